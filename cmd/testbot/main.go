@@ -6,10 +6,14 @@ import (
 
 	"github.com/wepogo/testbot"
 	"github.com/wepogo/testbot/farmer"
+	"github.com/wepogo/testbot/lint"
 	"github.com/wepogo/testbot/worker"
 )
 
 func main() {
+	if len(os.Args) == 2 && os.Args[1] == "lint" {
+		os.Args = append(os.Args, ".")
+	}
 	if n := len(os.Args); n < 2 || n != needArgs[os.Args[1]] {
 		usage()
 	}
@@ -24,6 +28,10 @@ func main() {
 			Dir:  os.Args[3],
 			Name: os.Args[4],
 		})
+	case "lint":
+		lint.Main(os.Args[2])
+	case "migrate":
+		farmer.Migrate(os.Args[2])
 	default:
 		usage()
 	}
@@ -38,13 +46,27 @@ const usageString = `usage:
   testbot farmer
   testbot worker
   testbot onejob [sha] [dir] [name]
+  testbot lint [dir]
+  testbot migrate up|status
 
-For onejob, sha is a git commit hash, dir is the location
+For onejob, sha is a git commit hash in the first
+repository in $GITHUB_REPOS, dir is the location
 of a Testfile relative to $I10R, and name is the name
 of an entry in the Testfile.
 
 Example:
   $ testbot onejob e3e9378da testbot gotest
+
+For lint, dir is the root of a checkout (default ".").
+Lint checks every Testfile in it, prints any problems
+with their file:line positions, and exits non-zero if
+it found any. It makes a good pre-commit hook.
+
+Migrate brings the farmer's database at $DATABASE_URL
+up to date with this version of testbot (up), or lists
+the schema migrations and which have been applied
+(status). The farmer refuses to start until its
+database is up to date.
 `
 
-var needArgs = map[string]int{"farmer": 2, "worker": 2, "onejob": 5}
+var needArgs = map[string]int{"farmer": 2, "worker": 2, "onejob": 5, "lint": 3, "migrate": 3}
@@ -15,6 +15,20 @@ const enspace = "\u2002"
 type prObj struct {
 	Number int
 	Head   struct{ SHA string }
+	Base   struct {
+		Ref string // branch name
+		SHA string
+	}
+	Labels []struct{ Name string }
+}
+
+func (pr prObj) hasLabel(name string) bool {
+	for _, l := range pr.Labels {
+		if l.Name == name {
+			return true
+		}
+	}
+	return false
 }
 
 type prEventReq struct {
@@ -22,23 +36,76 @@ type prEventReq struct {
 	//   assigned unassigned review_requested
 	//   review_request_removed labeled unlabeled opened
 	//   edited closed reopened synchronize [sic]
-	// We care about opened, closed, reopened, and synchronize.
+	// We care about opened, edited (for a new base branch),
+	// closed, reopened, and synchronize, and, for the merge
+	// queue, labeled and unlabeled.
 	Action string
-	PR     prObj `json:"pull_request"`
+	PR     prObj                 `json:"pull_request"`
+	Label  struct{ Name string } // for labeled and unlabeled
+
+	Repository struct {
+		FullName string `json:"full_name"` // owner/name
+	}
+}
+
+type pushEventReq struct {
+	Ref     string // refs/heads/branch for a branch
+	Before  string // previous head; all zeros for a new branch
+	After   string // new head
+	Deleted bool
+
+	Repository struct {
+		FullName string `json:"full_name"` // owner/name
+	}
+}
+
+type commentEventReq struct {
+	Action string // created, edited, or deleted
+	Issue  struct {
+		Number      int
+		PullRequest *struct{} `json:"pull_request"` // nil for an issue
+	}
+	Comment commentObj
+
+	Repository struct {
+		FullName string `json:"full_name"` // owner/name
+	}
+}
+
+type commentObj struct {
+	Body              string
+	AuthorAssociation string `json:"author_association"`
 }
 
-func createHook() error {
+// trusted returns whether the author of c owns the
+// repository, is a member of its organization,
+// or is a collaborator on it.
+func (c commentObj) trusted() bool {
+	switch c.AuthorAssociation {
+	case "OWNER", "MEMBER", "COLLABORATOR":
+		return true
+	}
+	return false
+}
+
+// zeroSHA is the Before of a push that
+// creates a branch.
+const zeroSHA = "0000000000000000000000000000000000000000"
+
+// createHook subscribes to event events for repo,
+// to be delivered to callback, a path on this farmer.
+func createHook(repo, event, callback string) error {
 	// We use PubSubHubbub here because it is idempotent
 	// (unlike the github webhook api).
 	data := url.Values{
 		"hub.mode":     {"subscribe"},
-		"hub.topic":    {fmt.Sprintf("https://github.com/%s/%s/events/pull_request.json", org, repo)},
-		"hub.callback": {selfURLf("pr-hook")},
+		"hub.topic":    {fmt.Sprintf("https://github.com/%s/events/%s.json", repo, event)},
+		"hub.callback": {selfURLf(callback)},
 		"hub.secret":   {hookSecret},
 	}
 	err := gh.Postf(data, nil, "/hub")
 	if err != nil {
-		err = fmt.Errorf("unable to create hook. check $GITHUB_ORG [%s] or $GITHUB_REPO [%s]: %w", org, repo, err)
+		err = fmt.Errorf("unable to create hook. check $GITHUB_REPOS [%s]: %w", repo, err)
 		return err
 	}
 	return nil
@@ -48,18 +115,30 @@ func createHook() error {
 // from postPendingStatus and reportResults --
 // all other functions should use
 // postPendingStatus or markDone.
+// The shards of a Testfile entry share one status,
+// named for the entry; see shardStatus.
 func postStatus(ctx context.Context, job testbot.Job, state, desc, url string) error {
+	name := job.Name
+	if entry, shard, shards, ok := testbot.ParseShard(job.Name); ok {
+		var post bool
+		var err error
+		state, desc, post, err = shardStatus(ctx, job, entry, shard, shards, state, desc)
+		if err != nil || !post {
+			return err
+		}
+		name = entry
+	}
 	body := map[string]string{
 		"state":       state, // error, failure, pending, or success
 		"target_url":  url,
 		"description": abbrevMiddle(desc, 140),
-		"context":     job.Dir + enspace + job.Name,
+		"context":     job.Dir + enspace + name,
 	}
-	err := gh.Postf(body, nil, "statuses/%s", job.SHA)
+	err := gh.Postf(body, nil, "%s/statuses/%s", job.Repo, job.SHA)
 	if err != nil {
 		// Sometimes this fails. Try once more.
 		time.Sleep(250 * time.Millisecond)
-		err = gh.Postf(body, nil, "statuses/%s", job.SHA)
+		err = gh.Postf(body, nil, "%s/statuses/%s", job.Repo, job.SHA)
 	}
 	return err
 }
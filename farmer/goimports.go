@@ -0,0 +1,222 @@
+package farmer
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// goImports is an affectedResolver for Go code.
+// It considers a Go package affected if it is in
+// the same directory as a changed file, or if it
+// imports an affected package (including in tests).
+// It returns the directory of every affected package,
+// along with all their ancestors, since a Testfile
+// often runs the tests for an entire subtree.
+//
+// It keeps a local clone of each repo under $GO_CHECKOUT,
+// and needs git and go installed on the farmer host.
+type goImports struct {
+	mu sync.Mutex // serializes use of the local clones
+}
+
+// A goPackage is the output of go list
+// for a single package.
+type goPackage struct {
+	ImportPath   string
+	Dir          string // absolute path in the repo
+	Imports      []string
+	TestImports  []string
+	XTestImports []string
+}
+
+func (g *goImports) affectedDirs(ctx context.Context, repo, sha string, changed []string) ([]string, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	dir := filepath.Join(goCheckout, filepath.FromSlash(repo))
+	err := checkout(ctx, dir, repo, sha)
+	if err != nil {
+		return nil, fmt.Errorf("checkout %s %s: %w", repo, sha, err)
+	}
+	pkgs, err := listGoPackages(ctx, dir)
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, file := range changed {
+		dirs = append(dirs, path.Dir(file))
+	}
+	return fillParents(goDependents(pkgs, dirs)), nil
+}
+
+// goDependents returns the directories of all packages
+// in pkgs that are in dirs, or that transitively import
+// a package in dirs.
+func goDependents(pkgs []goPackage, dirs []string) []string {
+	importers := make(map[string][]goPackage)
+	for _, p := range pkgs {
+		var imports []string
+		imports = append(imports, p.Imports...)
+		imports = append(imports, p.TestImports...)
+		imports = append(imports, p.XTestImports...)
+		for _, imp := range imports {
+			importers[imp] = append(importers[imp], p)
+		}
+	}
+
+	isChanged := make(map[string]bool)
+	for _, dir := range dirs {
+		isChanged[dir] = true
+	}
+	seen := make(map[string]bool)
+	var queue []goPackage
+	for _, p := range pkgs {
+		if isChanged[p.Dir] && !seen[p.ImportPath] {
+			seen[p.ImportPath] = true
+			queue = append(queue, p)
+		}
+	}
+
+	var affected []string
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		affected = append(affected, p.Dir)
+		for _, q := range importers[p.ImportPath] {
+			if !seen[q.ImportPath] {
+				seen[q.ImportPath] = true
+				queue = append(queue, q)
+			}
+		}
+	}
+	sort.Strings(affected)
+	return uniq(affected)
+}
+
+// listGoPackages lists the packages in every Go module
+// in the repo checked out in root.
+func listGoPackages(ctx context.Context, root string) ([]goPackage, error) {
+	var modules []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		name := fi.Name()
+		if fi.IsDir() && p != root && (name == "vendor" || name == "testdata" || strings.HasPrefix(name, ".") || strings.HasPrefix(name, "_")) {
+			return filepath.SkipDir
+		}
+		if !fi.IsDir() && name == "go.mod" {
+			modules = append(modules, filepath.Dir(p))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	const format = `{{.ImportPath}}	{{.Dir}}	` +
+		`{{join .Imports " "}}	{{join .TestImports " "}}	{{join .XTestImports " "}}`
+	var pkgs []goPackage
+	for _, mod := range modules {
+		var out, stderr bytes.Buffer
+		cmd := exec.CommandContext(ctx, "go", "list", "-e", "-f", format, "./...")
+		cmd.Dir = mod
+		cmd.Env = goListEnv
+		cmd.Stdout = &out
+		cmd.Stderr = &stderr
+		err := cmd.Run()
+		if err != nil {
+			return nil, fmt.Errorf("go list in %s: %w: %s", mod, err, stderr.Bytes())
+		}
+		sc := bufio.NewScanner(&out)
+		for sc.Scan() {
+			f := strings.Split(sc.Text(), "\t")
+			if len(f) != 5 {
+				continue
+			}
+			rel, err := filepath.Rel(root, f[1])
+			if err != nil {
+				return nil, err
+			}
+			pkgs = append(pkgs, goPackage{
+				ImportPath:   f[0],
+				Dir:          path.Join("/", filepath.ToSlash(rel)),
+				Imports:      strings.Fields(f[2]),
+				TestImports:  strings.Fields(f[3]),
+				XTestImports: strings.Fields(f[4]),
+			})
+		}
+	}
+	return pkgs, nil
+}
+
+// goListEnv is the environment for go list in
+// a checkout, which we don't trust: it may not
+// download anything, including a toolchain,
+// change go.mod, or run cgo's pkg-config.
+var goListEnv = append(os.Environ(),
+	"GOFLAGS=-mod=readonly",
+	"GOPROXY=off",
+	"GOTOOLCHAIN=local",
+	"GOWORK=off",
+	"CGO_ENABLED=0",
+)
+
+// checkout makes dir a clean checkout of commit sha
+// in repo, cloning repo first if necessary.
+func checkout(ctx context.Context, dir, repo, sha string) error {
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		u := fmt.Sprintf("https://github.com/%s.git", repo)
+		err = git(ctx, "", "clone", "--quiet", "--no-checkout", u, dir)
+		if err != nil {
+			return err
+		}
+	}
+	if git(ctx, dir, "cat-file", "-e", sha+"^{commit}") != nil {
+		// GitHub lets us fetch any commit by its hash,
+		// including the heads of pull requests from forks.
+		err := git(ctx, dir, "fetch", "--quiet", "origin", sha)
+		if err != nil {
+			return err
+		}
+	}
+	err := git(ctx, dir, "checkout", "--quiet", "--force", "--detach", sha)
+	if err != nil {
+		return err
+	}
+	return git(ctx, dir, "clean", "--quiet", "-xdf")
+}
+
+// git runs git with arg in dir, authenticating
+// to GitHub with $GITHUB_TOKEN.
+func git(ctx context.Context, dir string, arg ...string) error {
+	// Pass the token in the environment, rather than
+	// in the remote URL, so it isn't stored in the clone,
+	// or in argv, where any process can read it.
+	auth := base64.StdEncoding.EncodeToString([]byte("x-access-token:" + os.Getenv("GITHUB_TOKEN")))
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "git", arg...)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(),
+		"GIT_CONFIG_COUNT=1",
+		"GIT_CONFIG_KEY_0=http.extraHeader",
+		"GIT_CONFIG_VALUE_0=Authorization: basic "+auth,
+	)
+	cmd.Stderr = &stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("git %s: %w: %s", arg[0], err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	return nil
+}
@@ -41,7 +41,168 @@ by a colon followed by a shell command. For example:
     gctrace: GODEBUG=gctrace=1 go test
 
 Lines beginning with # are ignored. Blank lines are
-ignored. Lines that don't fit this format are an error.
+ignored. Lines that don't fit this format are an error,
+as is a second entry with the same name as another,
+even in an included file.
+
+An entry can be followed directly (with no blank line
+between) by indented option lines, each an option name
+followed by a colon and a value:
+
+    integration: go test -tags integration ./...
+        timeout: 10m
+        env: PGHOST=localhost
+        env: GOFLAGS=-race -count=1
+        retries: 2
+        allow_failure: true
+
+An indented line anywhere else, such as after a blank
+line, is an entry, even if it is named like an option.
+
+The options are:
+
+    timeout        how long the test may run, as a Go
+                   duration string such as 90s or 10m
+                   (default is the worker's JOB_TIMEOUT)
+    env            an environment variable for the test,
+                   as name=value (repeat for more)
+    retries        how many more times to run the test
+                   if it fails, perhaps on another worker
+                   (default 0); a test that passes on
+                   a retry is reported as flaky
+    allow_failure  if true, report a failing test as
+                   passing (default false)
+    needs          tests that must pass before this
+                   one runs, separated by spaces
+                   (see Dependencies below)
+    paths          glob patterns for files that affect
+                   this test, separated by spaces
+                   (see Finding Tests below)
+    labels         worker labels this test requires,
+                   separated by spaces (see Workers below)
+    matrix         a variable and a comma-separated list
+                   of values for it (see Matrix below)
+    shards         how many workers to split the test
+                   across (see Shards below)
+
+
+Matrix
+
+A test with one or more matrix options runs once for
+each combination of values of its matrix variables,
+each run a separate test with its own status on GitHub.
+Each matrix variable is set in the test's environment.
+
+    gotest: go test ./...
+        matrix: GOFLAGS=-race,
+        matrix: NODE=10,12
+
+This defines four tests, named by appending the values
+to the name: gotest_race_10, gotest_race_12,
+gotest_none_10, and gotest_none_12. (In names, each run
+of characters other than letters, digits, and
+underscores becomes an underscore, and an empty value
+becomes "none".) Naming gotest in a needs option (or
+/dir/gotest, from another Testfile) means all four.
+
+
+Shards
+
+A test with the option shards: N runs as N separate
+tests, which can run on different workers at once.
+Each one's environment has TESTBOT_SHARD_INDEX, from
+0 to N-1, and TESTBOT_SHARD_TOTAL, N, so the command
+can run its own part of the tests:
+
+    e2e: ./e2e.sh --part $TESTBOT_SHARD_INDEX/$TESTBOT_SHARD_TOTAL
+        shards: 4
+
+This defines four tests, e2e_shard0of4 through
+e2e_shard3of4, but they share one status on GitHub,
+named e2e, which fails as soon as any shard fails,
+and passes once every shard has passed. Each shard is
+retried on its own, if the test has a retries option.
+A matrix test with shards has shards for each value.
+Naming e2e in a needs option, from any Testfile, means
+all of its shards.
+Names like e2e_shard0of4 are reserved for shards; any
+other test named that way is an error.
+
+
+Includes and Variables
+
+A Testfile can include another file, to share entries
+among Testfiles. An include line names the file to
+include, relative to the root of the repo:
+
+    include: /testbot/go.Testfile
+
+The entries in the included file become entries of the
+including Testfile, and run in the including Testfile's
+directory, just as if the included file's lines were
+written in place of the include line. An included file
+can include other files too, but not in a cycle. It's
+an error to include a file that doesn't exist.
+
+A var line defines a variable, and {{name}} anywhere
+after it in the file (or in files it includes) stands
+for the variable's value. This lets an included file
+serve as a template:
+
+    # in /testbot/go.Testfile
+    vet: go vet {{PKG}}
+    gotest: go test -race {{PKG}}
+
+    # in /server/Testfile
+    var: PKG=./server/...
+    include: /testbot/go.Testfile
+
+Variables defined in an included file don't affect the
+file that includes it. Text like {{name}} where name
+isn't a defined variable is left alone.
+
+Names "include", "var", and "watch" (see Finding Tests)
+can't be used as test names.
+
+
+Dependencies
+
+A test can wait for other tests on the same commit to
+pass before it runs, by listing them in a needs option.
+Name a test in the same Testfile by its name alone, and
+a test in another Testfile by that Testfile's directory
+followed by the test name:
+
+    build: make
+    e2e: make e2e
+        needs: build /lib/shared/gotest
+
+If a needed test fails, the waiting test doesn't run,
+and its status reads "skipped: dependency failed". If a
+needed test isn't run at all for the pull request (for
+example, because its directory isn't affected), it
+doesn't hold anything up. Tests in one Testfile can't
+need each other in a cycle.
+
+
+Checking Testfiles
+
+If a Testfile has a syntax error, testbot reports it as
+a failed "Testfile" status on the pull request, linking
+to the offending line. To catch mistakes before pushing,
+run
+
+    testbot lint
+
+in your checkout (or testbot lint dir for some other
+checkout). It reads every Testfile, and prints each
+problem it finds with its file and line: syntax errors
+(such as duplicate entry names), empty commands, needs
+that name nonexistent tests, watch lines for nonexistent
+directories, and files testbot will never read, such as
+a file called testfile or a .Testfile nobody includes.
+It exits non-zero if it found any problems, so it works
+as a pre-commit hook.
 
 
 Finding Tests
@@ -67,6 +228,50 @@ directories would be /, /a, /a/b, /d, /f, /h, and /j.
 Note in particular that merely deleting a file from a
 directory will run the tests in that directory.
 
+A Testfile can also watch other directories, with a
+watch line naming one or more absolute directories:
+
+    watch: /lib/shared /proto
+
+Any change in a watched directory, or anywhere in the
+tree rooted in it, affects the Testfile just as if it
+were in the Testfile's own directory.
+
+If this testbot is configured to use the goimports
+resolver, then for Go code, a directory is also affected
+if it contains a package that imports (directly or
+indirectly, including from tests) a package in a
+directory with changed files. In that case, all of the
+affected directory's ancestors are affected too.
+
+A test with a paths option runs only if the pull request
+changes a file matching at least one of its patterns,
+even when its Testfile's directory is affected. A
+pattern is relative to the Testfile's directory, unless
+it starts with a slash, in which case it's relative to
+the root of the repo. Patterns are like shell globs,
+except that ** stands for any number of directories:
+
+    migrations: ./migrate-test.sh
+        paths: db/**/*.sql /go.mod
+
+
+Workers
+
+Ordinarily any worker can run any test. Workers can
+advertise labels for special capabilities (see LABELS
+in the worker's configuration), and a test can require
+them with a labels option:
+
+    e2e: ./run-e2e.sh
+        labels: big-mem linux
+
+Such a test runs only on a worker that has all the
+labels it lists. If no connected worker has them, the
+test waits, and its live page says "no eligible worker"
+until one connects. The jobs list on the home page shows
+these tests too.
+
 
 Test Environment
 
@@ -0,0 +1,143 @@
+package farmer
+
+import (
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/wepogo/testbot/log"
+)
+
+// A DurationBucket summarizes the results
+// of one Testfile entry over a span of time.
+// Durations are of successful runs only,
+// since a failure can stop a test early.
+type DurationBucket struct {
+	Start       time.Time
+	Runs        int
+	Successes   int
+	SuccessRate float64 // Successes / Runs
+	P50MS       int
+	P90MS       int
+	MaxMS       int
+}
+
+// bucketSize returns the span of time summarized
+// by each bucket in a history over window,
+// and its name.
+func bucketSize(window time.Duration) (time.Duration, string) {
+	switch {
+	case window <= 2*24*time.Hour:
+		return time.Hour, "hour"
+	case window <= 90*24*time.Hour:
+		return 24 * time.Hour, "day"
+	}
+	return 7 * 24 * time.Hour, "week"
+}
+
+// durationHistory summarizes results, which must be
+// oldest first, in buckets of size span, oldest first.
+// Spans with no results have no bucket.
+func durationHistory(results []ResultInfo, span time.Duration) []DurationBucket {
+	var a []DurationBucket
+	var elapsed []int // of successes in the last bucket
+	for _, r := range results {
+		start := r.CreatedAt.Truncate(span)
+		if len(a) == 0 || !a[len(a)-1].Start.Equal(start) {
+			if len(a) > 0 {
+				a[len(a)-1].setDurations(elapsed)
+			}
+			a = append(a, DurationBucket{Start: start})
+			elapsed = elapsed[:0]
+		}
+		b := &a[len(a)-1]
+		b.Runs++
+		if r.State == "success" {
+			b.Successes++
+			elapsed = append(elapsed, r.ElapsedMS)
+		}
+	}
+	if len(a) > 0 {
+		a[len(a)-1].setDurations(elapsed)
+	}
+	for i := range a {
+		a[i].SuccessRate = float64(a[i].Successes) / float64(a[i].Runs)
+	}
+	return a
+}
+
+func (b *DurationBucket) setDurations(ms []int) {
+	if len(ms) == 0 {
+		return
+	}
+	sort.Ints(ms)
+	b.P50MS = percentile(ms, 50)
+	b.P90MS = percentile(ms, 90)
+	b.MaxMS = ms[len(ms)-1]
+}
+
+// percentile returns the p-th percentile of sorted,
+// by the nearest-rank method.
+func percentile(sorted []int, p int) int {
+	i := int(math.Ceil(float64(p)/100*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+// history serves the duration history of the entry
+// named by the path, over the window (default 90d),
+// along with each of its results, including the
+// host that ran it.
+func history(w http.ResponseWriter, req *http.Request) {
+	repo, dir, name, err := parseEntryPath(strings.TrimPrefix(req.URL.Path, "/history/"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	window := or(req.URL.Query().Get("window"), "90d")
+	d, err := parseWindow(window)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	results, err := store.EntryResults(req.Context(), repo, dir, name, d)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	span, spanName := bucketSize(d)
+	data := struct {
+		Repo, Dir, Name string
+		Path            string // see entryPath
+		Window          string
+		Bucket          string
+		Buckets         []DurationBucket
+		Results         []ResultInfo // newest first
+	}{
+		Repo:    repo,
+		Dir:     dir,
+		Name:    name,
+		Path:    entryPath(repo, dir, name),
+		Window:  window,
+		Bucket:  spanName,
+		Buckets: durationHistory(results, span),
+	}
+	for i := len(results) - 1; i >= 0; i-- {
+		data.Results = append(data.Results, results[i])
+	}
+	forDisplay(data.Results)
+	if wantJSON(req) {
+		writeJSON(w, req, data)
+		return
+	}
+	w.Header().Set("Content-Language", "en")
+	err = historyPage.Execute(w, data)
+	if err != nil {
+		log.Error(req.Context(), err, "history template")
+	}
+}
@@ -0,0 +1,68 @@
+package farmer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wepogo/testbot"
+)
+
+func TestDurationHistory(t *testing.T) {
+	day := time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)
+	result := func(hour int, state string, ms int) ResultInfo {
+		return ResultInfo{State: state, ElapsedMS: ms, CreatedAt: day.Add(time.Duration(hour) * time.Hour)}
+	}
+	results := []ResultInfo{
+		result(1, "success", 40),
+		result(2, "success", 10),
+		result(3, "failure", 1),
+		result(4, "success", 20),
+		result(5, "success", 30),
+		result(25, "failure", 5),
+	}
+	got := durationHistory(results, 24*time.Hour)
+	want := []DurationBucket{
+		{Start: day, Runs: 5, Successes: 4, SuccessRate: 0.8, P50MS: 20, P90MS: 40, MaxMS: 40},
+		{Start: day.Add(24 * time.Hour), Runs: 1, SuccessRate: 0},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("durationHistory = %+v, want %+v", got, want)
+	}
+}
+
+func TestHistoryHandler(t *testing.T) {
+	gpu := setupMem(t)
+	ctx := context.Background()
+	must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1", Host: "h1", Labels: []string{"gpu"}}))
+	must(t, schedule(ctx))
+	must(t, markDone(ctx, gpu, "success", "", "", 3*time.Second))
+
+	w := do(http.HandlerFunc(history), "GET", "/history/org/repo/a/gpu?format=json", "")
+	var page struct {
+		Buckets []DurationBucket
+		Results []ResultInfo
+	}
+	must(t, json.Unmarshal(w.Body.Bytes(), &page))
+	if len(page.Buckets) != 1 || page.Buckets[0].P50MS != 3000 {
+		t.Errorf("buckets = %+v, want one with p50 3000ms", page.Buckets)
+	}
+	if len(page.Results) != 1 || page.Results[0].Host != "h1" {
+		t.Errorf("results = %+v, want one on host h1", page.Results)
+	}
+
+	w = do(http.HandlerFunc(history), "GET", "/history/org/repo/a/gpu", "")
+	if body := w.Body.String(); !strings.Contains(body, "100.0%") || !strings.Contains(body, " h1") {
+		t.Errorf("history page = %q, want 100%% success on host h1", body)
+	}
+
+	// Results link to their entry's history.
+	w = do(http.HandlerFunc(index), "GET", "/", "")
+	if !strings.Contains(w.Body.String(), "/history/org/repo/a/gpu") {
+		t.Errorf("home page has no link to history:\n%s", w.Body)
+	}
+}
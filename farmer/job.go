@@ -3,9 +3,14 @@ package farmer
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"path"
 	"sort"
+	"strings"
 	"time"
 
 	"github.com/wepogo/testbot"
@@ -19,8 +24,10 @@ import (
 // test jobs to run.
 // The initial file list is retrieved synchronously,
 // but the rest is done in a background goroutine.
-func populateJobs(ctx context.Context, pr prObj) error {
-	modified, err := upsertPR(ctx, pr.Number, pr.Head.SHA)
+// If $TEST_MERGE is set, the jobs test the merge of
+// the pull request's head into its base.
+func populateJobs(ctx context.Context, repo string, pr prObj) error {
+	modified, err := upsertPR(ctx, repo, pr.Number, pr.Head.SHA, pr.Base.Ref)
 	if err != nil {
 		return fmt.Errorf("upserting pr: %w", err)
 	}
@@ -34,78 +41,394 @@ func populateJobs(ctx context.Context, pr prObj) error {
 	// because we'll get another event for the new HEAD and
 	// correctly populate that one, and the jobs for this SHA
 	// will need to be canceled anyway.
+	changed, err := prFiles(ctx, repo, pr.Number)
+	if err != nil {
+		return fmt.Errorf("getting pr files: %w", err)
+	}
+
+	var base string
+	if testMerge {
+		base = pr.Base.SHA
+	}
+	go populateJobsBG(repo, pr.Head.SHA, base, changed)
+	return nil
+}
+
+// prFiles returns the absolute paths of the files
+// changed by pull request num in repo.
+func prFiles(ctx context.Context, repo string, num int) ([]string, error) {
 	var files []struct{ Filename string }
-	err = gh.GetAllf(&files, "pulls/%d/files", pr.Number)
+	err := gh.GetAllf(&files, "%s/pulls/%d/files", repo, num)
 	for err == github.StatusError(404) {
 		// The GitHub API may 404 for a PR they just delivered
 		// a webhook for. Retry until it succeeds. Under normal
 		// operations, a PR can't be deleted (only closed), so
 		// this is safe to retry.
-		err = gh.GetAllf(&files, "pulls/%d/files", pr.Number)
+		err = gh.GetAllf(&files, "%s/pulls/%d/files", repo, num)
 	}
 	if err != nil {
-		return fmt.Errorf("getting pr files: %w", err)
+		return nil, err
 	}
-	var dirs []string
+	var changed []string
 	for _, file := range files {
-		dirs = append(dirs, path.Dir("/"+file.Filename))
+		changed = append(changed, "/"+file.Filename)
+	}
+	return changed, nil
+}
+
+// compareFiles returns the absolute paths of the files
+// changed in repo between commits before and after.
+func compareFiles(ctx context.Context, repo, before, after string) ([]string, error) {
+	var cmp struct {
+		Files []struct{ Filename string }
+	}
+	err := gh.Getf(&cmp, "%s/compare/%s...%s", repo, before, after)
+	if err != nil {
+		return nil, err
+	}
+	var changed []string
+	for _, file := range cmp.Files {
+		changed = append(changed, "/"+file.Filename)
+	}
+	return changed, nil
+}
+
+// populatePushJobs is like populateJobs, but for
+// commit after, pushed to branch. The affected files
+// are those changed since before, the previous head
+// of branch.
+func populatePushJobs(ctx context.Context, repo, branch, before, after string) error {
+	added, err := store.AddPush(ctx, repo, branch, after)
+	if err != nil {
+		return fmt.Errorf("adding push: %w", err)
+	}
+	if !added {
+		return nil // nothing new to do
+	}
+	if before == zeroSHA {
+		// A new branch. There's nothing sensible
+		// to compare it to, so there's nothing to test.
+		log.Printkv(ctx, "at", "push", "repo", repo, "branch", branch, "warning", "new branch; not testing")
+		return nil
+	}
+
+	changed, err := compareFiles(ctx, repo, before, after)
+	if err != nil {
+		return fmt.Errorf("comparing push: %w", err)
+	}
+
+	go populateJobsBG(repo, after, "", changed)
+	return nil
+}
+
+// retestBase re-tests the pull requests in repo
+// whose base is branch, after its head moved from
+// before to after, according to $MERGE_RETEST.
+// If it is none, it does nothing. If it is affected,
+// it re-tests the jobs in Testfiles affected by both
+// the pull request and the push. If it is all, it
+// re-tests every job for the pull request.
+// Each job is re-tested merged into after.
+// A job that is already running finishes against
+// the old base.
+func retestBase(ctx context.Context, repo, branch, before, after string) error {
+	if mergeRetest == "none" {
+		return nil
+	}
+	prs, err := store.BranchPRs(ctx, repo, branch)
+	if err != nil || len(prs) == 0 {
+		return err
+	}
+	var baseChanged []string
+	if mergeRetest == "affected" {
+		baseChanged, err = compareFiles(ctx, repo, before, after)
+		if err != nil {
+			return fmt.Errorf("comparing push: %w", err)
+		}
+	}
+	for _, pr := range prs {
+		go retestPR(repo, pr, after, baseChanged)
+	}
+	return nil
+}
+
+// retestPR re-tests pull request pr in repo, merged
+// into base. See retestBase.
+func retestPR(repo string, pr PR, base string, baseChanged []string) {
+	ctx := context.Background()
+	changed, err := prFiles(ctx, repo, pr.Num)
+	var testfiles []string
+	if err == nil {
+		testfiles, err = affectedTestfiles(ctx, repo, pr.Head, changed)
+	}
+	if err == nil && mergeRetest == "affected" {
+		var also []string
+		also, err = affectedTestfiles(ctx, repo, pr.Head, baseChanged)
+		testfiles = intersect(testfiles, also)
+	}
+	if err != nil {
+		log.Error(ctx, err, "re-testing pull request")
+		time.Sleep(time.Second)
+		go retestPR(repo, pr, base, baseChanged)
+		return
+	}
+	fetchJobs(repo, pr.Head, base, testfiles, changed)
+}
+
+// An affectedResolver is a strategy for finding which
+// Testfiles are affected by a change.
+//
+// Given the absolute paths in repo of the changed
+// files at commit sha, affectedDirs returns directories
+// whose Testfiles should run. It's fine to return
+// directories that have no Testfile.
+type affectedResolver interface {
+	affectedDirs(ctx context.Context, repo, sha string, changed []string) ([]string, error)
+}
+
+type resolverFunc func(ctx context.Context, repo, sha string, changed []string) ([]string, error)
+
+func (f resolverFunc) affectedDirs(ctx context.Context, repo, sha string, changed []string) ([]string, error) {
+	return f(ctx, repo, sha, changed)
+}
+
+// resolvers holds every available affectedResolver,
+// by the name used to enable it in $RESOLVERS.
+var resolvers = map[string]affectedResolver{
+	"parents":   resolverFunc(parentDirs),
+	"watch":     resolverFunc(watchDirs),
+	"goimports": new(goImports),
+}
+
+// enabledResolvers returns the resolvers named
+// in the comma-separated list names.
+func enabledResolvers(names string) ([]affectedResolver, error) {
+	var a []affectedResolver
+	for _, name := range strings.Split(names, ",") {
+		r, ok := resolvers[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown resolver %q", name)
+		}
+		a = append(a, r)
+	}
+	return a, nil
+}
+
+// parentDirs considers every ancestor directory
+// of every changed file to be affected.
+func parentDirs(ctx context.Context, repo, sha string, changed []string) ([]string, error) {
+	var dirs []string
+	for _, file := range changed {
+		dirs = append(dirs, path.Dir(file))
 	}
+	return fillParents(dirs), nil
+}
+
+// affectedTestfiles returns the paths of all
+// Testfiles affected by the changed files in repo
+// at sha, according to all enabled resolvers.
+func affectedTestfiles(ctx context.Context, repo, sha string, changed []string) ([]string, error) {
+	var dirs []string
+	for _, r := range affected {
+		a, err := r.affectedDirs(ctx, repo, sha, changed)
+		if err != nil {
+			return nil, err
+		}
+		dirs = append(dirs, a...)
+	}
+	sort.Strings(dirs)
 	var testfiles []string
-	for _, dir := range fillParents(dirs) {
+	for _, dir := range uniq(dirs) {
 		testfiles = append(testfiles, path.Join(dir, testfile))
 	}
+	return testfiles, nil
+}
 
-	go populateJobsBG(pr.Head.SHA, testfiles)
-	return nil
+// populateJobsBG finds the Testfiles affected by
+// the changed files in repo at commit sha, then
+// fetches them.
+func populateJobsBG(repo, sha, base string, changed []string) {
+	ctx := context.Background()
+	testfiles, err := affectedTestfiles(ctx, repo, sha, changed)
+	if err != nil {
+		log.Error(ctx, err, "finding affected Testfiles")
+		time.Sleep(time.Second)
+		go populateJobsBG(repo, sha, base, changed)
+		return
+	}
+	fetchJobs(repo, sha, base, testfiles, changed)
 }
 
-func populateJobsBG(sha string, files []string) {
+// fetchJobs fetches and parses the Testfiles in files
+// in repo at commit sha, and inserts a job for each
+// entry affected by the changed files, to be merged
+// into commit base, if any, before it runs.
+func fetchJobs(repo, sha, base string, files, changed []string) {
 	ctx := context.Background()
-	var failed []string
+	failed := insertJobs(ctx, contentsOpen(ctx, repo, sha), repo, sha, base, files, changed)
+	if len(failed) > 0 {
+		time.Sleep(time.Second)
+		go fetchJobs(repo, sha, base, failed, changed)
+	}
+}
+
+// insertJobs is like fetchJobs, but it doesn't retry,
+// and it reads files with open.
+// It returns the files it couldn't fetch, or whose
+// jobs it couldn't insert. If it couldn't fetch any
+// of them, it inserts nothing, and returns them all.
+// For a Testfile with a syntax error, it records an
+// error result, with the offending line as its URL,
+// named after the Testfile (but with no job to run),
+// so the commit (for example, a merge queue batch)
+// doesn't pass.
+func insertJobs(ctx context.Context, open testbot.OpenFunc, repo, sha, base string, files, changed []string) (failed []string) {
+	type syntaxError struct {
+		file      string
+		job       testbot.Job
+		desc, url string
+	}
+	var found []string
+	var bad []syntaxError
+	tfs := make(map[string]*testbot.Testfile) // by directory
 	for _, file := range files {
 		dir := path.Dir(file)
-		var body bytes.Buffer
-		log.Printkv(ctx, "at", "fetch", "path", file, "ref", sha)
-		err := gh.Getf(&body, "contents/%s?ref=%s", file, sha)
-		if err == github.StatusError(404) {
+		tf, err := testbot.ReadTestfile(file, open)
+		if err, ok := err.(testbot.SyntaxError); ok {
+			job := testbot.Job{Repo: repo, SHA: sha, Dir: dir, Name: testfile}
+			// The error may be in an included file.
+			errFile := file
+			if err.File != "" {
+				errFile = err.File
+			}
+			fileURL := fmt.Sprintf("https://github.com/%s/blob/%s%s", repo, sha, errFile)
+			if err.Line > 0 {
+				fileURL += fmt.Sprintf("#L%d", err.Line)
+			}
+			found = append(found, file)
+			bad = append(bad, syntaxError{file, job, err.Error(), fileURL})
+			continue
+		}
+		if errors.Is(err, os.ErrNotExist) {
 			continue
 		} else if err != nil {
 			failed = append(failed, file)
 			log.Error(ctx, err)
 			continue
 		}
+		found = append(found, file)
+		tfs[dir] = tf
+	}
+	// Insert jobs from all Testfiles at once,
+	// so a job that needs a job in another Testfile
+	// can't start before that job exists.
+	// (A need with neither a job nor a result
+	// is satisfied; see need_state in schema.go.)
+	if len(failed) > 0 {
+		return append(failed, found...)
+	}
 
-		entries, err := testbot.ParseTestfile(&body)
-		if err, ok := err.(testbot.SyntaxError); ok {
-			job := testbot.Job{SHA: sha, Dir: dir, Name: testfile}
-			fileURL := fmt.Sprintf("https://github.com/%s/%s/blob/%s%s", org, repo, sha, file)
-			postStatus(ctx, job, "error", err.Error(), fileURL)
-			continue
+	var jobs []testbot.Job
+	needs := make(map[testbot.Job][]testbot.Job)
+	labels := make(map[testbot.Job][]string)
+	bases := make(map[testbot.Job]string)
+	retries := make(map[testbot.Job]int)
+	for _, file := range found {
+		dir := path.Dir(file)
+		tf := tfs[dir]
+		if tf == nil {
+			continue // syntax error
+		}
+		for name, entry := range tf.Entries {
+			if !entry.Affected(dir, changed) {
+				continue
+			}
+			job := testbot.Job{Repo: repo, SHA: sha, Dir: dir, Name: name}
+			jobs = append(jobs, job)
+			if len(entry.Needs) > 0 {
+				needs[job] = expandGroups(entry.Needed(job), tfs)
+			}
+			if len(entry.Labels) > 0 {
+				labels[job] = entry.Labels
+			}
+			if base != "" {
+				bases[job] = base
+			}
+			if entry.Retries > 0 {
+				retries[job] = entry.Retries
+			}
 		}
+	}
+
+	err := store.UpsertJobs(ctx, jobs, needs, labels, bases, retries)
+	if err != nil {
+		log.Error(ctx, err)
+		return found
+	}
+	for _, e := range bad {
+		err = store.AddResult(ctx, e.job, "error", e.desc, e.url)
 		if err != nil {
-			failed = append(failed, file)
+			failed = append(failed, e.file)
 			log.Error(ctx, err)
-			continue
 		}
-		var names []string
-		for name := range entries {
-			names = append(names, name)
+	}
+	for _, job := range jobs {
+		desc := "in queue"
+		if a := needs[job]; len(a) > 0 {
+			desc = "waiting for " + jobNames(job.Dir, a)
 		}
-		err = upsertJobs(ctx, sha, dir, names)
-		if err != nil {
-			failed = append(failed, file)
-			log.Error(ctx, err)
+		postPendingStatus(ctx, job, desc)
+	}
+	return failed
+}
+
+// expandGroups replaces each job in needs that names
+// a matrix or sharded entry in another Testfile in tfs,
+// by directory, with the jobs expanded from it.
+// (The parser expands those in the same Testfile.)
+func expandGroups(needs []testbot.Job, tfs map[string]*testbot.Testfile) []testbot.Job {
+	var a []testbot.Job
+	for _, need := range needs {
+		tf := tfs[need.Dir]
+		if tf == nil || tf.Groups[need.Name] == nil {
+			a = append(a, need)
 			continue
 		}
-		for _, name := range names {
-			job := testbot.Job{SHA: sha, Dir: dir, Name: name}
-			postPendingStatus(ctx, job, "in queue")
+		for _, name := range tf.Groups[need.Name] {
+			need.Name = name
+			a = append(a, need)
 		}
-		_ = file
 	}
-	if len(failed) > 0 {
-		time.Sleep(time.Second)
-		go populateJobsBG(sha, failed)
+	return a
+}
+
+// jobNames returns a list of the names of jobs
+// as they'd be written in the Testfile in dir.
+func jobNames(dir string, jobs []testbot.Job) string {
+	var a []string
+	for _, job := range jobs {
+		if job.Dir == dir {
+			a = append(a, job.Name)
+		} else {
+			a = append(a, path.Join(job.Dir, job.Name))
+		}
+	}
+	return strings.Join(a, ", ")
+}
+
+// contentsOpen returns an OpenFunc that reads files
+// in repo at commit sha using the GitHub contents API.
+func contentsOpen(ctx context.Context, repo, sha string) testbot.OpenFunc {
+	return func(name string) (io.ReadCloser, error) {
+		var body bytes.Buffer
+		log.Printkv(ctx, "at", "fetch", "repo", repo, "path", name, "ref", sha)
+		err := gh.Getf(&body, "%s/contents/%s?ref=%s", repo, name, sha)
+		if err == github.StatusError(404) {
+			return nil, fmt.Errorf("%s: %w", name, os.ErrNotExist)
+		} else if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(&body), nil
 	}
 }
 
@@ -133,3 +456,14 @@ func uniq(s []string) []string {
 	}
 	return a
 }
+
+// intersect returns the elements of a that are also in b.
+func intersect(a, b []string) []string {
+	var c []string
+	for _, v := range a {
+		if contains(b, v) {
+			c = append(c, v)
+		}
+	}
+	return c
+}
@@ -1,8 +1,16 @@
 package farmer
 
 import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/wepogo/testbot"
 )
 
 func TestFillParents(t *testing.T) {
@@ -22,3 +30,146 @@ func TestFillParentsRel(t *testing.T) {
 		t.Errorf("fillParents(%v) = %v, want %v", input, got, want)
 	}
 }
+
+func TestWatchers(t *testing.T) {
+	x := watchIndex{
+		"/lib/shared": {"/server", "/worker"},
+		"/proto":      {"/server"},
+	}
+	cases := []struct {
+		dirs []string
+		want []string
+	}{
+		{[]string{"/lib/shared"}, []string{"/server", "/worker"}},
+		{[]string{"/lib/shared/a/b", "/proto"}, []string{"/server", "/worker"}},
+		{[]string{"/proto/a"}, []string{"/server"}},
+		{[]string{"/lib"}, nil},
+		{[]string{"/lib/sharedx"}, nil},
+	}
+
+	for _, test := range cases {
+		got := x.watchers(test.dirs)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("watchers(%q) = %q, want %q", test.dirs, got, test.want)
+		}
+	}
+}
+
+func TestGoDependents(t *testing.T) {
+	pkgs := []goPackage{
+		{ImportPath: "m/lib/shared", Dir: "/lib/shared"},
+		{ImportPath: "m/lib/other", Dir: "/lib/other"},
+		{ImportPath: "m/server", Dir: "/server", Imports: []string{"m/server/api", "fmt"}},
+		{ImportPath: "m/server/api", Dir: "/server/api", Imports: []string{"m/lib/shared"}},
+		{ImportPath: "m/tools", Dir: "/tools", XTestImports: []string{"m/lib/shared"}},
+		{ImportPath: "m/cmd/x", Dir: "/cmd/x", Imports: []string{"m/lib/other"}},
+	}
+	cases := []struct {
+		dirs []string
+		want []string
+	}{
+		{[]string{"/lib/shared"}, []string{"/lib/shared", "/server", "/server/api", "/tools"}},
+		{[]string{"/lib/other", "/docs"}, []string{"/cmd/x", "/lib/other"}},
+		{[]string{"/server"}, []string{"/server"}},
+		{[]string{"/docs"}, nil},
+	}
+
+	for _, test := range cases {
+		got := goDependents(pkgs, test.dirs)
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("goDependents(%q) = %q, want %q", test.dirs, got, test.want)
+		}
+	}
+}
+
+func TestEnabledResolvers(t *testing.T) {
+	a, err := enabledResolvers("parents, goimports")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(a) != 2 {
+		t.Errorf("len(enabledResolvers) = %d, want 2", len(a))
+	}
+	_, err = enabledResolvers("parents,cobol")
+	if err == nil {
+		t.Error("enabledResolvers with unknown name: err = nil, want error")
+	}
+}
+
+func TestInsertJobsSyntaxError(t *testing.T) {
+	setupMem(t)
+	ctx := context.Background()
+	b := Batch{Repo: "org/repo", Branch: "main", Base: "base1", SHA: "merge1", PRs: []PR{{1, "c0ffee"}}}
+	must(t, store.PutBatch(ctx, b))
+	open := func(name string) (io.ReadCloser, error) {
+		if name != "/a/Testfile" {
+			return nil, os.ErrNotExist
+		}
+		return ioutil.NopCloser(strings.NewReader("unit: go test\nbogus\n")), nil
+	}
+	failed := insertJobs(ctx, open, b.Repo, b.SHA, "", []string{"/a/Testfile"}, []string{"/a/x.go"})
+	if len(failed) > 0 {
+		t.Fatalf("insertJobs failed for %v", failed)
+	}
+
+	done, result, err := batchResults(ctx, b)
+	must(t, err)
+	want := testbot.Job{Repo: "org/repo", SHA: "merge1", Dir: "/a", Name: "Testfile"}
+	if !done || result == nil || result.Job() != want || result.State != "error" {
+		t.Fatalf("batchResults = %v, %+v, want done, failed %v", done, result, want)
+	}
+	const wantURL = "https://github.com/org/repo/blob/merge1/a/Testfile#L2"
+	if result.URL != wantURL {
+		t.Errorf("result URL = %q, want %q", result.URL, wantURL)
+	}
+
+	// It's not a job, and can't become one.
+	if _, ok, _ := store.Job(ctx, want); ok {
+		t.Errorf("job %v exists, want only a result", want)
+	}
+	if _, err := retryResult(ctx, result.ID); err != errNoRetry {
+		t.Errorf("retryResult err = %v, want %v", err, errNoRetry)
+	}
+}
+
+func TestInsertJobsFetchError(t *testing.T) {
+	setupMem(t)
+	ctx := context.Background()
+	open := func(name string) (io.ReadCloser, error) {
+		if name == "/b/Testfile" {
+			return nil, errors.New("GitHub is down")
+		}
+		return ioutil.NopCloser(strings.NewReader("e2e: make e2e\n\tneeds: /b/unit\n")), nil
+	}
+	files := []string{"/a/Testfile", "/b/Testfile"}
+	failed := insertJobs(ctx, open, "org/repo", "c0ffee", "", files, []string{"/a/x.go", "/b/x.go"})
+	if want := []string{"/b/Testfile", "/a/Testfile"}; !reflect.DeepEqual(failed, want) {
+		t.Errorf("insertJobs failed = %v, want %v", failed, want)
+	}
+	// Not even e2e, which would run before /b/unit exists.
+	e2e := testbot.Job{Repo: "org/repo", SHA: "c0ffee", Dir: "/a", Name: "e2e"}
+	if _, ok, _ := store.Job(ctx, e2e); ok {
+		t.Errorf("job %v inserted before all Testfiles loaded", e2e)
+	}
+}
+
+func TestExpandGroups(t *testing.T) {
+	tf, err := testbot.ParseTestfile(strings.NewReader("gotest: go test\n\tshards: 2\nvet: go vet\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tfs := map[string]*testbot.Testfile{"/lib": tf}
+	job := func(dir, name string) testbot.Job {
+		return testbot.Job{Repo: "org/repo", SHA: "c0ffee", Dir: dir, Name: name}
+	}
+	needs := []testbot.Job{job("/lib", "gotest"), job("/lib", "vet"), job("/other", "gotest")}
+	want := []testbot.Job{
+		job("/lib", "gotest_shard0of2"),
+		job("/lib", "gotest_shard1of2"),
+		job("/lib", "vet"),
+		job("/other", "gotest"),
+	}
+	if got := expandGroups(needs, tfs); !reflect.DeepEqual(got, want) {
+		t.Errorf("expandGroups = %v, want %v", got, want)
+	}
+}
@@ -10,57 +10,74 @@ and test-runner processes.
 On the GitHub side, it receives events for Pull Request
 state changes (opened, closed, reopened, synchronize [sic])
 and sends updates of the status of zero or more tests on
-each commit.
+each commit. If PUSH_BRANCHES is set, it also receives
+push events, and tests each commit pushed to one of those
+branches; unlike a pull request's, those jobs aren't
+canceled by a later push. If MERGE_QUEUE is set, it also
+merges pull requests for which it is asked to, after
+testing them together; see queue.go.
 
 On the test-runner side, it listens for boxes to
-announce they are (still) alive (with a ping message),
-to request work to do (with a longpoll message, doling
-out jobs as they become available), and to report the
-status of finished jobs (with a runstatus message).
-
-Most of the data model is represented in the Postgres
-schema. Some tables (pr and job) mirror the state of
-GitHub, recording the events GitHub sends and a list of
-jobs for each commit the farmer retrieves from files in
-the repo. Other tables (box) mirror the state of
-test-runner boxes, recording the messages they send. (As
-of this writing, that is just the fact that a box exists
-and when it was last heard from.)
-
-Postgres triggers assign jobs to boxes whenever new jobs
-appear or boxes become available (either because an
-existing job finishes or because a new box comes
-online). Foreign keys remove assignments whenever jobs
-are deleted (when a job is finished or canceled) and
-whenever boxes are deleted (because they've stopped
-pinging). At any given time, the run table shows the
-current assignment of jobs to boxes. Whenever the
-assignment for a particular box changes (from no job to
-a job, from a job to no job, or from one job to
-another), farmer notifies the box of its new box state
-via the pending or next longpoll request.
+announce they are (still) alive (with a ping message,
+which carries the box's labels, and whether it is
+draining, that is, shutting down), to request work to
+do (with a longpoll message, doling out jobs as they
+become available), to report the status of finished
+jobs (with a runstatus message), and to give back jobs
+they won't run after all (with a release message).
+
+The data model lives behind the Store interface (see
+store.go). The Postgres Store is the real one; an
+in-memory Store, with the same behavior, serves for
+development and tests (set DATABASE_URL=memory).
+Some of the state (pull requests, pushes, the merge
+queue, and jobs) mirrors GitHub, recording the events
+GitHub sends and the jobs the farmer reads from the
+Testfiles at each commit. The rest mirrors the boxes:
+when each was last heard from, its labels, and whether
+it is draining. Results record each finished job.
+A Store also keeps a few rules of its own, such as
+deleting the jobs for a commit no longer wanted and
+skipping jobs whose needs failed; in Postgres,
+triggers keep them (see schema.go).
+
+Whenever new jobs appear or boxes become available
+(either because an existing job finishes or because a
+new box comes online), the Store notifies the farmer,
+which assigns waiting jobs to idle boxes using a
+Scheduler, in Go (see sched.go). A draining box gets
+no new jobs. Deleting a job (when it is finished or
+canceled) or a box (because it stopped pinging)
+deletes its assignment. At any given time, the runs
+show the current assignment of jobs to boxes.
+Whenever the assignment for a particular box changes
+(from no job to a job, from a job to no job, or from
+one job to another), farmer notifies the box of its
+new box state via the pending or next longpoll request.
 
 When a job runs to completion (success or failure), the
-runstatus handler atomically moves the job to the result
-table (deleting it from job and inserting it in result)
-along with its final state.
-
-Since Postgres is responsible for maintaining
-consistency of the data model, the Go code in farmer is
-mainly concerned with plumbing: listening for HTTP
-requests, inserting and deleting records when
-appropriate, and synchronizing responses to state
-changes (by LISTENing to NOTIFY messages sent by
-triggers in stored procedures and diffing state in
-memory).
+runstatus handler atomically moves the job to the
+results, along with its final state, or, if it failed
+with retries left, records the failure and leaves the
+job to run again.
+
+So the Go code in farmer is mainly concerned with
+plumbing: listening for HTTP requests, telling the
+Store what happened, and acting on its notifications
+(assigning jobs, and reporting results to GitHub).
+
+The Postgres schema changes only by numbered migrations
+(see migrate.go), applied with testbot migrate up.
+The farmer refuses to start on a database whose schema
+isn't at the version it needs.
 
 */
 
 import (
 	"context"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
@@ -77,7 +94,6 @@ import (
 	// https://www.godoc.org/github.com/heroku/x/hmetrics/onload
 	_ "github.com/heroku/x/hmetrics/onload"
 	"github.com/kr/githubauth"
-	"github.com/lib/pq"
 
 	"github.com/wepogo/testbot"
 	"github.com/wepogo/testbot/farmer/stream"
@@ -106,21 +122,61 @@ var (
 	dbURL       = os.Getenv("DATABASE_URL")
 	hookSecret  = os.Getenv("HOOK_SECRET")
 	org         = os.Getenv("GITHUB_ORG")
-	repo        = os.Getenv("GITHUB_REPO")
+	repoNames   = or(os.Getenv("GITHUB_REPOS"), org+"/"+os.Getenv("GITHUB_REPO"))
 	ghToken     = github.Token(os.Getenv("GITHUB_TOKEN"))
 	listenAddr  = or(os.Getenv("LISTEN"), ":1994")
+	goCheckout  = or(os.Getenv("GO_CHECKOUT"), path.Join(os.Getenv("HOME"), "farmer", "go"))
+
+	// space-separated names of branches to test
+	// each commit pushed to, in every repository
+	pushBranches = strings.Fields(os.Getenv("PUSH_BRANCHES"))
+
+	// whether to test the merge of each pull request
+	// into its base, rather than its head alone
+	testMergeStr = os.Getenv("TEST_MERGE")
+
+	// which pull requests to re-test when their base
+	// moves, if testing merges; see retestBase
+	mergeRetest = or(os.Getenv("MERGE_RETEST"), "affected")
+
+	// whether to run a merge queue; see queue.go
+	mergeQueueStr = os.Getenv("MERGE_QUEUE")
+
+	// label that puts a pull request in the merge queue
+	mergeLabel = or(os.Getenv("MERGE_LABEL"), "merge")
+
+	// most pull requests to test together in the merge queue
+	mergeBatchStr = or(os.Getenv("MERGE_BATCH"), "8")
+
+	// comma-separated names of affectedResolvers to use
+	resolverNames = or(os.Getenv("RESOLVERS"), "parents,watch")
+
+	// name of the Scheduler to use
+	schedulerName = or(os.Getenv("SCHEDULER"), "fair")
+
+	// how long to keep results, such as 90d, if not
+	// forever, and where to archive them; see retain.go
+	retentionStr = os.Getenv("RESULT_RETENTION")
+	archiveDir   = os.Getenv("RESULT_ARCHIVE")
 )
 
 var baseURL *url.URL
 var dumpReqs bool
-var db *sql.DB
+var testMerge bool
+var useMergeQueue bool
+var mergeBatch int
+var retention time.Duration
+var store Store
+var repos []string // owner/name of each repository we serve
 var gh = github.Open(
 	ghToken,
-	github.Repo(org, repo),
+	github.Prefix("/repos"), // paths start with owner/name
 	// "raw" needed for fetching repo file contents
 	github.Accept("application/vnd.github.raw+json"),
 )
 var httpClient = new(http.Client)
+var affected []affectedResolver
+var scheduler = schedulers["fair"]
 
 // Main is the entrypoint for operation
 func Main() {
@@ -136,36 +192,105 @@ func Main() {
 		os.Exit(1)
 	}
 
-	err = createHook()
-	if err != nil {
-		log.Fatalkv(context.Background(), "error", err)
+	testMerge, err = strconv.ParseBool(testMergeStr)
+	if len(testMergeStr) > 0 && err != nil {
+		log.Fatalkv(context.Background(), "variable", "TEST_MERGE", log.KeyError, err)
+	}
+	switch mergeRetest {
+	case "none", "affected", "all":
+	default:
+		log.Fatalkv(context.Background(), "variable", "MERGE_RETEST", log.KeyError, "unknown policy "+mergeRetest)
 	}
 
-	db, err = sql.Open("postgres", dbURL)
-	if err != nil {
-		log.Fatalkv(context.Background(), "error", err)
+	useMergeQueue, err = strconv.ParseBool(mergeQueueStr)
+	if len(mergeQueueStr) > 0 && err != nil {
+		log.Fatalkv(context.Background(), "variable", "MERGE_QUEUE", log.KeyError, err)
+	}
+	mergeBatch, err = strconv.Atoi(mergeBatchStr)
+	if err == nil && mergeBatch < 1 {
+		err = errors.New("must be at least 1")
 	}
-	err = db.Ping()
 	if err != nil {
-		log.Fatalkv(
-			context.Background(),
-			"error",
-			"database not connected. check DATABASE_URL. "+err.Error(),
-		)
+		log.Fatalkv(context.Background(), "variable", "MERGE_BATCH", log.KeyError, err)
 	}
 
-	listener := pq.NewListener(dbURL, minReconnectDur, maxReconnectDur, nil)
-	err = listener.Listen("state_wakeup")
-	if err != nil {
-		log.Fatalkv(context.Background(), "error", err)
+	if retentionStr != "" {
+		retention, err = parseWindow(retentionStr)
+		if err != nil {
+			log.Fatalkv(context.Background(), "variable", "RESULT_RETENTION", log.KeyError, err)
+		}
+	}
+	if archiveDir != "" {
+		if retention == 0 {
+			log.Fatalkv(context.Background(), "variable", "RESULT_ARCHIVE", log.KeyError, "needs RESULT_RETENTION")
+		}
+		err = os.MkdirAll(archiveDir, 0755)
+		if err != nil {
+			log.Fatalkv(context.Background(), "variable", "RESULT_ARCHIVE", log.KeyError, err)
+		}
 	}
-	err = listener.Listen("report")
+
+	affected, err = enabledResolvers(resolverNames)
 	if err != nil {
-		log.Fatalkv(context.Background(), "error", err)
+		log.Fatalkv(context.Background(), "variable", "RESOLVERS", log.KeyError, err)
 	}
-	go notify(listener)
+
+	var ok bool
+	scheduler, ok = schedulers[schedulerName]
+	if !ok {
+		log.Fatalkv(context.Background(), "variable", "SCHEDULER", log.KeyError, "unknown scheduler "+schedulerName)
+	}
+
+	repos = strings.Fields(repoNames)
+	for _, r := range repos {
+		if !testbot.OKRepo(r) {
+			log.Fatalkv(context.Background(), "variable", "GITHUB_REPOS", log.KeyError, "bad repository "+r)
+		}
+	}
+	if org == "" {
+		// Web UI access requires membership in org.
+		org = path.Dir(repos[0])
+	}
+
+	for _, r := range repos {
+		err = createHook(r, "pull_request", "pr-hook")
+		if err != nil {
+			log.Fatalkv(context.Background(), "error", err)
+		}
+		if len(pushBranches) > 0 || testMerge || useMergeQueue {
+			err = createHook(r, "push", "push-hook")
+			if err != nil {
+				log.Fatalkv(context.Background(), "error", err)
+			}
+		}
+		if useMergeQueue {
+			err = createHook(r, "issue_comment", "comment-hook")
+			if err != nil {
+				log.Fatalkv(context.Background(), "error", err)
+			}
+		}
+	}
+
+	if dbURL == "memory" {
+		// For development. See docs/CONTRIBUTING.md.
+		log.Printkv(context.Background(), "at", "store", "warning", "in memory; nothing will persist")
+		store = newMemStore()
+	} else {
+		pg, err := openPG(dbURL)
+		if err != nil {
+			log.Fatalkv(context.Background(), "error", err)
+		}
+		store = pg
+	}
+	go notify(store.Notify())
 	go gcBoxes()
 	go initSync(listenAddr) // get initial PR state
+	if useMergeQueue {
+		go mergeQueue()
+	}
+	if retention > 0 {
+		go pruneResults()
+	}
 
 	// browser-accessible URLs need github auth
 	authMux := new(http.ServeMux)
@@ -173,14 +298,21 @@ func Main() {
 	authMux.HandleFunc("/cancel", cancel)
 	authMux.HandleFunc("/result/", result)
 	authMux.HandleFunc("/live/", live)
+	authMux.HandleFunc("/flaky", flaky)
+	authMux.HandleFunc("/flaky/", flaky)
+	authMux.HandleFunc("/history/", history)
+	authMux.HandleFunc("/pr/", pr)
 	authMux.HandleFunc("/retry", retry)
 	authMux.HandleFunc("/", index)
 
 	mux := new(http.ServeMux)
 	mux.Handle("/pr-hook", github.Hook(hookSecret, jsonHandler(prHook)))
+	mux.Handle("/push-hook", github.Hook(hookSecret, jsonHandler(pushHook)))
+	mux.Handle("/comment-hook", github.Hook(hookSecret, jsonHandler(commentHook)))
 	mux.Handle("/box-ping", jsonHandler(boxPing))
 	mux.Handle("/box-longpoll", jsonHandler(boxLongPoll))
 	mux.Handle("/box-runstatus", jsonHandler(boxRunStatus))
+	mux.Handle("/box-release", jsonHandler(boxRelease))
 	mux.Handle("/box-livepoll", jsonHandler(boxLivePoll))
 	mux.HandleFunc("/box-livesend", boxLiveSend)
 	mux.Handle("/static/a.css", static("a.css", css))
@@ -209,15 +341,21 @@ func initSync(listenAddr string) {
 		time.Sleep(10 * time.Millisecond)
 	}
 
-	var prs []prObj
-	err := gh.GetAllf(&prs, "pulls?state=open")
-	if err != nil {
-		log.Fatalkv(ctx, "at", "initial sync", "error", err)
-	}
-	for _, pr := range prs {
-		err = populateJobs(ctx, pr)
+	for _, repo := range repos {
+		var prs []prObj
+		err := gh.GetAllf(&prs, "%s/pulls?state=open", repo)
 		if err != nil {
-			log.Fatalkv(ctx, "at", "initial sync", "error", err)
+			log.Fatalkv(ctx, "at", "initial sync", "repo", repo, "error", err)
+		}
+		for _, pr := range prs {
+			if useMergeQueue && pr.hasLabel(mergeLabel) {
+				err = enqueue(ctx, repo, pr)
+			} else {
+				err = populateJobs(ctx, repo, pr)
+			}
+			if err != nil {
+				log.Fatalkv(ctx, "at", "initial sync", "repo", repo, "error", err)
+			}
 		}
 	}
 }
@@ -240,15 +378,20 @@ func index(w http.ResponseWriter, req *http.Request) {
 	}
 
 	var v struct {
-		Boxes  []box
+		Boxes  []Box
 		ErrBox error
 
-		Jobs   []testbot.Job
+		Jobs   []JobInfo
 		ErrJob error
 
-		Results   []resultInfo
+		Results   []ResultInfo
 		ErrResult error
 
+		MergeQueue bool
+		Batches    []Batch
+		Queue      []QueuedPR
+		ErrQueue   error
+
 		States map[string]testbot.BoxState
 	}
 
@@ -256,9 +399,16 @@ func index(w http.ResponseWriter, req *http.Request) {
 	v.States = allStates
 	mu.Unlock()
 
-	v.Boxes, v.ErrBox = listBoxes(req.Context())
+	v.Boxes, v.ErrBox = store.ListBoxes(req.Context())
 	v.Jobs, v.ErrJob = listJobs(req.Context())
 	v.Results, v.ErrResult = listResults(req.Context(), 200)
+	v.MergeQueue = useMergeQueue
+	if useMergeQueue {
+		v.Batches, v.ErrQueue = store.Batches(req.Context())
+		if v.ErrQueue == nil {
+			v.Queue, v.ErrQueue = store.Queue(req.Context())
+		}
+	}
 
 	w.Header().Set("Content-Language", "en")
 	err := homePage.Execute(w, v)
@@ -275,14 +425,20 @@ func result(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	const q = `SELECT url, sha, dir, name, pr FROM result WHERE id = $1`
-	var u, sha, dir, name string
-	var pr []int64
-	err = db.QueryRow(q, n).Scan(&u, &sha, &dir, &name, pq.Array(&pr))
-	if err != nil {
+	r, err := store.Result(req.Context(), n)
+	if err == ErrNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
+	if r.Name == testfile {
+		// A syntax error; see insertJobs.
+		// Its URL is the offending line.
+		http.Redirect(w, req, r.URL, http.StatusFound)
+		return
+	}
 
 	// TODO(kr): detect if the job can't be rerun
 	// (for example, if the PR has been closed) and
@@ -292,9 +448,8 @@ func result(w http.ResponseWriter, req *http.Request) {
 	data := struct {
 		Title string
 		PR    []int64
-		Org   string
 		Repo  string
-	}{fmt.Sprintf("%.8s %s %s", sha, dir, name), pr, org, repo}
+	}{fmt.Sprintf("%.8s %s %s", r.SHA, r.Dir, r.Name), r.PR, r.Repo}
 	err = resultPage.Execute(w, data)
 	if err != nil {
 		log.Error(req.Context(), err, "result template") // but continue
@@ -305,11 +460,11 @@ func result(w http.ResponseWriter, req *http.Request) {
 		f.Flush()
 	}
 
-	if u == "" {
+	if r.URL == "" {
 		io.WriteString(w, "sorry, no output is available for this test")
 		return
 	}
-	resp, err := httpClient.Get(u)
+	resp, err := httpClient.Get(r.URL)
 	if err != nil {
 		io.WriteString(w, "fetching output: "+err.Error())
 		return
@@ -326,19 +481,13 @@ func live(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	const q = `
-		SELECT count(*) > 0 FROM job
-		WHERE sha = $1 AND dir = $2 AND name = $3
-	`
-	var isLive bool
-	err = db.QueryRow(q, job.SHA, job.Dir, job.Name).Scan(&isLive)
+	info, isLive, err := store.Job(req.Context(), job)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 
-	var pr []int64
-	err = db.QueryRow(`SELECT array_agg(num) FROM pr WHERE head = $1`, job.SHA).Scan(pq.Array(&pr))
+	pr, err := store.CommitPRs(req.Context(), job.Repo, job.SHA)
 	if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
@@ -349,13 +498,15 @@ func live(w http.ResponseWriter, req *http.Request) {
 	data := struct {
 		Title string
 		PR    []int64
+		Repo  string
 		Live  bool
 
-		Results   []resultInfo
+		Results   []ResultInfo
 		ErrResult error
 	}{
 		Title: fmt.Sprintf("%.8s %s %s", job.SHA, job.Dir, job.Name),
 		PR:    pr,
+		Repo:  job.Repo,
 		Live:  isLive,
 	}
 
@@ -371,7 +522,11 @@ func live(w http.ResponseWriter, req *http.Request) {
 	}
 	boxID := findBox(job)
 	if boxID == "" {
-		fmt.Fprintln(w, "in queue")
+		if info.Ineligible {
+			fmt.Fprintf(escapeWriter{w}, "no eligible worker: no box has labels %s\n", strings.Join(info.Labels, " "))
+		} else {
+			fmt.Fprintln(w, "in queue")
+		}
 		return
 	}
 	flush := func() {}
@@ -399,6 +554,7 @@ func live(w http.ResponseWriter, req *http.Request) {
 func boxLiveSend(w http.ResponseWriter, req *http.Request) {
 	boxID := req.Header.Get("Box-ID")
 	job := testbot.Job{
+		Repo: req.Header.Get("Job-Repo"),
 		SHA:  req.Header.Get("Job-SHA"),
 		Dir:  req.Header.Get("Job-Dir"),
 		Name: req.Header.Get("Job-Name"),
@@ -416,23 +572,86 @@ func prHook(ctx context.Context, ev prEventReq) error {
 	if dumpReqs {
 		log.Printkv(ctx, "ev", ev)
 	}
+	repo := ev.Repository.FullName
+	if !contains(repos, repo) {
+		log.Printkv(ctx, "at", "pr hook", "repo", repo, "warning", "not in GITHUB_REPOS; ignoring")
+		return nil
+	}
 	switch ev.Action {
-	case "opened", "reopened", "synchronize":
-		return populateJobs(ctx, ev.PR)
+	case "opened", "edited", "reopened", "synchronize":
+		return populateJobs(ctx, repo, ev.PR)
 	case "closed":
-		const q = `DELETE FROM pr WHERE num=$1`
-		_, err := db.ExecContext(ctx, q, ev.PR.Number)
-		return err
+		return store.DeletePR(ctx, repo, ev.PR.Number)
+	case "labeled":
+		if useMergeQueue && ev.Label.Name == mergeLabel {
+			return enqueue(ctx, repo, ev.PR)
+		}
+	case "unlabeled":
+		if useMergeQueue && ev.Label.Name == mergeLabel {
+			return store.Dequeue(ctx, repo, ev.PR.Number)
+		}
 	}
 	return nil
 }
 
+// commentHook puts a pull request in the merge queue
+// when someone trusted comments /merge on it.
+func commentHook(ctx context.Context, ev commentEventReq) error {
+	if dumpReqs {
+		log.Printkv(ctx, "ev", ev)
+	}
+	repo := ev.Repository.FullName
+	if !contains(repos, repo) {
+		log.Printkv(ctx, "at", "comment hook", "repo", repo, "warning", "not in GITHUB_REPOS; ignoring")
+		return nil
+	}
+	if !useMergeQueue || ev.Action != "created" || ev.Issue.PullRequest == nil {
+		return nil
+	}
+	if strings.TrimSpace(ev.Comment.Body) != "/merge" || !ev.Comment.trusted() {
+		return nil
+	}
+	var pr prObj
+	err := gh.Getf(&pr, "%s/pulls/%d", repo, ev.Issue.Number)
+	if err != nil {
+		return fmt.Errorf("getting pr: %w", err)
+	}
+	return enqueue(ctx, repo, pr)
+}
+
+func pushHook(ctx context.Context, ev pushEventReq) error {
+	if dumpReqs {
+		log.Printkv(ctx, "ev", ev)
+	}
+	repo := ev.Repository.FullName
+	if !contains(repos, repo) {
+		log.Printkv(ctx, "at", "push hook", "repo", repo, "warning", "not in GITHUB_REPOS; ignoring")
+		return nil
+	}
+	branch := strings.TrimPrefix(ev.Ref, "refs/heads/")
+	if branch == ev.Ref || ev.Deleted {
+		return nil // a tag, or a deleted branch
+	}
+	if useMergeQueue {
+		err := discardBatch(ctx, repo, branch, ev.After)
+		if err != nil {
+			return err
+		}
+	}
+	if testMerge && ev.Before != zeroSHA {
+		err := retestBase(ctx, repo, branch, ev.Before, ev.After)
+		if err != nil {
+			return err
+		}
+	}
+	if !contains(pushBranches, branch) {
+		return nil
+	}
+	return populatePushJobs(ctx, repo, branch, ev.Before, ev.After)
+}
+
 func boxPing(ctx context.Context, p testbot.BoxPingReq) error {
-	q := `
-		INSERT INTO box (id, host) VALUES ($1, $2)
-		ON CONFLICT (id) DO UPDATE SET last_seen_at = now(), host = $2
-	`
-	_, err := db.ExecContext(ctx, q, p.ID, p.Host)
+	err := store.PingBox(ctx, p)
 	if err != nil {
 		return fmt.Errorf("insert box: %s", err)
 	}
@@ -462,6 +681,17 @@ func boxRunStatus(ctx context.Context, req testbot.BoxJobUpdateReq) error {
 	}
 }
 
+// boxRelease puts a job back in the queue,
+// for a box that won't run it after all.
+func boxRelease(ctx context.Context, req testbot.BoxReleaseReq) error {
+	err := store.ReleaseJob(ctx, req.Job, req.ID)
+	if err != nil {
+		return err
+	}
+	go postPendingStatus(ctx, req.Job, "in queue")
+	return nil
+}
+
 func cancel(w http.ResponseWriter, req *http.Request) {
 	var rr testbot.CancelReq
 	prefix := selfURLf("live") + "/"
@@ -491,28 +721,11 @@ func cancel(w http.ResponseWriter, req *http.Request) {
 
 // state must be one of: error, failure, pending, success
 func markDone(ctx context.Context, job testbot.Job, state, desc, url string, elapsed time.Duration) error {
-	const q = `
-		WITH done AS (
-			DELETE FROM job
-			WHERE sha=$1 AND dir=$2 AND name=$3
-			RETURNING sha, dir, name
-		),
-		donepr AS (
-			SELECT sha, dir, name, array_agg(num) as prnum
-			FROM done JOIN pr ON (done.sha=pr.head)
-			GROUP BY sha, dir, name
-		)
-		INSERT INTO result (sha, dir, name, pr, state, descr, url, elapsed_ms)
-		SELECT sha, dir, name, prnum, $4, $5, $6, $7 FROM donepr
-	`
-	ms := int(elapsed / time.Millisecond)
-	_, err := db.ExecContext(ctx, q, job.SHA, job.Dir, job.Name, state, desc, url, ms)
-	return err
+	return store.FinishJob(ctx, job, state, desc, url, elapsed)
 }
 
 func postPendingStatus(ctx context.Context, job testbot.Job, desc string) error {
-	url := selfURLf("live/%s/%s/%s", job.SHA, job.Dir, job.Name)
-	return postStatus(ctx, job, "pending", desc, url)
+	return postStatus(ctx, job, "pending", desc, liveURL(job))
 }
 
 func retry(w http.ResponseWriter, req *http.Request) {
@@ -533,23 +746,21 @@ func retry(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 	}
-	const q = `
-		INSERT INTO job (sha, dir, name)
-		SELECT sha, dir, name FROM result
-		WHERE id=$1
-		ON CONFLICT (sha, dir, name) DO UPDATE SET sha=job.sha
-		RETURNING sha, dir, name
-	`
-	var sha, dir, name string
-	err := db.QueryRowContext(req.Context(), q, rr.ResultID).Scan(&sha, &dir, &name)
-	if err != nil {
+	job, err := retryResult(req.Context(), rr.ResultID)
+	if err == ErrNotFound {
+		http.Error(w, err.Error(), 404)
+		return
+	} else if err == errNoRetry {
+		http.Error(w, err.Error(), 400)
+		return
+	} else if err != nil {
 		http.Error(w, err.Error(), 500)
 		return
 	}
 	// TODO(kr): detect if the job won't actually run
 	// (for example, if the PR has been closed) and
 	// give a suitable message.
-	url := selfURLf("live/%s/%s/%s", sha, dir, name)
+	url := liveURL(job)
 	http.Redirect(w, req, url, http.StatusSeeOther)
 }
 
@@ -583,6 +794,11 @@ func errFunc(ctx context.Context, w http.ResponseWriter, err error) {
 	http.Error(w, err.Error(), 500)
 }
 
+// liveURL returns the URL of the live page for job.
+func liveURL(job testbot.Job) string {
+	return selfURLf("live/%s/%s/%s/%s", job.Repo, job.SHA, job.Dir, job.Name)
+}
+
 func selfURLf(format string, arg ...interface{}) string {
 	u := *baseURL
 	u.Path = path.Clean("/" + fmt.Sprintf(format, arg...))
@@ -593,7 +809,7 @@ type dumpHandler struct{ h http.Handler }
 
 func (h dumpHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	// dump body for everything but gh events; they are too noisy
-	dump, err := httputil.DumpRequest(req, req.URL.Path != "/pr-hook")
+	dump, err := httputil.DumpRequest(req, !strings.HasSuffix(req.URL.Path, "-hook"))
 	if err != nil {
 		log.Error(req.Context(), err)
 	} else {
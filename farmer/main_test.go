@@ -0,0 +1,117 @@
+package farmer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/wepogo/testbot"
+)
+
+// setupMem sets the store to an empty memStore,
+// with one pull request whose head is commit c0ffee,
+// and one job for it needing label gpu.
+func setupMem(t *testing.T) (gpu testbot.Job) {
+	t.Helper()
+	store = newMemStore()
+	baseURL, _ = url.Parse("https://farmer.example.com")
+	ctx := context.Background()
+	_, err := upsertPR(ctx, "org/repo", 1, "c0ffee", "main")
+	must(t, err)
+	gpu = testbot.Job{Repo: "org/repo", SHA: "c0ffee", Dir: "/a", Name: "gpu"}
+	labels := map[testbot.Job][]string{gpu: {"gpu"}}
+	must(t, store.UpsertJobs(ctx, []testbot.Job{gpu}, nil, labels, nil, nil))
+	return gpu
+}
+
+func do(h http.Handler, method, target, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, target, strings.NewReader(body))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, req)
+	return w
+}
+
+func TestBoxPingHandler(t *testing.T) {
+	setupMem(t)
+	body := `{"ID": "box1", "Host": "h1", "Labels": ["gpu"]}`
+	w := do(jsonHandler(boxPing), "POST", "/box-ping", body)
+	if w.Code != 200 {
+		t.Fatalf("box-ping status = %d, want 200: %s", w.Code, w.Body)
+	}
+	boxes, err := store.ListBoxes(context.Background())
+	must(t, err)
+	if len(boxes) != 1 || boxes[0].ID != "box1" || !reflect.DeepEqual(boxes[0].Labels, []string{"gpu"}) {
+		t.Errorf("boxes = %+v, want box1 with label gpu", boxes)
+	}
+}
+
+func TestLiveHandler(t *testing.T) {
+	gpu := setupMem(t)
+	target := "/live/" + gpu.Repo + "/" + gpu.SHA + gpu.Dir + "/" + gpu.Name
+
+	w := do(http.HandlerFunc(live), "GET", target, "")
+	if !strings.Contains(w.Body.String(), "/pull/1") {
+		t.Errorf("live page = %q, want link to pull request 1", w.Body)
+	}
+	if !strings.Contains(w.Body.String(), "no eligible worker: no box has labels gpu") {
+		t.Errorf("live page = %q, want no eligible worker", w.Body)
+	}
+
+	must(t, boxPing(context.Background(), testbot.BoxPingReq{ID: "box1", Labels: []string{"gpu"}}))
+	w = do(http.HandlerFunc(live), "GET", target, "")
+	if !strings.Contains(w.Body.String(), "in queue") {
+		t.Errorf("live page = %q, want in queue", w.Body)
+	}
+}
+
+func TestCancelRetryHandlers(t *testing.T) {
+	gpu := setupMem(t)
+	ctx := context.Background()
+
+	w := do(http.HandlerFunc(cancel), "POST", "/cancel", `{"Job": {"Repo": "org/repo", "SHA": "c0ffee", "Dir": "/a", "Name": "gpu"}}`)
+	if w.Code != 200 {
+		t.Fatalf("cancel status = %d, want 200: %s", w.Code, w.Body)
+	}
+	if _, ok, _ := store.Job(ctx, gpu); ok {
+		t.Fatalf("job %v still waiting after cancel", gpu)
+	}
+	results, err := store.JobResults(ctx, gpu)
+	must(t, err)
+	if len(results) != 1 || results[0].Desc != "canceled by operator" {
+		t.Fatalf("results = %+v, want one canceled", results)
+	}
+
+	w = do(http.HandlerFunc(retry), "POST", "/retry", `{"ResultID": 1}`)
+	if w.Code != http.StatusSeeOther {
+		t.Fatalf("retry status = %d, want 303: %s", w.Code, w.Body)
+	}
+	want := "https://farmer.example.com/live/org/repo/c0ffee/a/gpu"
+	if got := w.Header().Get("Location"); got != want {
+		t.Errorf("retry Location = %q, want %q", got, want)
+	}
+	if _, ok, _ := store.Job(ctx, gpu); !ok {
+		t.Errorf("job %v not waiting after retry", gpu)
+	}
+
+	w = do(http.HandlerFunc(retry), "POST", "/retry", `{"ResultID": 99}`)
+	if w.Code != 404 {
+		t.Errorf("retry nonexistent status = %d, want 404", w.Code)
+	}
+}
+
+func TestIndexHandler(t *testing.T) {
+	setupMem(t)
+	must(t, boxPing(context.Background(), testbot.BoxPingReq{ID: "box1"}))
+	must(t, boxPing(context.Background(), testbot.BoxPingReq{ID: "box2", Labels: []string{"gpu"}, Draining: true}))
+	w := do(http.HandlerFunc(index), "GET", "/", "")
+	body := w.Body.String()
+	for _, want := range []string{"box1", "gpu", "(no eligible worker)", "box2  labels: gpu <b>draining</b>"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("home page has no %q:\n%s", want, body)
+		}
+	}
+}
@@ -0,0 +1,848 @@
+package farmer
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wepogo/testbot"
+)
+
+// memStore is a Store in memory, for development
+// and tests. It keeps the same rules as the triggers
+// in schema.go, but nothing persists across restarts.
+type memStore struct {
+	mu      sync.Mutex
+	prs     map[prKey]memPR
+	pushes  map[pushKey]time.Time
+	queue   []prKey // merge queue, in order
+	batches map[branchKey]Batch
+	jobs    map[testbot.Job]*memJob
+	boxes   map[string]*Box
+	runs    map[testbot.Job]string // job -> box
+	results []*memResult           // in order by ID
+	lastID  int                    // of the latest result
+
+	pending map[string]bool // notifications not yet sent
+	wake    chan struct{}
+	once    sync.Once
+	c       chan string
+}
+
+type prKey struct {
+	repo string
+	num  int
+}
+
+type memPR struct {
+	head, branch string
+}
+
+type pushKey struct {
+	repo, sha, branch string
+}
+
+type branchKey struct {
+	repo, branch string
+}
+
+type memJob struct {
+	labels  []string
+	needs   []testbot.Job
+	base    string
+	retries int
+	attempt int
+}
+
+type memResult struct {
+	ResultInfo
+	needs    []testbot.Job // of the job, for RetryResult
+	reported bool
+}
+
+func newMemStore() *memStore {
+	return &memStore{
+		prs:     make(map[prKey]memPR),
+		pushes:  make(map[pushKey]time.Time),
+		batches: make(map[branchKey]Batch),
+		jobs:    make(map[testbot.Job]*memJob),
+		boxes:   make(map[string]*Box),
+		runs:    make(map[testbot.Job]string),
+		pending: make(map[string]bool),
+		wake:    make(chan struct{}, 1),
+		c:       make(chan string),
+	}
+}
+
+func (m *memStore) Notify() <-chan string {
+	m.once.Do(func() {
+		go func() {
+			for range m.wake {
+				m.mu.Lock()
+				var kinds []string
+				for kind := range m.pending {
+					kinds = append(kinds, kind)
+				}
+				m.pending = make(map[string]bool)
+				m.mu.Unlock()
+				sort.Strings(kinds)
+				for _, kind := range kinds {
+					m.c <- kind
+				}
+			}
+		}()
+	})
+	return m.c
+}
+
+// must hold m.mu
+func (m *memStore) notify(kind string) {
+	m.pending[kind] = true
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// resolve does what the resolve trigger does
+// in schema.go, after any change.
+// It must be called with m.mu held.
+func (m *memStore) resolve() {
+	for job := range m.jobs {
+		if !m.isHead(job.Repo, job.SHA) && !m.isPushed(job.Repo, job.SHA) && !m.isBatch(job.Repo, job.SHA) {
+			m.deleteJob(job)
+		}
+	}
+	for {
+		var blocked []testbot.Job
+		for job, j := range m.jobs {
+			for _, need := range j.needs {
+				if m.needFailed(need) && m.jobs[need] == nil {
+					blocked = append(blocked, job)
+					break
+				}
+			}
+		}
+		if len(blocked) == 0 {
+			break
+		}
+		for _, job := range blocked {
+			m.finish(job, "error", "skipped: dependency failed", "", 0)
+		}
+	}
+	m.notify("state_wakeup")
+}
+
+// must hold m.mu
+func (m *memStore) isHead(repo, sha string) bool {
+	for k, pr := range m.prs {
+		if k.repo == repo && pr.head == sha {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold m.mu
+func (m *memStore) isPushed(repo, sha string) bool {
+	for k := range m.pushes {
+		if k.repo == repo && k.sha == sha {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold m.mu
+func (m *memStore) isBatch(repo, sha string) bool {
+	for k, b := range m.batches {
+		if k.repo == repo && b.SHA == sha {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold m.mu
+func (m *memStore) deleteJob(job testbot.Job) {
+	delete(m.jobs, job)
+	delete(m.runs, job)
+}
+
+// needFailed returns whether the most recent
+// result for need is anything but success.
+// must hold m.mu
+func (m *memStore) needFailed(need testbot.Job) bool {
+	for i := len(m.results) - 1; i >= 0; i-- {
+		if r := m.results[i]; r.Job() == need {
+			return r.State != "success"
+		}
+	}
+	return false
+}
+
+// retried returns whether the latest result for job
+// is retried: whether job is running again after
+// failing, rather than for the first time since
+// it was inserted or retried by hand.
+// must hold m.mu
+func (m *memStore) retried(job testbot.Job) bool {
+	for i := len(m.results) - 1; i >= 0; i-- {
+		if r := m.results[i]; r.Job() == job {
+			return r.Retried
+		}
+	}
+	return false
+}
+
+// must hold m.mu
+func (m *memStore) ready(job testbot.Job) bool {
+	for _, need := range m.jobs[job].needs {
+		if m.jobs[need] != nil || m.needFailed(need) {
+			return false
+		}
+	}
+	return true
+}
+
+// must hold m.mu
+func (m *memStore) expected(job testbot.Job) time.Duration {
+	var sum, n int
+	for i := len(m.results) - 1; i >= 0 && n < 10; i-- {
+		r := m.results[i]
+		if r.Repo == job.Repo && r.Dir == job.Dir && r.Name == job.Name && r.ElapsedMS > 0 {
+			sum += r.ElapsedMS
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	ms := math.Round(float64(sum) / float64(n))
+	return time.Duration(ms) * time.Millisecond
+}
+
+// must hold m.mu
+func (m *memStore) eligible(job testbot.Job) bool {
+	sj := SchedJob{Job: job, Labels: m.jobs[job].labels}
+	for _, b := range m.boxes {
+		if !b.Draining && (SchedBox{ID: b.ID, Labels: b.Labels}).CanRun(sj) {
+			return true
+		}
+	}
+	return false
+}
+
+// finish deletes job and records its result.
+// must hold m.mu
+func (m *memStore) finish(job testbot.Job, state, desc, url string, elapsed time.Duration) {
+	j := m.jobs[job]
+	if j == nil {
+		return
+	}
+	m.record(job, j, false, state, desc, url, elapsed)
+	m.deleteJob(job)
+}
+
+// record records a result for job j.
+// must hold m.mu
+func (m *memStore) record(job testbot.Job, j *memJob, retried bool, state, desc, url string, elapsed time.Duration) {
+	pr := m.commitPRs(job.Repo, job.SHA)
+	var host string
+	if b := m.boxes[m.runs[job]]; b != nil {
+		host = b.Host
+	}
+	m.lastID++
+	m.results = append(m.results, &memResult{ResultInfo: ResultInfo{
+		ID:        m.lastID,
+		Repo:      job.Repo,
+		SHA:       job.SHA,
+		Dir:       job.Dir,
+		Name:      job.Name,
+		Labels:    j.labels,
+		Base:      j.base,
+		Retries:   j.retries,
+		Attempt:   j.attempt,
+		Retried:   retried,
+		Flaky:     state == "success" && m.retried(job),
+		Host:      host,
+		ElapsedMS: int(elapsed / time.Millisecond),
+		PR:        pr,
+		State:     state,
+		Desc:      desc,
+		URL:       url,
+		CreatedAt: time.Now(),
+	}, needs: j.needs})
+	m.notify("report")
+}
+
+func (m *memStore) UpsertPR(ctx context.Context, repo string, num int, head, branch string) (bool, []testbot.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := prKey{repo, num}
+	old, ok := m.prs[k]
+	if ok && old == (memPR{head, branch}) {
+		return false, nil, nil
+	}
+	var obsolete []testbot.Job
+	if ok && old.head != head && !m.isPushed(repo, old.head) {
+		for job := range m.jobs {
+			if job.Repo == repo && job.SHA == old.head {
+				obsolete = append(obsolete, job)
+			}
+		}
+	}
+	m.prs[k] = memPR{head, branch}
+	m.resolve()
+	return true, obsolete, nil
+}
+
+func (m *memStore) DeletePR(ctx context.Context, repo string, num int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.prs, prKey{repo, num})
+	m.dequeue(prKey{repo, num})
+	m.resolve()
+	return nil
+}
+
+func (m *memStore) CommitPRs(ctx context.Context, repo, sha string) ([]int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.commitPRs(repo, sha), nil
+}
+
+// must hold m.mu
+func (m *memStore) commitPRs(repo, sha string) []int64 {
+	var pr []int64
+	for k, p := range m.prs {
+		if k.repo == repo && p.head == sha {
+			pr = append(pr, int64(k.num))
+		}
+	}
+	sort.Slice(pr, func(i, j int) bool { return pr[i] < pr[j] })
+	return pr
+}
+
+func (m *memStore) PR(ctx context.Context, repo string, num int) (PR, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.prs[prKey{repo, num}]
+	if !ok {
+		return PR{}, ErrNotFound
+	}
+	return PR{Num: num, Head: p.head}, nil
+}
+
+func (m *memStore) BranchPRs(ctx context.Context, repo, branch string) ([]PR, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var prs []PR
+	for k, p := range m.prs {
+		if k.repo == repo && p.branch == branch {
+			prs = append(prs, PR{Num: k.num, Head: p.head})
+		}
+	}
+	sort.Slice(prs, func(i, j int) bool { return prs[i].Num < prs[j].Num })
+	return prs, nil
+}
+
+func (m *memStore) AddPush(ctx context.Context, repo, branch, sha string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, t := range m.pushes {
+		if time.Since(t) > time.Hour && !m.hasJobs(k.repo, k.sha) {
+			delete(m.pushes, k)
+		}
+	}
+	k := pushKey{repo, sha, branch}
+	if _, ok := m.pushes[k]; ok {
+		return false, nil
+	}
+	m.pushes[k] = time.Now()
+	m.resolve()
+	return true, nil
+}
+
+// must hold m.mu
+func (m *memStore) hasJobs(repo, sha string) bool {
+	for job := range m.jobs {
+		if job.Repo == repo && job.SHA == sha {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *memStore) Enqueue(ctx context.Context, repo string, num int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	k := prKey{repo, num}
+	if _, ok := m.prs[k]; !ok || m.queued(k) {
+		return false, nil
+	}
+	m.queue = append(m.queue, k)
+	return true, nil
+}
+
+func (m *memStore) Dequeue(ctx context.Context, repo string, num int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.dequeue(prKey{repo, num})
+	return nil
+}
+
+// must hold m.mu
+func (m *memStore) queued(k prKey) bool {
+	for _, q := range m.queue {
+		if q == k {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold m.mu
+func (m *memStore) dequeue(k prKey) {
+	for i, q := range m.queue {
+		if q == k {
+			m.queue = append(m.queue[:i:i], m.queue[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *memStore) Queue(ctx context.Context) ([]QueuedPR, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []QueuedPR
+	for _, k := range m.queue {
+		pr := m.prs[k]
+		a = append(a, QueuedPR{PR: PR{Num: k.num, Head: pr.head}, Repo: k.repo, Branch: pr.branch})
+	}
+	return a, nil
+}
+
+func (m *memStore) PutBatch(ctx context.Context, b Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	b.PRs = append([]PR(nil), b.PRs...)
+	m.batches[branchKey{b.Repo, b.Branch}] = b
+	m.resolve()
+	return nil
+}
+
+func (m *memStore) DeleteBatch(ctx context.Context, repo, branch string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.batches, branchKey{repo, branch})
+	m.resolve()
+	return nil
+}
+
+func (m *memStore) Batches(ctx context.Context) ([]Batch, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []Batch
+	for _, b := range m.batches {
+		b.PRs = append([]PR(nil), b.PRs...)
+		a = append(a, b)
+	}
+	sort.Slice(a, func(i, j int) bool {
+		if a[i].Repo != a[j].Repo {
+			return a[i].Repo < a[j].Repo
+		}
+		return a[i].Branch < a[j].Branch
+	})
+	return a, nil
+}
+
+func (m *memStore) UpsertJobs(ctx context.Context, jobs []testbot.Job, needs map[testbot.Job][]testbot.Job, labels map[testbot.Job][]string, bases map[testbot.Job]string, retries map[testbot.Job]int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, job := range jobs {
+		if j := m.jobs[job]; j == nil {
+			m.jobs[job] = &memJob{labels: labels[job], base: bases[job], retries: retries[job], attempt: 1}
+		} else if _, running := m.runs[job]; !running {
+			j.base = bases[job]
+		}
+	}
+	for job, a := range needs {
+		if j := m.jobs[job]; j != nil {
+			for _, need := range a {
+				if !containsJob(j.needs, need) {
+					j.needs = append(j.needs, need)
+				}
+			}
+		}
+	}
+	m.resolve()
+	return nil
+}
+
+func containsJob(a []testbot.Job, job testbot.Job) bool {
+	for _, x := range a {
+		if x == job {
+			return true
+		}
+	}
+	return false
+}
+
+// must hold m.mu
+func (m *memStore) jobInfo(job testbot.Job) JobInfo {
+	_, running := m.runs[job]
+	return JobInfo{
+		Job:        job,
+		Labels:     m.jobs[job].labels,
+		Base:       m.jobs[job].base,
+		Attempt:    m.jobs[job].attempt,
+		Ineligible: !m.eligible(job),
+		Queued:     !running && m.ready(job),
+		Expected:   m.expected(job),
+	}
+}
+
+func (m *memStore) Job(ctx context.Context, job testbot.Job) (JobInfo, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.jobs[job] == nil {
+		return JobInfo{}, false, nil
+	}
+	return m.jobInfo(job), true, nil
+}
+
+func (m *memStore) ListJobs(ctx context.Context) ([]JobInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []JobInfo
+	for _, job := range m.sortedJobs() {
+		a = append(a, m.jobInfo(job))
+	}
+	return a, nil
+}
+
+// must hold m.mu
+func (m *memStore) sortedJobs() []testbot.Job {
+	var a []testbot.Job
+	for job := range m.jobs {
+		a = append(a, job)
+	}
+	sort.Slice(a, func(i, j int) bool {
+		x, y := a[i], a[j]
+		if x.Repo != y.Repo {
+			return x.Repo < y.Repo
+		}
+		if x.SHA != y.SHA {
+			return x.SHA < y.SHA
+		}
+		if x.Dir != y.Dir {
+			return x.Dir < y.Dir
+		}
+		return x.Name < y.Name
+	})
+	return a
+}
+
+func (m *memStore) FinishJob(ctx context.Context, job testbot.Job, state, desc, url string, elapsed time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j := m.jobs[job]
+	if j != nil && state == "failure" && j.attempt <= j.retries {
+		m.record(job, j, true, state, desc, url, elapsed)
+		j.attempt++
+		delete(m.runs, job)
+	} else {
+		m.finish(job, state, desc, url, elapsed)
+	}
+	m.resolve()
+	return nil
+}
+
+func (m *memStore) AddResult(ctx context.Context, job testbot.Job, state, desc, url string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.record(job, &memJob{attempt: 1}, false, state, desc, url, 0)
+	m.resolve()
+	return nil
+}
+
+func (m *memStore) RetryResult(ctx context.Context, id int) (testbot.Job, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.result(id)
+	if r == nil {
+		return testbot.Job{}, ErrNotFound
+	}
+	job := r.Job()
+	if m.jobs[job] == nil {
+		attempt := 0
+		for _, r := range m.results {
+			if r.Job() == job && r.Attempt > attempt {
+				attempt = r.Attempt
+			}
+		}
+		m.jobs[job] = &memJob{labels: r.Labels, needs: r.needs, base: r.Base, retries: r.Retries, attempt: attempt + 1}
+	}
+	m.resolve()
+	return job, nil
+}
+
+func (m *memStore) PingBox(ctx context.Context, p testbot.BoxPingReq) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.boxes[p.ID] = &Box{ID: p.ID, Host: p.Host, Seen: time.Now(), Labels: p.Labels, Draining: p.Draining}
+	m.resolve()
+	return nil
+}
+
+func (m *memStore) DeleteStaleBoxes(ctx context.Context, d time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t := time.Now().Add(-d)
+	for id, b := range m.boxes {
+		if b.Seen.Before(t) {
+			delete(m.boxes, id)
+			for job, box := range m.runs {
+				if box == id {
+					delete(m.runs, job)
+				}
+			}
+		}
+	}
+	m.resolve()
+	return nil
+}
+
+func (m *memStore) ListBoxes(ctx context.Context) ([]Box, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []Box
+	for _, b := range m.boxes {
+		a = append(a, *b)
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].ID < a[j].ID })
+	return a, nil
+}
+
+func (m *memStore) SchedState(ctx context.Context) ([]SchedJob, []SchedBox, []Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var jobs []SchedJob
+	for _, job := range m.sortedJobs() {
+		if info := m.jobInfo(job); info.Queued {
+			jobs = append(jobs, SchedJob{Job: job, Labels: info.Labels, Expected: info.Expected})
+		}
+	}
+	busy := make(map[string]bool)
+	for _, box := range m.runs {
+		busy[box] = true
+	}
+	var boxes []SchedBox
+	for _, b := range m.boxes {
+		if !busy[b.ID] && !b.Draining {
+			boxes = append(boxes, SchedBox{ID: b.ID, Labels: b.Labels})
+		}
+	}
+	sort.Slice(boxes, func(i, j int) bool { return boxes[i].ID < boxes[j].ID })
+	return jobs, boxes, m.sortedRuns(), nil
+}
+
+func (m *memStore) InsertRuns(ctx context.Context, runs []Run) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	busy := make(map[string]bool)
+	for _, box := range m.runs {
+		busy[box] = true
+	}
+	n := 0
+	for _, r := range runs {
+		_, running := m.runs[r.Job]
+		b := m.boxes[r.Box]
+		if m.jobs[r.Job] == nil || b == nil || b.Draining || running || busy[r.Box] {
+			continue
+		}
+		m.runs[r.Job] = r.Box
+		busy[r.Box] = true
+		n++
+	}
+	if n > 0 {
+		m.resolve()
+	}
+	return n, nil
+}
+
+func (m *memStore) ReleaseJob(ctx context.Context, job testbot.Job, box string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if b, ok := m.runs[job]; ok && b == box {
+		delete(m.runs, job)
+		m.resolve()
+	}
+	return nil
+}
+
+func (m *memStore) Runs(ctx context.Context) ([]Run, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.sortedRuns(), nil
+}
+
+// must hold m.mu
+func (m *memStore) sortedRuns() []Run {
+	var a []Run
+	for job, box := range m.runs {
+		j := m.jobs[job]
+		a = append(a, Run{Job: job, Box: box, Base: j.base, Attempt: j.attempt})
+	}
+	sort.Slice(a, func(i, j int) bool { return a[i].Box < a[j].Box })
+	return a
+}
+
+func (m *memStore) Result(ctx context.Context, id int) (ResultInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r := m.result(id)
+	if r == nil {
+		return ResultInfo{}, ErrNotFound
+	}
+	return r.ResultInfo, nil
+}
+
+// result returns result id, or nil if there is none.
+// must hold m.mu
+func (m *memStore) result(id int) *memResult {
+	i := sort.Search(len(m.results), func(i int) bool { return m.results[i].ID >= id })
+	if i == len(m.results) || m.results[i].ID != id {
+		return nil
+	}
+	return m.results[i]
+}
+
+func (m *memStore) ListResults(ctx context.Context, limit int) ([]ResultInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []ResultInfo
+	for i := len(m.results) - 1; i >= 0 && len(a) < limit; i-- {
+		a = append(a, m.results[i].ResultInfo)
+	}
+	return a, nil
+}
+
+func (m *memStore) JobResults(ctx context.Context, job testbot.Job) ([]ResultInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []ResultInfo
+	for i := len(m.results) - 1; i >= 0; i-- {
+		if r := m.results[i]; r.Job() == job {
+			a = append(a, r.ResultInfo)
+		}
+	}
+	return a, nil
+}
+
+func (m *memStore) RecentResults(ctx context.Context, d time.Duration) ([]ResultInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []ResultInfo
+	for _, r := range m.results {
+		if time.Since(r.CreatedAt) <= d {
+			a = append(a, r.ResultInfo)
+		}
+	}
+	return a, nil
+}
+
+func (m *memStore) EntryResults(ctx context.Context, repo, dir, name string, d time.Duration) ([]ResultInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []ResultInfo
+	for _, r := range m.results {
+		if r.Repo == repo && r.Dir == dir && r.Name == name && time.Since(r.CreatedAt) <= d {
+			a = append(a, r.ResultInfo)
+		}
+	}
+	return a, nil
+}
+
+func (m *memStore) CommitResults(ctx context.Context, repo, sha string) ([]ResultInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []ResultInfo
+	for i := len(m.results) - 1; i >= 0; i-- {
+		if r := m.results[i]; r.Repo == repo && r.SHA == sha {
+			a = append(a, r.ResultInfo)
+		}
+	}
+	return a, nil
+}
+
+func (m *memStore) UnreportedResults(ctx context.Context) ([]ResultInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var a []ResultInfo
+	for _, r := range m.results {
+		if !r.reported {
+			a = append(a, r.ResultInfo)
+		}
+	}
+	return a, nil
+}
+
+func (m *memStore) MarkReported(ctx context.Context, ids []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, id := range ids {
+		if r := m.result(id); r != nil {
+			r.reported = true
+		}
+	}
+	return nil
+}
+
+func (m *memStore) OldResults(ctx context.Context, t time.Time, limit int) ([]ResultInfo, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keep := make(map[testbot.Job]bool) // latest result at a live commit seen
+	var a []ResultInfo
+	for i := len(m.results) - 1; i >= 0; i-- {
+		r := m.results[i]
+		live := m.isHead(r.Repo, r.SHA) || m.isPushed(r.Repo, r.SHA) ||
+			m.isBatch(r.Repo, r.SHA) || m.hasJobs(r.Repo, r.SHA)
+		if live && !keep[r.Job()] {
+			keep[r.Job()] = true
+			continue
+		}
+		if r.reported && r.CreatedAt.Before(t) {
+			a = append(a, r.ResultInfo)
+		}
+	}
+	// Oldest first.
+	for i, j := 0, len(a)-1; i < j; i, j = i+1, j-1 {
+		a[i], a[j] = a[j], a[i]
+	}
+	if len(a) > limit {
+		a = a[:limit]
+	}
+	return a, nil
+}
+
+func (m *memStore) DeleteResults(ctx context.Context, ids []int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	del := make(map[int]bool)
+	for _, id := range ids {
+		del[id] = true
+	}
+	var kept []*memResult
+	for _, r := range m.results {
+		if !del[r.ID] {
+			kept = append(kept, r)
+		}
+	}
+	m.results = kept
+	m.notify("report")
+	return nil
+}
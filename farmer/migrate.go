@@ -0,0 +1,249 @@
+package farmer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/wepogo/testbot/log"
+)
+
+// A migration changes the database schema
+// from the previous version to version.
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations lists every change to the schema, in order.
+// Versions are consecutive, starting at 1.
+var migrations = []migration{
+	{1, "initial schema", migration1},
+	{2, "needs, labels, and expected times", migration2},
+	{3, "repository in job identity", migration3},
+	{4, "pushed commits", migration4},
+	{5, "merge testing", migration5},
+	{6, "merge queue", migration6},
+	{7, "retries and flaky results", migration7},
+	{8, "result hosts", migration8},
+	{9, "result creation time index", migration9},
+	{10, "draining boxes", migration10},
+	{11, "result needs", migration11},
+}
+
+// latestVersion is the schema version this farmer needs.
+var latestVersion = migrations[len(migrations)-1].version
+
+// schema_migration records each migration applied.
+// A database set up before migrations existed has
+// no such table, but it does have the tables from
+// migration 1; we count that as version 1.
+const migrationTable = `
+	CREATE TABLE IF NOT EXISTS schema_migration (
+		version int PRIMARY KEY,
+		name text NOT NULL,
+		applied_at timestamp NOT NULL DEFAULT now()
+	)
+`
+
+// appliedMigrations returns the time each migration
+// was applied to db, by version. A migration applied
+// before migrations existed has the zero time.
+func appliedMigrations(ctx context.Context, db *sql.DB) (map[int]time.Time, error) {
+	var hasTable, hasPR bool
+	const q = `
+		SELECT
+			to_regclass('schema_migration') IS NOT NULL,
+			to_regclass('pr') IS NOT NULL
+	`
+	err := db.QueryRowContext(ctx, q).Scan(&hasTable, &hasPR)
+	if err != nil {
+		return nil, err
+	}
+	applied := make(map[int]time.Time)
+	if !hasTable {
+		if hasPR {
+			applied[1] = time.Time{}
+		}
+		return applied, nil
+	}
+	rows, err := db.QueryContext(ctx, `SELECT version, applied_at FROM schema_migration`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v int
+		var t time.Time
+		err = rows.Scan(&v, &t)
+		if err != nil {
+			return nil, err
+		}
+		applied[v] = t
+	}
+	return applied, rows.Err()
+}
+
+// schemaVersion returns the highest version in applied,
+// or 0 if it is empty.
+func schemaVersion(applied map[int]time.Time) int {
+	n := 0
+	for v := range applied {
+		if v > n {
+			n = v
+		}
+	}
+	return n
+}
+
+// checkSchema returns an error if db's schema
+// is not exactly the version this farmer needs.
+func checkSchema(ctx context.Context, db *sql.DB) error {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return fmt.Errorf("checking schema version: %w", err)
+	}
+	v := schemaVersion(applied)
+	switch {
+	case v < latestVersion:
+		return fmt.Errorf("database schema is at version %d, but this farmer needs version %d; run testbot migrate up", v, latestVersion)
+	case v > latestVersion:
+		return fmt.Errorf("database schema is at version %d, newer than this farmer knows (%d); deploy a newer testbot", v, latestVersion)
+	}
+	return nil
+}
+
+// migrateUp applies every migration not yet applied to db,
+// in order, each in its own transaction, printing each
+// one's version and name to w as it goes.
+// It is safe to run concurrently with itself.
+func migrateUp(ctx context.Context, db *sql.DB, w io.Writer) error {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	_, err = db.ExecContext(ctx, migrationTable)
+	if err != nil {
+		return err
+	}
+	if _, ok := applied[1]; ok && applied[1].IsZero() {
+		// Set up before migrations existed. Record it.
+		const q = `
+			INSERT INTO schema_migration (version, name) VALUES (1, $1)
+			ON CONFLICT DO NOTHING
+		`
+		_, err = db.ExecContext(ctx, q, migrations[0].name)
+		if err != nil {
+			return err
+		}
+	}
+	for _, m := range migrations {
+		if _, ok := applied[m.version]; ok {
+			continue
+		}
+		fmt.Fprintf(w, "%d %s\n", m.version, m.name)
+		err = applyMigration(ctx, db, m)
+		if err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, db *sql.DB, m migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Serialize with any other migrateUp, then make
+	// sure no other one applied m while we waited.
+	_, err = tx.ExecContext(ctx, `LOCK TABLE schema_migration IN EXCLUSIVE MODE`)
+	if err != nil {
+		return err
+	}
+	var done bool
+	const q = `SELECT count(*) > 0 FROM schema_migration WHERE version = $1`
+	err = tx.QueryRowContext(ctx, q, m.version).Scan(&done)
+	if err != nil || done {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, m.sql)
+	if err != nil {
+		return err
+	}
+	const iq = `INSERT INTO schema_migration (version, name) VALUES ($1, $2)`
+	_, err = tx.ExecContext(ctx, iq, m.version, m.name)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// migrateStatus prints every migration to w,
+// along with when it was applied to db, if it was.
+func migrateStatus(ctx context.Context, db *sql.DB, w io.Writer) error {
+	applied, err := appliedMigrations(ctx, db)
+	if err != nil {
+		return err
+	}
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "version\tapplied\tname")
+	for _, m := range migrations {
+		t, ok := applied[m.version]
+		status := "pending"
+		if ok && t.IsZero() {
+			status = "before migrations"
+		} else if ok {
+			status = t.Format("2006-01-02 15:04:05")
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", m.version, status, m.name)
+	}
+	var unknown []int
+	for v := range applied {
+		if v > latestVersion {
+			unknown = append(unknown, v)
+		}
+	}
+	sort.Ints(unknown)
+	for _, v := range unknown {
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", v, applied[v].Format("2006-01-02 15:04:05"), "(unknown to this testbot)")
+	}
+	return tw.Flush()
+}
+
+// Migrate is the entrypoint for testbot migrate.
+// Cmd is up, to apply every pending migration
+// to the database at $DATABASE_URL, or status,
+// to list the migrations and which are applied.
+func Migrate(cmd string) {
+	ctx := context.Background()
+	f := map[string]func(context.Context, *sql.DB, io.Writer) error{
+		"up":     migrateUp,
+		"status": migrateStatus,
+	}[cmd]
+	if f == nil {
+		fmt.Fprintf(os.Stderr, "testbot migrate: unknown command %q (want up or status)\n", cmd)
+		os.Exit(2)
+	}
+	if dbURL == "" || dbURL == "memory" {
+		log.Fatalkv(ctx, log.KeyError, "migrate needs a Postgres DATABASE_URL")
+	}
+	db, err := openDB(dbURL)
+	if err != nil {
+		log.Fatalkv(ctx, log.KeyError, err)
+	}
+	defer db.Close()
+	err = f(ctx, db, os.Stdout)
+	if err != nil {
+		log.Fatalkv(ctx, log.KeyError, err)
+	}
+}
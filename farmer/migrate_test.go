@@ -0,0 +1,52 @@
+package farmer
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jbowens/pqtest"
+)
+
+func TestMigrations(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migrations[%d].version = %d, want %d", i, m.version, i+1)
+		}
+		if m.name == "" || strings.TrimSpace(m.sql) == "" {
+			t.Errorf("migration %d has no name or no sql", m.version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	db := pqtest.Open(t)
+	defer db.Close()
+	ctx := context.Background()
+
+	// A database set up before migrations existed.
+	_, err := db.Exec(migration1)
+	must(t, err)
+	if err := checkSchema(ctx, db); err == nil {
+		t.Fatal("checkSchema(version 1) = nil, want error")
+	}
+	out := new(bytes.Buffer)
+	must(t, migrateStatus(ctx, db, out))
+	if !strings.Contains(out.String(), "before migrations") {
+		t.Errorf("status = %q, want version 1 before migrations", out)
+	}
+
+	out.Reset()
+	must(t, migrateUp(ctx, db, out))
+	if strings.HasPrefix(out.String(), "1 ") || !strings.Contains(out.String(), "2 ") {
+		t.Errorf("up = %q, want only migrations after 1", out)
+	}
+	must(t, checkSchema(ctx, db))
+
+	out.Reset()
+	must(t, migrateUp(ctx, db, out))
+	if out.Len() != 0 {
+		t.Errorf("second up = %q, want nothing", out)
+	}
+}
@@ -0,0 +1,775 @@
+package farmer
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/wepogo/testbot"
+)
+
+// pgStore is a Store in Postgres,
+// using the schema in schema.go.
+type pgStore struct {
+	db *sql.DB
+	c  chan string // nil if not listening
+}
+
+// openPG connects to the Postgres database at url,
+// checks that its schema is up to date, and listens
+// for notifications from its triggers.
+func openPG(url string) (*pgStore, error) {
+	db, err := openDB(url)
+	if err != nil {
+		return nil, err
+	}
+	err = checkSchema(context.Background(), db)
+	if err != nil {
+		return nil, err
+	}
+
+	l := pq.NewListener(url, minReconnectDur, maxReconnectDur, nil)
+	for _, channel := range []string{"state_wakeup", "report"} {
+		err = l.Listen(channel)
+		if err != nil {
+			return nil, err
+		}
+	}
+	s := &pgStore{db: db, c: make(chan string)}
+	go func() {
+		for n := range l.Notify {
+			if n == nil {
+				// We reconnected, and may have missed
+				// notifications on any channel.
+				s.c <- "state_wakeup"
+				s.c <- "report"
+				continue
+			}
+			s.c <- n.Channel
+		}
+	}()
+	return s, nil
+}
+
+func openDB(url string) (*sql.DB, error) {
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Ping()
+	if err != nil {
+		return nil, fmt.Errorf("database not connected. check DATABASE_URL. %w", err)
+	}
+	return db, nil
+}
+
+func (s *pgStore) Notify() <-chan string {
+	return s.c
+}
+
+func (s *pgStore) UpsertPR(ctx context.Context, repo string, num int, head, branch string) (bool, []testbot.Job, error) {
+	const cq = `
+		SELECT job.repo, sha, dir, name FROM job, pr
+		WHERE (job.repo, sha) = (pr.repo, head)
+		AND pr.repo = $1 AND num = $2 AND head != $3
+		AND (job.repo, sha) NOT IN (SELECT repo, sha FROM push)
+	`
+	obsolete, err := scanJobs(s.db.QueryContext(ctx, cq, repo, num, head))
+	if err != nil {
+		return false, nil, err
+	}
+
+	const q = `
+		INSERT INTO pr (repo, num, head, branch) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (repo, num) DO UPDATE SET head=$3, branch=$4
+		WHERE pr.head != $3 OR pr.branch != $4
+	`
+	res, err := s.db.ExecContext(ctx, q, repo, num, head, branch)
+	if err != nil {
+		return false, nil, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, obsolete, nil
+}
+
+func (s *pgStore) DeletePR(ctx context.Context, repo string, num int) error {
+	const q = `DELETE FROM pr WHERE repo=$1 AND num=$2`
+	_, err := s.db.ExecContext(ctx, q, repo, num)
+	return err
+}
+
+func (s *pgStore) CommitPRs(ctx context.Context, repo, sha string) ([]int64, error) {
+	var pr []int64
+	const q = `SELECT array_agg(num) FROM pr WHERE repo = $1 AND head = $2`
+	err := s.db.QueryRowContext(ctx, q, repo, sha).Scan(pq.Array(&pr))
+	return pr, err
+}
+
+func (s *pgStore) PR(ctx context.Context, repo string, num int) (PR, error) {
+	pr := PR{Num: num}
+	const q = `SELECT head FROM pr WHERE repo = $1 AND num = $2`
+	err := s.db.QueryRowContext(ctx, q, repo, num).Scan(&pr.Head)
+	if err == sql.ErrNoRows {
+		return PR{}, ErrNotFound
+	}
+	return pr, err
+}
+
+func (s *pgStore) BranchPRs(ctx context.Context, repo, branch string) ([]PR, error) {
+	const q = `SELECT num, head FROM pr WHERE repo = $1 AND branch = $2 ORDER BY num`
+	rows, err := s.db.QueryContext(ctx, q, repo, branch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var prs []PR
+	for rows.Next() {
+		var pr PR
+		err = rows.Scan(&pr.Num, &pr.Head)
+		if err != nil {
+			return nil, err
+		}
+		prs = append(prs, pr)
+	}
+	return prs, rows.Err()
+}
+
+func (s *pgStore) AddPush(ctx context.Context, repo, branch, sha string) (bool, error) {
+	const dq = `
+		DELETE FROM push
+		WHERE pushed_at < now() - interval '1 hour'
+		AND (repo, sha) NOT IN (SELECT repo, sha FROM job)
+	`
+	_, err := s.db.ExecContext(ctx, dq)
+	if err != nil {
+		return false, err
+	}
+
+	const q = `
+		INSERT INTO push (repo, sha, branch) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`
+	res, err := s.db.ExecContext(ctx, q, repo, sha, branch)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *pgStore) Enqueue(ctx context.Context, repo string, num int) (bool, error) {
+	const q = `
+		INSERT INTO merge_queue (repo, num)
+		SELECT repo, num FROM pr WHERE repo = $1 AND num = $2
+		ON CONFLICT DO NOTHING
+	`
+	res, err := s.db.ExecContext(ctx, q, repo, num)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+func (s *pgStore) Dequeue(ctx context.Context, repo string, num int) error {
+	const q = `DELETE FROM merge_queue WHERE repo = $1 AND num = $2`
+	_, err := s.db.ExecContext(ctx, q, repo, num)
+	return err
+}
+
+func (s *pgStore) Queue(ctx context.Context) ([]QueuedPR, error) {
+	const q = `
+		SELECT repo, num, head, branch
+		FROM merge_queue JOIN pr USING (repo, num)
+		ORDER BY queued_at, repo, num
+	`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var a []QueuedPR
+	for rows.Next() {
+		var pr QueuedPR
+		err = rows.Scan(&pr.Repo, &pr.Num, &pr.Head, &pr.Branch)
+		if err != nil {
+			return nil, err
+		}
+		a = append(a, pr)
+	}
+	return a, rows.Err()
+}
+
+func (s *pgStore) PutBatch(ctx context.Context, b Batch) error {
+	const q = `
+		INSERT INTO merge_batch (repo, branch, base, sha, prs, heads, populated)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		ON CONFLICT (repo, branch) DO UPDATE SET
+			base = excluded.base,
+			sha = excluded.sha,
+			prs = excluded.prs,
+			heads = excluded.heads,
+			populated = excluded.populated
+	`
+	var prs []int64
+	var heads []string
+	for _, pr := range b.PRs {
+		prs = append(prs, int64(pr.Num))
+		heads = append(heads, pr.Head)
+	}
+	_, err := s.db.ExecContext(ctx, q, b.Repo, b.Branch, b.Base, b.SHA, pq.Array(prs), pq.Array(heads), b.Populated)
+	return err
+}
+
+func (s *pgStore) DeleteBatch(ctx context.Context, repo, branch string) error {
+	const q = `DELETE FROM merge_batch WHERE repo = $1 AND branch = $2`
+	_, err := s.db.ExecContext(ctx, q, repo, branch)
+	return err
+}
+
+func (s *pgStore) Batches(ctx context.Context) ([]Batch, error) {
+	const q = `
+		SELECT repo, branch, base, sha, prs, heads, populated
+		FROM merge_batch ORDER BY repo, branch
+	`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var a []Batch
+	for rows.Next() {
+		var b Batch
+		var prs []int64
+		var heads []string
+		err = rows.Scan(&b.Repo, &b.Branch, &b.Base, &b.SHA, pq.Array(&prs), pq.Array(&heads), &b.Populated)
+		if err != nil {
+			return nil, err
+		}
+		for i := range prs {
+			b.PRs = append(b.PRs, PR{Num: int(prs[i]), Head: heads[i]})
+		}
+		a = append(a, b)
+	}
+	return a, rows.Err()
+}
+
+func (s *pgStore) UpsertJobs(ctx context.Context, jobs []testbot.Job, needs map[testbot.Job][]testbot.Job, labels map[testbot.Job][]string, bases map[testbot.Job]string, retries map[testbot.Job]int) error {
+	const q = `
+		WITH j AS (
+			INSERT INTO job (repo, sha, dir, name, labels, base, retries)
+			SELECT repo, sha, dir, name, string_to_array(labels, ' '), base, retries
+			FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[], $7::int[])
+				AS t (repo, sha, dir, name, labels, base, retries)
+			ON CONFLICT (repo, sha, dir, name) DO UPDATE SET base = excluded.base
+			WHERE job.base != excluded.base
+			AND (job.repo, job.sha, job.dir, job.name) NOT IN (SELECT repo, sha, dir, name FROM run)
+		)
+		INSERT INTO need (repo, sha, dir, name, need_dir, need_name)
+		SELECT * FROM unnest($8::text[], $9::text[], $10::text[], $11::text[], $12::text[], $13::text[])
+		ON CONFLICT DO NOTHING
+	`
+	// Labels can't contain spaces (see testbot.OKLabel),
+	// so pass each job's labels as a single string.
+	var repo, sha, dir, name, label, base []string
+	var retry []int64
+	for _, job := range jobs {
+		repo = append(repo, job.Repo)
+		sha = append(sha, job.SHA)
+		dir = append(dir, job.Dir)
+		name = append(name, job.Name)
+		label = append(label, strings.Join(labels[job], " "))
+		base = append(base, bases[job])
+		retry = append(retry, int64(retries[job]))
+	}
+	var nrepo, nsha, ndir, nname, needDir, needName []string
+	for job, a := range needs {
+		for _, need := range a {
+			nrepo = append(nrepo, job.Repo)
+			nsha = append(nsha, job.SHA)
+			ndir = append(ndir, job.Dir)
+			nname = append(nname, job.Name)
+			needDir = append(needDir, need.Dir)
+			needName = append(needName, need.Name)
+		}
+	}
+	_, err := s.db.ExecContext(ctx, q,
+		pq.Array(repo), pq.Array(sha), pq.Array(dir), pq.Array(name), pq.Array(label), pq.Array(base), pq.Array(retry),
+		pq.Array(nrepo), pq.Array(nsha), pq.Array(ndir), pq.Array(nname), pq.Array(needDir), pq.Array(needName),
+	)
+	return err
+}
+
+// jobInfoQuery selects the columns scanned by scanJobInfo.
+const jobInfoQuery = `
+	SELECT repo, sha, dir, name, labels, base, attempt,
+		(repo, sha, dir, name) IN (TABLE job_ineligible),
+		(repo, sha, dir, name) IN (SELECT repo, sha, dir, name FROM job_ready)
+		AND (repo, sha, dir, name) NOT IN (SELECT repo, sha, dir, name FROM run),
+		coalesce(expected_ms, 0)
+	FROM job JOIN job_expected USING (repo, sha, dir, name)
+`
+
+func (s *pgStore) Job(ctx context.Context, job testbot.Job) (JobInfo, bool, error) {
+	const q = jobInfoQuery + `WHERE repo=$1 AND sha=$2 AND dir=$3 AND name=$4`
+	jobs, err := scanJobInfo(s.db.QueryContext(ctx, q, job.Repo, job.SHA, job.Dir, job.Name))
+	if err != nil || len(jobs) == 0 {
+		return JobInfo{}, false, err
+	}
+	return jobs[0], true, nil
+}
+
+func (s *pgStore) ListJobs(ctx context.Context) ([]JobInfo, error) {
+	const q = jobInfoQuery + `ORDER BY repo, sha, dir, name`
+	return scanJobInfo(s.db.QueryContext(ctx, q))
+}
+
+func scanJobInfo(rows *sql.Rows, err error) ([]JobInfo, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []JobInfo
+	for rows.Next() {
+		var job JobInfo
+		var ms int64
+		err = rows.Scan(
+			&job.Repo,
+			&job.SHA,
+			&job.Dir,
+			&job.Name,
+			pq.Array(&job.Labels),
+			&job.Base,
+			&job.Attempt,
+			&job.Ineligible,
+			&job.Queued,
+			&ms,
+		)
+		if err != nil {
+			return nil, err
+		}
+		job.Expected = time.Duration(ms) * time.Millisecond
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func scanJobs(rows *sql.Rows, err error) ([]testbot.Job, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []testbot.Job
+	for rows.Next() {
+		var job testbot.Job
+		err = rows.Scan(&job.Repo, &job.SHA, &job.Dir, &job.Name)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *pgStore) FinishJob(ctx context.Context, job testbot.Job, state, desc, url string, elapsed time.Duration) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// First, try to retry the job.
+	const rq = `
+		WITH retry AS (
+			UPDATE job SET attempt = attempt + 1
+			WHERE repo=$1 AND sha=$2 AND dir=$3 AND name=$4
+			AND $5 = 'failure' AND attempt <= retries
+			RETURNING repo, sha, dir, name, labels, base, retries, attempt - 1 AS attempt
+		), unassign AS (
+			DELETE FROM run
+			WHERE (repo, sha, dir, name) IN (SELECT repo, sha, dir, name FROM retry)
+		)
+		INSERT INTO result (repo, sha, dir, name, labels, base, retries, attempt, retried, need_dirs, need_names, host, pr, state, descr, url, elapsed_ms)
+		SELECT repo, sha, dir, name, labels, base, retries, attempt, true,
+			coalesce(need_dirs, '{}'), coalesce(need_names, '{}'), (
+			SELECT coalesce(max(host), '') FROM run JOIN box ON box.id = run.box
+			WHERE (run.repo, run.sha, run.dir, run.name) = (retry.repo, retry.sha, retry.dir, retry.name)
+		), (
+			SELECT coalesce(array_agg(num), '{}') FROM pr
+			WHERE (pr.repo, pr.head) = (retry.repo, retry.sha)
+		), $5, $6, $7, $8
+		FROM retry LEFT JOIN job_needs USING (repo, sha, dir, name)
+	`
+	ms := int(elapsed / time.Millisecond)
+	res, err := tx.ExecContext(ctx, rq, job.Repo, job.SHA, job.Dir, job.Name, state, desc, url, ms)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return tx.Commit()
+	}
+
+	const q = `
+		WITH done AS (
+			DELETE FROM job
+			WHERE repo=$1 AND sha=$2 AND dir=$3 AND name=$4
+			RETURNING repo, sha, dir, name, labels, base, retries, attempt
+		)
+		INSERT INTO result (repo, sha, dir, name, labels, base, retries, attempt, flaky, need_dirs, need_names, host, pr, state, descr, url, elapsed_ms)
+		SELECT repo, sha, dir, name, labels, base, retries, attempt, $5 = 'success' AND coalesce((
+			-- Whether this run is an automatic retry.
+			SELECT retried FROM result r
+			WHERE (r.repo, r.sha, r.dir, r.name) = (done.repo, done.sha, done.dir, done.name)
+			ORDER BY id DESC LIMIT 1
+		), false), coalesce(need_dirs, '{}'), coalesce(need_names, '{}'), (
+			SELECT coalesce(max(host), '') FROM run JOIN box ON box.id = run.box
+			WHERE (run.repo, run.sha, run.dir, run.name) = (done.repo, done.sha, done.dir, done.name)
+		), (
+			SELECT coalesce(array_agg(num), '{}') FROM pr
+			WHERE (pr.repo, pr.head) = (done.repo, done.sha)
+		), $5, $6, $7, $8
+		FROM done LEFT JOIN job_needs USING (repo, sha, dir, name)
+	`
+	_, err = tx.ExecContext(ctx, q, job.Repo, job.SHA, job.Dir, job.Name, state, desc, url, ms)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *pgStore) AddResult(ctx context.Context, job testbot.Job, state, desc, url string) error {
+	const q = `
+		INSERT INTO result (repo, sha, dir, name, pr, state, descr, url, elapsed_ms)
+		SELECT $1, $2, $3, $4, (
+			SELECT coalesce(array_agg(num), '{}') FROM pr
+			WHERE (pr.repo, pr.head) = ($1, $2)
+		), $5, $6, $7, 0
+	`
+	_, err := s.db.ExecContext(ctx, q, job.Repo, job.SHA, job.Dir, job.Name, state, desc, url)
+	return err
+}
+
+func (s *pgStore) RetryResult(ctx context.Context, id int) (testbot.Job, error) {
+	const q = `
+		WITH res AS (
+			SELECT * FROM result WHERE id=$1
+		), j AS (
+			INSERT INTO job (repo, sha, dir, name, labels, base, retries, attempt)
+			SELECT repo, sha, dir, name, labels, base, retries, (
+				SELECT max(attempt) + 1 FROM result r
+				WHERE (r.repo, r.sha, r.dir, r.name) = (res.repo, res.sha, res.dir, res.name)
+			) FROM res
+			ON CONFLICT (repo, sha, dir, name) DO UPDATE SET sha=job.sha
+			RETURNING repo, sha, dir, name
+		), n AS (
+			INSERT INTO need (repo, sha, dir, name, need_dir, need_name)
+			SELECT repo, sha, dir, name, need_dir, need_name
+			FROM res, unnest(need_dirs, need_names) AS t (need_dir, need_name)
+			ON CONFLICT DO NOTHING
+		)
+		SELECT repo, sha, dir, name FROM j
+	`
+	var job testbot.Job
+	err := s.db.QueryRowContext(ctx, q, id).Scan(&job.Repo, &job.SHA, &job.Dir, &job.Name)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return job, err
+}
+
+func (s *pgStore) PingBox(ctx context.Context, p testbot.BoxPingReq) error {
+	const q = `
+		INSERT INTO box (id, host, labels, draining) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (id) DO UPDATE SET last_seen_at = now(), host = $2, labels = $3, draining = $4
+	`
+	_, err := s.db.ExecContext(ctx, q, p.ID, p.Host, pq.Array(p.Labels), p.Draining)
+	return err
+}
+
+func (s *pgStore) DeleteStaleBoxes(ctx context.Context, d time.Duration) error {
+	const q = `
+		DELETE FROM box
+		WHERE last_seen_at < now() - make_interval(secs => $1)
+	`
+	_, err := s.db.ExecContext(ctx, q, d.Seconds())
+	return err
+}
+
+func (s *pgStore) ListBoxes(ctx context.Context) ([]Box, error) {
+	const q = `SELECT id, host, last_seen_at, labels, draining FROM box ORDER BY id`
+	rows, err := s.db.QueryContext(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var boxes []Box
+	for rows.Next() {
+		var box Box
+		err = rows.Scan(&box.ID, &box.Host, &box.Seen, pq.Array(&box.Labels), &box.Draining)
+		if err != nil {
+			return nil, err
+		}
+		boxes = append(boxes, box)
+	}
+	return boxes, rows.Err()
+}
+
+func (s *pgStore) SchedState(ctx context.Context) (jobs []SchedJob, boxes []SchedBox, runs []Run, err error) {
+	tx, err := s.db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	defer tx.Rollback()
+
+	const jq = `
+		SELECT repo, sha, dir, name, labels, coalesce(expected_ms, 0)
+		FROM job_ready JOIN job_expected USING (repo, sha, dir, name)
+		WHERE (repo, sha, dir, name) NOT IN (SELECT repo, sha, dir, name FROM run)
+		ORDER BY repo, sha, dir, name
+	`
+	rows, err := tx.QueryContext(ctx, jq)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("querying jobs: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var j SchedJob
+		var ms int64
+		err = rows.Scan(&j.Repo, &j.SHA, &j.Dir, &j.Name, pq.Array(&j.Labels), &ms)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		j.Expected = time.Duration(ms) * time.Millisecond
+		jobs = append(jobs, j)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	const bq = `
+		SELECT id, labels FROM box
+		WHERE (id) NOT IN (SELECT box FROM run)
+		AND NOT draining
+		ORDER BY id
+	`
+	rows, err = tx.QueryContext(ctx, bq)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("querying boxes: %w", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var b SchedBox
+		err = rows.Scan(&b.ID, pq.Array(&b.Labels))
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		boxes = append(boxes, b)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, nil, err
+	}
+
+	// Schedulers don't need the base or attempt.
+	runs, err = scanRuns(tx.QueryContext(ctx, `SELECT repo, sha, dir, name, box, '', 0 FROM run`))
+	return jobs, boxes, runs, err
+}
+
+func (s *pgStore) ReleaseJob(ctx context.Context, job testbot.Job, box string) error {
+	const q = `
+		DELETE FROM run
+		WHERE repo=$1 AND sha=$2 AND dir=$3 AND name=$4 AND box=$5
+	`
+	_, err := s.db.ExecContext(ctx, q, job.Repo, job.SHA, job.Dir, job.Name, box)
+	return err
+}
+
+func (s *pgStore) Runs(ctx context.Context) ([]Run, error) {
+	const q = `
+		SELECT repo, sha, dir, name, box, base, attempt
+		FROM run JOIN job USING (repo, sha, dir, name)
+		ORDER BY box
+	`
+	return scanRuns(s.db.QueryContext(ctx, q))
+}
+
+func scanRuns(rows *sql.Rows, err error) ([]Run, error) {
+	if err != nil {
+		return nil, fmt.Errorf("querying runs: %w", err)
+	}
+	defer rows.Close()
+	var runs []Run
+	for rows.Next() {
+		var r Run
+		err = rows.Scan(&r.Job.Repo, &r.Job.SHA, &r.Job.Dir, &r.Job.Name, &r.Box, &r.Base, &r.Attempt)
+		if err != nil {
+			return nil, err
+		}
+		runs = append(runs, r)
+	}
+	return runs, rows.Err()
+}
+
+func (s *pgStore) InsertRuns(ctx context.Context, a []Run) (int, error) {
+	const q = `
+		INSERT INTO run (repo, sha, dir, name, box)
+		SELECT * FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[])
+			AS r (repo, sha, dir, name, box)
+		WHERE (repo, sha, dir, name) IN (SELECT repo, sha, dir, name FROM job)
+		AND (box) IN (SELECT id FROM box WHERE NOT draining)
+		ON CONFLICT DO NOTHING
+	`
+	var repo, sha, dir, name, box []string
+	for _, r := range a {
+		repo = append(repo, r.Job.Repo)
+		sha = append(sha, r.Job.SHA)
+		dir = append(dir, r.Job.Dir)
+		name = append(name, r.Job.Name)
+		box = append(box, r.Box)
+	}
+	res, err := s.db.ExecContext(ctx, q, pq.Array(repo), pq.Array(sha), pq.Array(dir), pq.Array(name), pq.Array(box))
+	if err != nil {
+		return 0, fmt.Errorf("inserting runs: %w", err)
+	}
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+// resultQuery selects the columns scanned by scanResults.
+const resultQuery = `
+	SELECT id, repo, sha, dir, name, labels, base, retries, attempt, retried, flaky, host,
+		elapsed_ms, pr, state, descr, url, created_at
+	FROM result
+`
+
+func (s *pgStore) Result(ctx context.Context, id int) (ResultInfo, error) {
+	res, err := scanResults(s.db.QueryContext(ctx, resultQuery+`WHERE id = $1`, id))
+	if err != nil {
+		return ResultInfo{}, err
+	}
+	if len(res) == 0 {
+		return ResultInfo{}, ErrNotFound
+	}
+	return res[0], nil
+}
+
+func (s *pgStore) ListResults(ctx context.Context, limit int) ([]ResultInfo, error) {
+	const q = resultQuery + `ORDER BY id DESC LIMIT $1`
+	return scanResults(s.db.QueryContext(ctx, q, limit))
+}
+
+func (s *pgStore) JobResults(ctx context.Context, job testbot.Job) ([]ResultInfo, error) {
+	const q = resultQuery + `
+		WHERE repo=$1 AND sha=$2 AND dir=$3 AND name=$4
+		ORDER BY id DESC
+	`
+	return scanResults(s.db.QueryContext(ctx, q, job.Repo, job.SHA, job.Dir, job.Name))
+}
+
+func (s *pgStore) RecentResults(ctx context.Context, d time.Duration) ([]ResultInfo, error) {
+	const q = resultQuery + `
+		WHERE created_at >= now() - make_interval(secs => $1)
+		ORDER BY id
+	`
+	return scanResults(s.db.QueryContext(ctx, q, d.Seconds()))
+}
+
+func (s *pgStore) EntryResults(ctx context.Context, repo, dir, name string, d time.Duration) ([]ResultInfo, error) {
+	const q = resultQuery + `
+		WHERE repo=$1 AND dir=$2 AND name=$3
+		AND created_at >= now() - make_interval(secs => $4)
+		ORDER BY id
+	`
+	return scanResults(s.db.QueryContext(ctx, q, repo, dir, name, d.Seconds()))
+}
+
+func (s *pgStore) CommitResults(ctx context.Context, repo, sha string) ([]ResultInfo, error) {
+	const q = resultQuery + `WHERE repo=$1 AND sha=$2 ORDER BY id DESC`
+	return scanResults(s.db.QueryContext(ctx, q, repo, sha))
+}
+
+func (s *pgStore) UnreportedResults(ctx context.Context) ([]ResultInfo, error) {
+	const q = resultQuery + `WHERE NOT reported ORDER BY id`
+	return scanResults(s.db.QueryContext(ctx, q))
+}
+
+func (s *pgStore) MarkReported(ctx context.Context, ids []int) error {
+	const q = `
+		UPDATE result SET reported=true
+		WHERE id = ANY($1::int[])
+	`
+	a := make([]int64, len(ids))
+	for i, id := range ids {
+		a[i] = int64(id)
+	}
+	_, err := s.db.ExecContext(ctx, q, pq.Array(a))
+	return err
+}
+
+func (s *pgStore) OldResults(ctx context.Context, t time.Time, limit int) ([]ResultInfo, error) {
+	const q = resultQuery + `
+		WHERE reported AND created_at < $1
+		AND id NOT IN (
+			SELECT DISTINCT ON (repo, sha, dir, name) id FROM result
+			WHERE (repo, sha) IN (
+				SELECT repo, head FROM pr
+				UNION SELECT repo, sha FROM push
+				UNION SELECT repo, sha FROM merge_batch
+				UNION SELECT repo, sha FROM job
+			)
+			ORDER BY repo, sha, dir, name, id DESC
+		)
+		ORDER BY id
+		LIMIT $2
+	`
+	return scanResults(s.db.QueryContext(ctx, q, t, limit))
+}
+
+func (s *pgStore) DeleteResults(ctx context.Context, ids []int) error {
+	const q = `DELETE FROM result WHERE id = ANY($1::int[])`
+	a := make([]int64, len(ids))
+	for i, id := range ids {
+		a[i] = int64(id)
+	}
+	_, err := s.db.ExecContext(ctx, q, pq.Array(a))
+	return err
+}
+
+func scanResults(rows *sql.Rows, err error) ([]ResultInfo, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []ResultInfo
+	for rows.Next() {
+		var result ResultInfo
+		err = rows.Scan(
+			&result.ID,
+			&result.Repo,
+			&result.SHA,
+			&result.Dir,
+			&result.Name,
+			pq.Array(&result.Labels),
+			&result.Base,
+			&result.Retries,
+			&result.Attempt,
+			&result.Retried,
+			&result.Flaky,
+			&result.Host,
+			&result.ElapsedMS,
+			pq.Array(&result.PR),
+			&result.State,
+			&result.Desc,
+			&result.URL,
+			&result.CreatedAt,
+		)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, result)
+	}
+	return res, rows.Err()
+}
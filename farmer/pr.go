@@ -0,0 +1,203 @@
+package farmer
+
+import (
+	"context"
+	"errors"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/wepogo/testbot"
+	"github.com/wepogo/testbot/log"
+)
+
+// A prView is the state of the jobs
+// for the head of a pull request.
+type prView struct {
+	Repo string
+	PR
+	Jobs    []JobInfo    // waiting or running
+	Results []ResultInfo // the latest of each job, newest first
+}
+
+// loadPR returns the state of the jobs for the
+// head of pull request num in repo.
+func loadPR(ctx context.Context, repo string, num int) (prView, error) {
+	v := prView{Repo: repo}
+	var err error
+	v.PR, err = store.PR(ctx, repo, num)
+	if err != nil {
+		return prView{}, err
+	}
+	jobs, err := listJobs(ctx)
+	if err != nil {
+		return prView{}, err
+	}
+	for _, j := range jobs {
+		if j.Repo == repo && j.SHA == v.Head {
+			v.Jobs = append(v.Jobs, j)
+		}
+	}
+	results, err := store.CommitResults(ctx, repo, v.Head)
+	if err != nil {
+		return prView{}, err
+	}
+	seen := make(map[testbot.Job]bool)
+	for _, r := range results {
+		if !seen[r.Job()] {
+			seen[r.Job()] = true
+			v.Results = append(v.Results, r)
+		}
+	}
+	forDisplay(v.Results)
+	return v, nil
+}
+
+// prActions holds the actions on every job for the
+// head of a pull request, by the name used to select
+// one in its URL. Each returns the jobs it acted on.
+var prActions = map[string]func(context.Context, prView) ([]testbot.Job, error){
+	"cancel":       cancelPR,
+	"retry-failed": func(ctx context.Context, v prView) ([]testbot.Job, error) { return rerunPR(ctx, v, true) },
+	"rerun":        func(ctx context.Context, v prView) ([]testbot.Job, error) { return rerunPR(ctx, v, false) },
+}
+
+// cancelPR cancels every job in v
+// that is waiting or running.
+func cancelPR(ctx context.Context, v prView) ([]testbot.Job, error) {
+	var canceled []testbot.Job
+	for _, j := range v.Jobs {
+		err := markDone(ctx, j.Job, "error", "canceled by operator", "", 0)
+		if err != nil {
+			return canceled, err
+		}
+		canceled = append(canceled, j.Job)
+	}
+	return canceled, nil
+}
+
+// rerunPR runs every job in v with a result again,
+// or, if failedOnly is set, every job whose latest
+// result is not a success. It leaves alone jobs that
+// are already waiting or running, and Testfile syntax
+// errors (see retryResult).
+func rerunPR(ctx context.Context, v prView, failedOnly bool) ([]testbot.Job, error) {
+	busy := make(map[testbot.Job]bool)
+	for _, j := range v.Jobs {
+		busy[j.Job] = true
+	}
+	var rerun []testbot.Job
+	for _, r := range v.Results {
+		if busy[r.Job()] || failedOnly && r.State == "success" || r.Name == testfile {
+			continue
+		}
+		job, err := store.RetryResult(ctx, r.ID)
+		if err != nil {
+			return rerun, err
+		}
+		rerun = append(rerun, job)
+	}
+	return rerun, nil
+}
+
+// pr serves the page for the head of a pull request,
+// at /pr/owner/name/num, listing its jobs and the latest
+// result of each.
+// A POST to the page's path joined with the name of an
+// action in prActions does that action, then redirects
+// back to the page, or, with format=json, responds with
+// the jobs it acted on. The POST must come from a pull
+// request page, or have Content-Type application/json
+// (as from a script; see fromScript).
+func pr(w http.ResponseWriter, req *http.Request) {
+	repo, num, action, err := parsePRPath(strings.TrimPrefix(req.URL.Path, "/pr/"))
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	f, ok := prActions[action]
+	if action != "" && !ok {
+		http.Error(w, "unknown action "+action, 404)
+		return
+	}
+	if action != "" && req.Method != "POST" {
+		http.Error(w, "action needs POST", http.StatusMethodNotAllowed)
+		return
+	}
+	if action != "" && !fromScript(req) && !strings.HasPrefix(req.Header.Get("Referer"), selfURLf("pr")+"/") {
+		// A form on another site can't do this.
+		http.Error(w, "action needs a referer from this farmer, or a JSON content type", http.StatusForbidden)
+		return
+	}
+
+	v, err := loadPR(req.Context(), repo, num)
+	if err == ErrNotFound {
+		http.Error(w, "no such pull request", 404)
+		return
+	} else if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	if action != "" {
+		jobs, err := f(req.Context(), v)
+		if err != nil {
+			http.Error(w, err.Error(), 500)
+			return
+		}
+		log.Printkv(req.Context(), "at", "pr-action", "repo", repo, "pr", num, "action", action, "jobs", len(jobs))
+		if wantJSON(req) {
+			writeJSON(w, req, struct {
+				Repo string
+				Num  int
+				Jobs []testbot.Job
+			}{repo, num, jobs})
+			return
+		}
+		http.Redirect(w, req, selfURLf("pr/%s/%d", repo, num), http.StatusSeeOther)
+		return
+	}
+
+	if wantJSON(req) {
+		writeJSON(w, req, v)
+		return
+	}
+	w.Header().Set("Content-Language", "en")
+	err = prPage.Execute(w, v)
+	if err != nil {
+		log.Error(req.Context(), err, "pr template")
+	}
+}
+
+// fromScript returns whether req has Content-Type
+// application/json. A browser won't send that to
+// another site without asking the site first, with
+// a CORS preflight request, which we never allow,
+// so req comes from a script, not a forged form.
+func fromScript(req *http.Request) bool {
+	t, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && t == "application/json"
+}
+
+// parsePRPath parses p, of the form
+// owner/name/num, optionally followed
+// by /action.
+func parsePRPath(p string) (repo string, num int, action string, err error) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) != 3 && len(parts) != 4 {
+		return "", 0, "", errors.New("bad pull request path " + p)
+	}
+	repo = parts[0] + "/" + parts[1]
+	if !testbot.OKRepo(repo) {
+		return "", 0, "", errors.New("bad repository " + repo)
+	}
+	num, err = strconv.Atoi(parts[2])
+	if err != nil || num <= 0 {
+		return "", 0, "", errors.New("bad pull request number " + parts[2])
+	}
+	if len(parts) == 4 {
+		action = parts[3]
+	}
+	return repo, num, action, nil
+}
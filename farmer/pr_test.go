@@ -0,0 +1,114 @@
+package farmer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/wepogo/testbot"
+)
+
+func TestPRHandler(t *testing.T) {
+	gpu := setupMem(t)
+	ctx := context.Background()
+	unit := testbot.Job{Repo: "org/repo", SHA: "c0ffee", Dir: "/a", Name: "unit"}
+	lint := testbot.Job{Repo: "org/repo", SHA: "c0ffee", Dir: "/a", Name: "lint"}
+	must(t, store.UpsertJobs(ctx, []testbot.Job{unit, lint}, nil, nil, nil, nil))
+	must(t, markDone(ctx, unit, "failure", "", "", time.Second))
+	must(t, markDone(ctx, lint, "success", "", "", time.Second))
+
+	const page = "https://farmer.example.com/pr/org/repo/1"
+	postFrom := func(referer, target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", target, nil)
+		if referer != "" {
+			req.Header.Set("Referer", referer)
+		}
+		w := httptest.NewRecorder()
+		pr(w, req)
+		return w
+	}
+	type actionResp struct{ Jobs []testbot.Job }
+	post := func(action string) []testbot.Job {
+		t.Helper()
+		w := postFrom(page, "/pr/org/repo/1/"+action+"?format=json")
+		if w.Code != 200 {
+			t.Fatalf("%s status = %d, want 200: %s", action, w.Code, w.Body)
+		}
+		var resp actionResp
+		must(t, json.Unmarshal(w.Body.Bytes(), &resp))
+		return resp.Jobs
+	}
+
+	if jobs := post("retry-failed"); len(jobs) != 1 || jobs[0] != unit {
+		t.Errorf("retry-failed jobs = %v, want [%v]", jobs, unit)
+	}
+	if jobs := post("cancel"); len(jobs) != 2 {
+		t.Errorf("cancel jobs = %v, want gpu and unit", jobs)
+	}
+	if _, ok, _ := store.Job(ctx, gpu); ok {
+		t.Errorf("job %v still waiting after cancel", gpu)
+	}
+	if jobs := post("rerun"); len(jobs) != 3 {
+		t.Errorf("rerun jobs = %v, want all 3", jobs)
+	}
+
+	w := do(http.HandlerFunc(pr), "GET", "/pr/org/repo/1?format=json", "")
+	var v prView
+	must(t, json.Unmarshal(w.Body.Bytes(), &v))
+	if v.Head != "c0ffee" || len(v.Jobs) != 3 || len(v.Results) != 3 {
+		t.Errorf("pr = %+v, want head c0ffee with 3 jobs and 3 results", v)
+	}
+
+	w = do(http.HandlerFunc(pr), "GET", "/pr/org/repo/1", "")
+	if body := w.Body.String(); !strings.Contains(body, "/pr/org/repo/1/retry-failed") {
+		t.Errorf("pr page = %q, want retry-failed form", body)
+	}
+
+	w = postFrom(page, "/pr/org/repo/1/rerun")
+	if w.Code != http.StatusSeeOther || w.Header().Get("Location") != page {
+		t.Errorf("rerun from page = %d to %q, want 303 to %q", w.Code, w.Header().Get("Location"), page)
+	}
+
+	for _, referer := range []string{"", "https://evil.example.com/pr/org/repo/1", "https://farmer.example.com/"} {
+		if w := postFrom(referer, "/pr/org/repo/1/cancel"); w.Code != http.StatusForbidden {
+			t.Errorf("cancel from %q status = %d, want 403", referer, w.Code)
+		}
+	}
+	if jobs, _ := store.ListJobs(ctx); len(jobs) != 3 {
+		t.Errorf("jobs = %v after forbidden cancels, want all 3", jobs)
+	}
+
+	// A script, such as curl in CI, needs no referer.
+	for ctype, code := range map[string]int{
+		"application/x-www-form-urlencoded": http.StatusForbidden,
+		"text/plain":                        http.StatusForbidden,
+		"application/json; charset=utf-8":   200,
+	} {
+		req := httptest.NewRequest("POST", "/pr/org/repo/1/rerun?format=json", strings.NewReader("{}"))
+		req.Header.Set("Content-Type", ctype)
+		w := httptest.NewRecorder()
+		pr(w, req)
+		if w.Code != code {
+			t.Errorf("rerun with %s status = %d, want %d: %s", ctype, w.Code, code, w.Body)
+		}
+	}
+
+	for target, code := range map[string]int{
+		"/pr/org/repo/2":         404,
+		"/pr/org/repo/x":         400,
+		"/pr/org/repo/1/explode": 404,
+		"/pr/org/../1":           400,
+		"/pr/org/repo/1/a/b":     400,
+	} {
+		if w := do(http.HandlerFunc(pr), "POST", target, ""); w.Code != code {
+			t.Errorf("POST %s status = %d, want %d", target, w.Code, code)
+		}
+	}
+	if w := do(http.HandlerFunc(pr), "GET", "/pr/org/repo/1/cancel", ""); w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET cancel status = %d, want 405", w.Code)
+	}
+}
@@ -0,0 +1,346 @@
+package farmer
+
+// The merge queue.
+//
+// If $MERGE_QUEUE is set, a pull request enters the
+// queue when it gets the label $MERGE_LABEL, or when
+// an owner, member, or collaborator of its repository
+// comments /merge on it.
+// For each base branch with queued pull requests, the
+// farmer merges the first $MERGE_BATCH of them, in
+// order, into the branch's head, on a scratch branch
+// (see scratchBranch), and tests that merge: a batch.
+// It runs the jobs in Testfiles affected by the batch,
+// just as for a push. If they all pass, the farmer
+// fast-forwards the base branch to the merge, and the
+// pull requests leave the queue. If any fails, it tests
+// the first half of the batch instead, and so on, until
+// the failing pull request is alone in its batch; then
+// that pull request leaves the queue with a failure
+// status.
+//
+// A batch is discarded, and a new one made, if its base
+// branch moves or one of its pull requests changes or
+// leaves the queue.
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/wepogo/testbot/github"
+	"github.com/wepogo/testbot/log"
+)
+
+// queueContext is the context of the status
+// the merge queue posts on a pull request's head.
+const queueContext = "merge queue"
+
+// enqueue adds pull request pr in repo to the
+// merge queue, populating its jobs first if needed.
+func enqueue(ctx context.Context, repo string, pr prObj) error {
+	err := populateJobs(ctx, repo, pr)
+	if err != nil {
+		return err
+	}
+	added, err := store.Enqueue(ctx, repo, pr.Number)
+	if err != nil {
+		return fmt.Errorf("enqueueing pr: %w", err)
+	}
+	if added {
+		head := PR{Num: pr.Number, Head: pr.Head.SHA}
+		postQueueStatus(ctx, repo, head, "pending", "in merge queue", selfURLf("/"))
+	}
+	return nil
+}
+
+// mergeQueue moves the merge queue along,
+// every few seconds, forever.
+func mergeQueue() {
+	for {
+		time.Sleep(5 * time.Second)
+		err := stepQueue(context.Background())
+		if err != nil {
+			log.Error(context.Background(), err, "merge queue")
+		}
+	}
+}
+
+// stepQueue checks on each batch being tested,
+// and starts a batch for each branch with queued
+// pull requests but no batch.
+func stepQueue(ctx context.Context) error {
+	queue, err := store.Queue(ctx)
+	if err != nil {
+		return err
+	}
+	batches, err := store.Batches(ctx)
+	if err != nil {
+		return err
+	}
+	var order []branchKey
+	queued := make(map[branchKey][]PR)
+	for _, q := range queue {
+		k := branchKey{q.Repo, q.Branch}
+		if queued[k] == nil {
+			order = append(order, k)
+		}
+		queued[k] = append(queued[k], q.PR)
+	}
+
+	busy := make(map[branchKey]bool)
+	for _, b := range batches {
+		k := branchKey{b.Repo, b.Branch}
+		busy[k] = true
+		err = checkBatch(ctx, b, queued[k])
+		if err != nil {
+			log.Error(ctx, err, "checking batch for ", b.Repo, " ", b.Branch)
+		}
+	}
+	for _, k := range order {
+		if busy[k] {
+			continue
+		}
+		prs := queued[k]
+		if len(prs) > mergeBatch {
+			prs = prs[:mergeBatch]
+		}
+		err = startBatch(ctx, k.repo, k.branch, prs)
+		if err != nil {
+			log.Error(ctx, err, "starting batch for ", k.repo, " ", k.branch)
+		}
+	}
+	return nil
+}
+
+// checkBatch populates batch b if it isn't already,
+// then acts on its results, if they are all in.
+// Queued lists the pull requests queued for its branch.
+func checkBatch(ctx context.Context, b Batch, queued []PR) error {
+	for _, pr := range b.PRs {
+		if !containsPR(queued, pr) {
+			// Changed, or no longer queued.
+			return store.DeleteBatch(ctx, b.Repo, b.Branch)
+		}
+	}
+
+	if !b.Populated {
+		err := populateBatch(ctx, b)
+		if err != nil {
+			store.DeleteBatch(ctx, b.Repo, b.Branch)
+			return fmt.Errorf("populating batch: %w", err)
+		}
+		b.Populated = true
+		return store.PutBatch(ctx, b)
+	}
+
+	done, failed, err := batchResults(ctx, b)
+	if err != nil || !done {
+		return err
+	}
+	err = store.DeleteBatch(ctx, b.Repo, b.Branch)
+	if err != nil {
+		return err
+	}
+	if failed != nil {
+		if len(b.PRs) == 1 {
+			desc := "failed: " + failed.Dir + " " + failed.Name
+			return eject(ctx, b.Repo, b.PRs[0], desc, selfURLf("result/%d", failed.ID))
+		}
+		return startBatch(ctx, b.Repo, b.Branch, b.PRs[:len(b.PRs)/2])
+	}
+
+	// Fast-forward only. If the branch has moved since
+	// the batch was made, this fails, and the next step
+	// makes a new batch on the new head.
+	body := map[string]interface{}{"sha": b.SHA, "force": false}
+	err = gh.Patchf(body, nil, "%s/git/refs/heads/%s", b.Repo, b.Branch)
+	if err != nil {
+		return fmt.Errorf("fast-forwarding %s: %w", b.Branch, err)
+	}
+	for _, pr := range b.PRs {
+		err = store.Dequeue(ctx, b.Repo, pr.Num)
+		if err != nil {
+			return err
+		}
+		postQueueStatus(ctx, b.Repo, pr, "success", "merged into "+b.Branch, selfURLf("/"))
+	}
+	return nil
+}
+
+// populateBatch inserts the jobs for batch b
+// affected by the files the batch changes.
+func populateBatch(ctx context.Context, b Batch) error {
+	changed, err := compareFiles(ctx, b.Repo, b.Base, b.SHA)
+	if err != nil {
+		return err
+	}
+	testfiles, err := affectedTestfiles(ctx, b.Repo, b.SHA, changed)
+	if err != nil {
+		return err
+	}
+	open := contentsOpen(ctx, b.Repo, b.SHA)
+	failed := insertJobs(ctx, open, b.Repo, b.SHA, "", testfiles, changed)
+	if len(failed) > 0 {
+		return fmt.Errorf("fetching %d Testfiles", len(failed))
+	}
+	return nil
+}
+
+// batchResults returns whether every job for batch b
+// has finished, and, if so, the latest result of a job
+// that didn't succeed, if any.
+func batchResults(ctx context.Context, b Batch) (done bool, failed *ResultInfo, err error) {
+	jobs, err := store.ListJobs(ctx)
+	if err != nil {
+		return false, nil, err
+	}
+	for _, j := range jobs {
+		if j.Repo == b.Repo && j.SHA == b.SHA {
+			return false, nil, nil
+		}
+	}
+	results, err := store.CommitResults(ctx, b.Repo, b.SHA)
+	if err != nil {
+		return false, nil, err
+	}
+	seen := make(map[string]bool) // dir and name
+	for i, r := range results {
+		k := r.Dir + " " + r.Name
+		if seen[k] {
+			continue // not the latest
+		}
+		seen[k] = true
+		if r.State != "success" {
+			return true, &results[i], nil
+		}
+	}
+	return true, nil, nil
+}
+
+// startBatch merges prs, in order, into the head
+// of branch in repo, and records the merge as the
+// batch being tested for branch. Pull requests that
+// don't merge cleanly leave the queue.
+func startBatch(ctx context.Context, repo, branch string, prs []PR) error {
+	var ref struct{ Object struct{ SHA string } }
+	err := gh.Getf(&ref, "%s/git/ref/heads/%s", repo, branch)
+	if err != nil {
+		return fmt.Errorf("getting head of %s: %w", branch, err)
+	}
+	b := Batch{Repo: repo, Branch: branch, Base: ref.Object.SHA, SHA: ref.Object.SHA}
+
+	scratch := scratchBranch(branch)
+	body := map[string]interface{}{"sha": b.Base, "force": true}
+	err = gh.Patchf(body, nil, "%s/git/refs/heads/%s", repo, scratch)
+	if err == github.StatusError(422) {
+		// It doesn't exist yet.
+		body = map[string]interface{}{"ref": "refs/heads/" + scratch, "sha": b.Base}
+		err = gh.Postf(body, nil, "%s/git/refs", repo)
+	}
+	if err != nil {
+		return fmt.Errorf("resetting %s: %w", scratch, err)
+	}
+
+	for _, pr := range prs {
+		req := map[string]string{
+			"base":           scratch,
+			"head":           pr.Head,
+			"commit_message": fmt.Sprintf("Merge pull request #%d", pr.Num),
+		}
+		// The response is empty if there was nothing
+		// to merge, so decode it ourselves.
+		var resp bytes.Buffer
+		err = gh.Postf(req, &resp, "%s/merges", repo)
+		if err == github.StatusError(409) {
+			err = eject(ctx, repo, pr, "merge conflict with "+branch, "")
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("merging #%d: %w", pr.Num, err)
+		}
+		if resp.Len() > 0 {
+			var merge struct{ SHA string }
+			err = json.Unmarshal(resp.Bytes(), &merge)
+			if err != nil {
+				return fmt.Errorf("merging #%d: %w", pr.Num, err)
+			}
+			b.SHA = merge.SHA
+		}
+		b.PRs = append(b.PRs, pr)
+	}
+	if len(b.PRs) == 0 {
+		return nil
+	}
+
+	err = store.PutBatch(ctx, b)
+	if err != nil {
+		return err
+	}
+	desc := fmt.Sprintf("testing in a batch of %d", len(b.PRs))
+	for _, pr := range b.PRs {
+		postQueueStatus(ctx, repo, pr, "pending", desc, selfURLf("/"))
+	}
+	return nil
+}
+
+// scratchBranch returns the name of the branch
+// the farmer makes batches for branch on.
+func scratchBranch(branch string) string {
+	return "testbot/merge/" + branch
+}
+
+// eject removes pr in repo from the merge queue,
+// and marks its head as failing it.
+func eject(ctx context.Context, repo string, pr PR, desc, url string) error {
+	err := store.Dequeue(ctx, repo, pr.Num)
+	if err != nil {
+		return err
+	}
+	postQueueStatus(ctx, repo, pr, "failure", desc, url)
+	return nil
+}
+
+// postQueueStatus posts a status for the merge queue
+// on the head of pull request pr in repo.
+func postQueueStatus(ctx context.Context, repo string, pr PR, state, desc, url string) {
+	body := map[string]string{
+		"state":       state,
+		"target_url":  url,
+		"description": abbrevMiddle(desc, 140),
+		"context":     queueContext,
+	}
+	err := gh.Postf(body, nil, "%s/statuses/%s", repo, pr.Head)
+	if err != nil {
+		log.Error(ctx, err, "posting merge queue status for ", repo, "#", pr.Num)
+	}
+}
+
+// discardBatch discards the batch for branch in repo,
+// if its merge isn't sha, the new head of branch.
+func discardBatch(ctx context.Context, repo, branch, sha string) error {
+	batches, err := store.Batches(ctx)
+	if err != nil {
+		return err
+	}
+	for _, b := range batches {
+		if b.Repo == repo && b.Branch == branch && b.SHA != sha {
+			return store.DeleteBatch(ctx, repo, branch)
+		}
+	}
+	return nil
+}
+
+func containsPR(a []PR, pr PR) bool {
+	for _, x := range a {
+		if x == pr {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,138 @@
+package farmer
+
+// Result retention.
+//
+// If $RESULT_RETENTION is set, the farmer deletes results
+// older than that, every hour, except for results not yet
+// reported to GitHub and the latest result of each job at
+// a commit still in use (the head of an open pull request,
+// a pushed commit, a merge batch, or a commit with jobs
+// left), which the farmer may still need (for example,
+// to resolve needs, to finish a batch, or to retry).
+// If $RESULT_ARCHIVE is also set, it names a directory the
+// farmer appends each result to, as a line of JSON, before
+// deleting it. Each day's results go in their own file;
+// see archiveFile.
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/wepogo/testbot/log"
+)
+
+// pruneBatch is how many results
+// to archive and delete at a time.
+const pruneBatch = 1000
+
+// pruneResults prunes old results,
+// every hour, forever.
+func pruneResults() {
+	for {
+		ctx := context.Background()
+		_, err := prune(ctx, time.Now().Add(-retention), archiveDir)
+		if err != nil {
+			log.Error(ctx, err, "pruning results")
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// prune deletes the results from before t that can be
+// deleted (see Store.OldResults), first archiving them
+// in dir, if it isn't empty. It logs what it pruned,
+// and returns how many results that was.
+func prune(ctx context.Context, t time.Time, dir string) (int, error) {
+	n := 0
+	var oldest, newest time.Time
+	defer func() {
+		if n == 0 {
+			return
+		}
+		log.Printkv(ctx,
+			"at", "prune",
+			"results", n,
+			"oldest", oldest.Format(time.RFC3339),
+			"newest", newest.Format(time.RFC3339),
+			"archive", dir,
+		)
+	}()
+	for {
+		old, err := store.OldResults(ctx, t, pruneBatch)
+		if err != nil || len(old) == 0 {
+			return n, err
+		}
+		if dir != "" {
+			err = archive(dir, old)
+			if err != nil {
+				return n, fmt.Errorf("archiving results: %w", err)
+			}
+		}
+		var ids []int
+		for _, r := range old {
+			ids = append(ids, r.ID)
+		}
+		err = store.DeleteResults(ctx, ids)
+		if err != nil {
+			return n, err
+		}
+		if n == 0 {
+			oldest = old[0].CreatedAt
+		}
+		newest = old[len(old)-1].CreatedAt
+		n += len(old)
+		if len(old) < pruneBatch {
+			return n, nil
+		}
+	}
+}
+
+// archive appends results to the archive file
+// in dir for the day each was created.
+// If the results are deleted after all, they may
+// be archived again the next time, in duplicate.
+func archive(dir string, results []ResultInfo) error {
+	byFile := make(map[string][]ResultInfo)
+	var names []string // in order of first result
+	for _, r := range results {
+		name := archiveFile(dir, r.CreatedAt)
+		if byFile[name] == nil {
+			names = append(names, name)
+		}
+		byFile[name] = append(byFile[name], r)
+	}
+	for _, name := range names {
+		err := appendJSONLines(name, byFile[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// archiveFile returns the name of the file in dir
+// that archives results created at t.
+func archiveFile(dir string, t time.Time) string {
+	return filepath.Join(dir, "results-"+t.UTC().Format("2006-01-02")+".ndjson")
+}
+
+func appendJSONLines(name string, results []ResultInfo) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, r := range results {
+		r.ElapsedSp = "" // for display only
+		err = enc.Encode(r)
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
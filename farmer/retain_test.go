@@ -0,0 +1,89 @@
+package farmer
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wepogo/testbot"
+)
+
+func TestPrune(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		_, err = upsertPR(ctx, "org/repo", 2, "commit2", "main")
+		must(t, err)
+		head := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "unit"}
+		old := testbot.Job{Repo: "org/repo", SHA: "commit2", Dir: "/", Name: "unit"}
+		must(t, store.UpsertJobs(ctx, []testbot.Job{head, old}, nil, nil, nil, nil))
+		must(t, markDone(ctx, head, "failure", "", "", time.Second)) // 1
+		must(t, markDone(ctx, old, "failure", "", "", time.Second))  // 2
+		for _, id := range []int{1, 2} {
+			_, err = store.RetryResult(ctx, id)
+			must(t, err)
+		}
+		must(t, markDone(ctx, head, "success", "", "", time.Second)) // 3
+		must(t, markDone(ctx, old, "success", "", "", time.Second))  // 4
+		_, err = upsertPR(ctx, "org/repo", 2, "commit3", "main")
+		must(t, err)
+
+		_, err = store.AddPush(ctx, "org/repo", "main", "pushed1")
+		must(t, err)
+		must(t, store.PutBatch(ctx, Batch{Repo: "org/repo", Branch: "main", Base: "pushed1", SHA: "merge1", PRs: []PR{{1, "commit1"}}}))
+		pushed := testbot.Job{Repo: "org/repo", SHA: "pushed1", Dir: "/", Name: "unit"}
+		batch := testbot.Job{Repo: "org/repo", SHA: "merge1", Dir: "/", Name: "unit"}
+		must(t, store.UpsertJobs(ctx, []testbot.Job{pushed, batch}, nil, nil, nil, nil))
+		must(t, markDone(ctx, pushed, "failure", "", "", time.Second)) // 5
+		must(t, markDone(ctx, batch, "failure", "", "", time.Second))  // 6
+		for _, id := range []int{5, 6} {
+			_, err = store.RetryResult(ctx, id)
+			must(t, err)
+		}
+		must(t, markDone(ctx, pushed, "success", "", "", time.Second)) // 7
+		must(t, markDone(ctx, batch, "success", "", "", time.Second))  // 8
+		must(t, store.MarkReported(ctx, []int{1, 2, 3, 5, 6, 7, 8}))
+
+		// Keep 3, the latest at a head, 4, unreported,
+		// and 7 and 8, the latest at a push and a batch.
+		dir := t.TempDir()
+		n, err := prune(ctx, time.Now().Add(time.Hour), dir)
+		must(t, err)
+		if n != 4 {
+			t.Errorf("prune = %d, want 4", n)
+		}
+		for id, want := range map[int]error{
+			1: ErrNotFound, 2: ErrNotFound, 3: nil, 4: nil,
+			5: ErrNotFound, 6: ErrNotFound, 7: nil, 8: nil,
+		} {
+			if _, err := store.Result(ctx, id); err != want {
+				t.Errorf("Result(%d) err = %v, want %v", id, err, want)
+			}
+		}
+
+		f, err := os.Open(archiveFile(dir, time.Now()))
+		must(t, err)
+		defer f.Close()
+		var ids []int
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			var r ResultInfo
+			must(t, json.Unmarshal(sc.Bytes(), &r))
+			ids = append(ids, r.ID)
+		}
+		if !reflect.DeepEqual(ids, []int{1, 2, 5, 6}) {
+			t.Errorf("archived %v, want [1 2 5 6]", ids)
+		}
+
+		n, err = prune(ctx, time.Now().Add(time.Hour), "")
+		must(t, err)
+		if n != 0 {
+			t.Errorf("second prune = %d, want 0", n)
+		}
+	})
+}
@@ -0,0 +1,295 @@
+package farmer
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/wepogo/testbot"
+)
+
+// A Scheduler decides which jobs run on which boxes.
+//
+// Schedule gets the jobs that are ready to run
+// but not yet running, the boxes that are idle,
+// and the current assignments of jobs to boxes.
+// It returns new assignments. Each job and box can
+// appear in at most one of them, and a box must
+// have every label its job needs (see SchedBox.CanRun).
+// The farmer ignores any assignment that breaks these
+// rules. It calls Schedule again whenever the state
+// changes, so Schedule needn't make every possible
+// assignment at once, but a box left idle stays idle
+// until something changes.
+type Scheduler interface {
+	Schedule(jobs []SchedJob, boxes []SchedBox, runs []Run) []Run
+}
+
+// A SchedJob is a job waiting for a box.
+type SchedJob struct {
+	testbot.Job
+	Labels   []string
+	Expected time.Duration // from past results; 0 if unknown
+}
+
+// A SchedBox is a box waiting for a job.
+type SchedBox struct {
+	ID     string
+	Labels []string
+}
+
+// CanRun returns whether b has every label j needs.
+func (b SchedBox) CanRun(j SchedJob) bool {
+	for _, need := range j.Labels {
+		if !contains(b.Labels, need) {
+			return false
+		}
+	}
+	return true
+}
+
+// A Run is an assignment of a job to a box.
+type Run struct {
+	Job testbot.Job
+	Box string
+
+	// Base is the commit to merge Job's commit into
+	// before running it, if any, and Attempt counts
+	// the job's runs, from 1. The Store fills them
+	// in from the job; a Scheduler needn't set them.
+	Base    string
+	Attempt int
+}
+
+// schedulers holds every available Scheduler,
+// by the name used to select it in $SCHEDULER.
+var schedulers = map[string]Scheduler{
+	"dir":     &greedy{less: deeperDir},
+	"longest": &greedy{less: longerExpected, guess: true},
+	"fair":    &greedy{less: longerExpected, guess: true, fair: true},
+}
+
+// greedy is a Scheduler that repeatedly takes the first
+// job, in order, that some idle box can run, and assigns
+// it to the eligible box with the fewest labels, to keep
+// special boxes free for the jobs that need them.
+type greedy struct {
+	// less orders the jobs.
+	less func(a, b SchedJob) bool
+
+	// If fair is set, boxes are shared fairly among
+	// pull requests: before less, jobs are ordered by
+	// how many jobs are running for the same commit,
+	// so a small pull request can start right away
+	// even while a huge one is using every box.
+	// (We count by commit, rather than by pull request,
+	// because pull requests with the same head share
+	// the same jobs.)
+	fair bool
+
+	// If guess is set, a job with no history is taken
+	// to have the median expected time of the jobs that
+	// have some (see guessExpected), rather than 0.
+	guess bool
+}
+
+func (g *greedy) Schedule(jobs []SchedJob, boxes []SchedBox, runs []Run) []Run {
+	running := make(map[commit]int) // number of running jobs
+	for _, r := range runs {
+		running[commitOf(r.Job)]++
+	}
+	jobs = append([]SchedJob(nil), jobs...)
+	if g.guess {
+		guessExpected(jobs)
+	}
+	boxes = append([]SchedBox(nil), boxes...)
+	sort.SliceStable(boxes, func(i, j int) bool {
+		return len(boxes[i].Labels) < len(boxes[j].Labels)
+	})
+
+	var a []Run
+	for len(jobs) > 0 && len(boxes) > 0 {
+		sort.SliceStable(jobs, func(i, j int) bool {
+			x, y := jobs[i], jobs[j]
+			if nx, ny := running[commitOf(x.Job)], running[commitOf(y.Job)]; g.fair && nx != ny {
+				return nx < ny
+			}
+			return g.less(x, y)
+		})
+		ji, bi := pick(jobs, boxes)
+		if ji < 0 {
+			break
+		}
+		a = append(a, Run{Job: jobs[ji].Job, Box: boxes[bi].ID})
+		running[commitOf(jobs[ji].Job)]++
+		jobs = append(jobs[:ji], jobs[ji+1:]...)
+		boxes = append(boxes[:bi], boxes[bi+1:]...)
+	}
+	return a
+}
+
+// A commit is a commit in a repository.
+type commit struct {
+	repo, sha string
+}
+
+func commitOf(j testbot.Job) commit {
+	return commit{j.Repo, j.SHA}
+}
+
+// pick returns the index of the first job that
+// any box can run, and the first box that can run it.
+// It returns -1, -1 if no box can run any job.
+func pick(jobs []SchedJob, boxes []SchedBox) (ji, bi int) {
+	for ji, j := range jobs {
+		for bi, b := range boxes {
+			if b.CanRun(j) {
+				return ji, bi
+			}
+		}
+	}
+	return -1, -1
+}
+
+// deeperDir is the original order:
+// deepest directory first.
+func deeperDir(a, b SchedJob) bool {
+	return len(a.Dir) > len(b.Dir)
+}
+
+// longerExpected runs the longest jobs first,
+// which keeps any one box from finishing long after
+// the others, and so keeps the total time for a pull
+// request short. Jobs expected to take the same time
+// go in deeperDir order.
+func longerExpected(a, b SchedJob) bool {
+	if a.Expected != b.Expected {
+		return a.Expected > b.Expected
+	}
+	return deeperDir(a, b)
+}
+
+// guessExpected sets the expected time of each job in
+// jobs with no history to the median of the others,
+// so a new job runs neither before every long job nor
+// after every short one. If no job has any history,
+// it leaves them all at 0, to run in deeperDir order.
+func guessExpected(jobs []SchedJob) {
+	var known []time.Duration
+	for _, j := range jobs {
+		if j.Expected > 0 {
+			known = append(known, j.Expected)
+		}
+	}
+	if len(known) == 0 {
+		return
+	}
+	sort.Slice(known, func(i, j int) bool { return known[i] < known[j] })
+	median := known[len(known)/2]
+	for i := range jobs {
+		if jobs[i].Expected == 0 {
+			jobs[i].Expected = median
+		}
+	}
+}
+
+// queueOrder returns jobs in the order s would run them,
+// one at a time, if a single box with every label became
+// available after each one started. Jobs s would never
+// run come last, in their original order.
+func queueOrder(s Scheduler, jobs []SchedJob, runs []Run) []SchedJob {
+	every := SchedBox{ID: "every"}
+	for _, j := range jobs {
+		every.Labels = append(every.Labels, j.Labels...)
+	}
+	jobs = append([]SchedJob(nil), jobs...)
+	runs = append([]Run(nil), runs...)
+	var order []SchedJob
+	for len(jobs) > 0 {
+		a := s.Schedule(jobs, []SchedBox{every}, runs)
+		i := -1
+		if len(a) > 0 {
+			i = indexJob(jobs, a[0].Job)
+		}
+		if i < 0 {
+			break
+		}
+		order = append(order, jobs[i])
+		runs = append(runs, a[0])
+		jobs = append(jobs[:i], jobs[i+1:]...)
+	}
+	return append(order, jobs...)
+}
+
+func indexJob(jobs []SchedJob, job testbot.Job) int {
+	for i, j := range jobs {
+		if j.Job == job {
+			return i
+		}
+	}
+	return -1
+}
+
+func contains(a []string, s string) bool {
+	for _, x := range a {
+		if x == s {
+			return true
+		}
+	}
+	return false
+}
+
+// valid returns the assignments in a that follow
+// the rules in the Scheduler documentation.
+func valid(a []Run, jobs []SchedJob, boxes []SchedBox) []Run {
+	jobByID := make(map[testbot.Job]SchedJob)
+	for _, j := range jobs {
+		jobByID[j.Job] = j
+	}
+	boxByID := make(map[string]SchedBox)
+	for _, b := range boxes {
+		boxByID[b.ID] = b
+	}
+	var ok []Run
+	for _, r := range a {
+		j, jok := jobByID[r.Job]
+		b, bok := boxByID[r.Box]
+		if !jok || !bok || !b.CanRun(j) {
+			continue
+		}
+		delete(jobByID, r.Job)
+		delete(boxByID, r.Box)
+		ok = append(ok, r)
+	}
+	return ok
+}
+
+var scheduleMu sync.Mutex
+
+// schedule assigns waiting jobs to idle boxes
+// using scheduler, until it can make no more
+// assignments.
+func schedule(ctx context.Context) error {
+	scheduleMu.Lock()
+	defer scheduleMu.Unlock()
+	for {
+		jobs, boxes, runs, err := store.SchedState(ctx)
+		if err != nil {
+			return err
+		}
+		a := valid(scheduler.Schedule(jobs, boxes, runs), jobs, boxes)
+		if len(a) == 0 {
+			return nil
+		}
+		n, err := store.InsertRuns(ctx, a)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			// The state changed underneath us. We'll be
+			// notified, and get another chance then.
+			return nil
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package farmer
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/wepogo/testbot"
+)
+
+func schedJob(sha, dir, name string, expected time.Duration, labels ...string) SchedJob {
+	return SchedJob{
+		Job:      testbot.Job{SHA: sha, Dir: dir, Name: name},
+		Labels:   labels,
+		Expected: expected,
+	}
+}
+
+// runNames returns the name of each job in a and its box.
+func runNames(a []Run) []string {
+	var s []string
+	for _, r := range a {
+		s = append(s, r.Job.Name+"@"+r.Box)
+	}
+	return s
+}
+
+func TestSchedulers(t *testing.T) {
+	jobs := []SchedJob{
+		schedJob("c1", "/", "short", time.Second),
+		schedJob("c1", "/a/b", "deep", time.Second),
+		schedJob("c1", "/", "long", time.Minute),
+		schedJob("c1", "/a", "new", 0),
+	}
+	boxes := []SchedBox{{ID: "b1"}, {ID: "b2"}}
+	cases := []struct {
+		name string
+		want []string
+	}{
+		{"dir", []string{"deep@b1", "new@b2"}},
+		{"longest", []string{"long@b1", "deep@b2"}},
+		{"fair", []string{"long@b1", "deep@b2"}},
+	}
+	for _, test := range cases {
+		got := runNames(schedulers[test.name].Schedule(jobs, boxes, nil))
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: Schedule = %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+// Jobs with no history run as if they took the median
+// time of the others, in deeperDir order among equals.
+func TestScheduleUnknown(t *testing.T) {
+	jobs := []SchedJob{
+		schedJob("c1", "/", "new", 0),
+		schedJob("c1", "/", "short", time.Second),
+		schedJob("c1", "/a/b", "newdeep", 0),
+		schedJob("c1", "/", "medium", time.Minute),
+		schedJob("c1", "/", "long", time.Hour),
+	}
+	var got []string
+	for _, j := range queueOrder(schedulers["longest"], jobs, nil) {
+		got = append(got, j.Name)
+	}
+	want := []string{"long", "newdeep", "new", "medium", "short"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queueOrder = %q, want %q", got, want)
+	}
+
+	// With no history at all, deeperDir order.
+	got = nil
+	for _, j := range queueOrder(schedulers["longest"], []SchedJob{jobs[0], jobs[2]}, nil) {
+		got = append(got, j.Name)
+	}
+	want = []string{"newdeep", "new"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queueOrder with no history = %q, want %q", got, want)
+	}
+}
+
+func TestScheduleLabels(t *testing.T) {
+	jobs := []SchedJob{
+		schedJob("c1", "/", "gpu", time.Hour, "gpu"),
+		schedJob("c1", "/", "e2e", time.Minute, "big-mem"),
+		schedJob("c1", "/", "unit", time.Second),
+	}
+	boxes := []SchedBox{
+		{ID: "big", Labels: []string{"big-mem", "linux"}},
+		{ID: "small"},
+	}
+	got := runNames(schedulers["longest"].Schedule(jobs, boxes, nil))
+	want := []string{"e2e@big", "unit@small"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Schedule = %q, want %q", got, want)
+	}
+
+	// Prefer the plain box, keeping the big one free.
+	got = runNames(schedulers["longest"].Schedule(jobs[2:], boxes, nil))
+	want = []string{"unit@small"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Schedule = %q, want %q", got, want)
+	}
+}
+
+func TestScheduleFair(t *testing.T) {
+	jobs := []SchedJob{
+		schedJob("big", "/", "b3", time.Minute),
+		schedJob("big", "/", "b4", time.Minute),
+		schedJob("small", "/", "s1", time.Second),
+		schedJob("other", "/", "o1", time.Second),
+	}
+	runs := []Run{
+		{Job: testbot.Job{SHA: "big", Dir: "/", Name: "b1"}, Box: "b1"},
+		{Job: testbot.Job{SHA: "big", Dir: "/", Name: "b2"}, Box: "b2"},
+		{Job: testbot.Job{SHA: "other", Dir: "/", Name: "o0"}, Box: "b3"},
+	}
+	boxes := []SchedBox{{ID: "b4"}, {ID: "b5"}}
+	got := runNames(schedulers["fair"].Schedule(jobs, boxes, runs))
+	want := []string{"s1@b4", "o1@b5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("fair: Schedule = %q, want %q", got, want)
+	}
+	got = runNames(schedulers["longest"].Schedule(jobs, boxes, runs))
+	want = []string{"b3@b4", "b4@b5"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("longest: Schedule = %q, want %q", got, want)
+	}
+}
+
+func TestQueueOrder(t *testing.T) {
+	jobs := []SchedJob{
+		schedJob("big", "/", "b1", time.Minute),
+		schedJob("big", "/", "b2", time.Minute),
+		schedJob("big", "/", "b3", time.Minute),
+		schedJob("small", "/", "s1", time.Second),
+		schedJob("small", "/", "s2", time.Second),
+	}
+	var got []string
+	for _, j := range queueOrder(schedulers["fair"], jobs, nil) {
+		got = append(got, j.Name)
+	}
+	want := []string{"b1", "s1", "b2", "s2", "b3"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("queueOrder = %q, want %q", got, want)
+	}
+}
+
+func TestValid(t *testing.T) {
+	jobs := []SchedJob{
+		schedJob("c1", "/", "a", 0),
+		schedJob("c1", "/", "b", 0, "gpu"),
+	}
+	boxes := []SchedBox{{ID: "b1"}, {ID: "b2"}}
+	a := []Run{
+		{Job: jobs[0].Job, Box: "b1"},
+		{Job: jobs[0].Job, Box: "b2"},                                 // job twice
+		{Job: jobs[1].Job, Box: "b2"},                                 // missing label
+		{Job: testbot.Job{SHA: "c1", Dir: "/", Name: "x"}, Box: "b2"}, // unknown job
+	}
+	got := runNames(valid(a, jobs, boxes))
+	want := []string{"a@b1"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("valid = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,753 @@
+package farmer
+
+// The database schema, as a sequence of migrations
+// (see migrate.go). To change the schema, add a new
+// migration at the end of migrations; never edit one
+// that has been released, since databases in the wild
+// have already applied it.
+
+// migration1 is the schema from before migrations existed.
+const migration1 = `
+-- github data, reported from github, stored as-is
+
+CREATE TABLE pr (
+	num int PRIMARY KEY,
+	head text NOT NULL
+);
+
+CREATE TABLE job (
+	sha text NOT NULL,
+	dir text NOT NULL,
+	name text NOT NULL,
+
+	-- We'd like to do this, but Postgres can't have
+	-- a foreign key that references a non-unique column.
+	-- Instead, we do a little extra work in resolve
+	-- to delete jobs that don't correspond to any pr.
+	-- See occurrences of job_garbage below.
+	-- FOREIGN KEY (sha) REFERENCES pr (head) ON DELETE CASCADE,
+
+	PRIMARY KEY (sha, dir, name)
+);
+
+-- worker box data, reported from workers, stored as-is
+
+CREATE TABLE box (
+	id text PRIMARY KEY,
+	host text NOT NULL,
+	last_seen_at timestamp NOT NULL DEFAULT now()
+);
+
+-- derived data
+
+CREATE TABLE run (
+	sha text NOT NULL,
+	dir text NOT NULL,
+	name text NOT NULL,
+	UNIQUE (sha, dir, name),
+	FOREIGN KEY (sha, dir, name) REFERENCES job ON DELETE CASCADE,
+
+	box text NOT NULL,
+	UNIQUE (box),
+	FOREIGN KEY (box) REFERENCES box ON DELETE CASCADE
+);
+
+CREATE VIEW job_garbage AS
+	SELECT sha, dir, name FROM job
+	WHERE (sha) NOT IN (SELECT head FROM pr);
+
+CREATE FUNCTION resolve() RETURNS trigger AS $$
+DECLARE
+	jcsha text;
+	jcdir text;
+	jcname text;
+	bid text;
+	n int;
+BEGIN
+	-- First, delete any jobs that don't correspond
+	-- to a pr. See the foreign key comment in job.
+	-- But don't do the delete at all if there's nothing
+	-- to delete, because deleting zero rows still fires
+	-- triggers and would be an unbounded recursion here.
+	SELECT count(*) INTO strict n FROM job_garbage;
+	IF n > 0 THEN
+		DELETE FROM job
+		WHERE (sha, dir, name) IN (TABLE job_garbage);
+	END IF;
+
+	-- Find one assignment and attempt to insert it.
+	-- It's possible that a concurrent process inserts
+	-- a different mapping for either the job or the box,
+	-- causing this insertion to fail. That is okay.
+	-- If we found one (regardless of whether we successfully
+	-- insert it), our insert attempt will recursively trigger
+	-- this resolve function to try again.
+	-- This process will repeat until we reach a fixed point
+	-- (that is, no new assignments are possible because there
+	-- are no unassigned jobs or no boxes available),
+	-- at which time we notify all observers.
+
+	SELECT id INTO bid FROM box
+	WHERE (id) NOT IN (SELECT box FROM run);
+
+	SELECT sha, dir, name INTO jcsha, jcdir, jcname FROM job
+	WHERE (sha, dir, name) NOT IN (SELECT sha, dir, name FROM run)
+	ORDER BY length(dir) DESC;
+
+	IF jcsha IS NULL OR bid IS NULL THEN
+		NOTIFY state_wakeup;
+	ELSE
+		INSERT INTO run (sha, dir, name, box)
+		VALUES (jcsha, jcdir, jcname, bid)
+		ON CONFLICT DO NOTHING;
+	END IF;
+
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER pr_write
+	AFTER INSERT OR UPDATE OR DELETE ON pr
+	EXECUTE PROCEDURE resolve();
+
+CREATE TRIGGER job_write
+	AFTER INSERT OR UPDATE OR DELETE ON job
+	EXECUTE PROCEDURE resolve();
+
+CREATE TRIGGER box_write
+	AFTER INSERT OR UPDATE OR DELETE ON box
+	EXECUTE PROCEDURE resolve();
+
+CREATE TRIGGER run_write
+	AFTER INSERT OR UPDATE OR DELETE ON run
+	EXECUTE PROCEDURE resolve();
+
+-- results, to report back to github
+
+CREATE TABLE result (
+	id serial PRIMARY KEY,
+	sha text NOT NULL,
+	dir text NOT NULL,
+	name text NOT NULL,
+	elapsed_ms int NOT NULL,
+	pr int[] NOT NULL,
+	state text NOT NULL, -- error, failure, pending, or success
+	descr text NOT NULL, -- any extra info, shows up in GH web UI
+	url text NOT NULL,
+	reported boolean NOT NULL DEFAULT false,
+	created_at timestamp NOT NULL DEFAULT now()
+);
+
+CREATE FUNCTION notify_report() RETURNS trigger AS $$
+DECLARE
+BEGIN
+	NOTIFY report;
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER result_write
+	AFTER INSERT OR UPDATE OR DELETE ON result
+	EXECUTE PROCEDURE notify_report();
+
+`
+
+// migration2 adds needs, labels, and expected run times,
+// and moves the assignment of jobs to boxes into Go.
+const migration2 = `
+ALTER TABLE job
+	-- labels a box must have to run this job
+	ADD COLUMN labels text[] NOT NULL DEFAULT '{}';
+
+ALTER TABLE box ADD COLUMN labels text[] NOT NULL DEFAULT '{}';
+
+ALTER TABLE result
+	-- copied from job, for retries
+	ADD COLUMN labels text[] NOT NULL DEFAULT '{}';
+
+-- need records that job (sha, dir, name) can run
+-- only after job (sha, need_dir, need_name) passes.
+-- Rows are removed along with the dependent job.
+
+CREATE TABLE need (
+	sha text NOT NULL,
+	dir text NOT NULL,
+	name text NOT NULL,
+	FOREIGN KEY (sha, dir, name) REFERENCES job ON DELETE CASCADE,
+
+	need_dir text NOT NULL,
+	need_name text NOT NULL,
+
+	PRIMARY KEY (sha, dir, name, need_dir, need_name)
+);
+
+CREATE INDEX result_test ON result (dir, name, id);
+
+-- The expected run time of each job, in milliseconds:
+-- the average elapsed time of the 10 most recent results
+-- for the same test (dir and name) on any commit.
+-- It is null for a test with no history.
+CREATE VIEW job_expected AS
+	SELECT sha, dir, name, (
+		SELECT avg(elapsed_ms)::int FROM (
+			SELECT elapsed_ms FROM result
+			WHERE (result.dir, result.name) = (job.dir, job.name)
+			AND elapsed_ms > 0 -- not canceled or skipped
+			ORDER BY id DESC LIMIT 10
+		) recent
+	) AS expected_ms
+	FROM job;
+
+-- needs, resolved against jobs and results.
+
+-- A need is pending while its job is still in the job
+-- table, and failed once its job is done and the most
+-- recent result for it is anything but success.
+-- A need with neither a job nor a result refers to a
+-- test that isn't part of this commit's run, and is
+-- treated as satisfied.
+CREATE VIEW need_state AS
+	SELECT sha, dir, name,
+		EXISTS (
+			SELECT 1 FROM job
+			WHERE (job.sha, job.dir, job.name) = (need.sha, need_dir, need_name)
+		) AS pending,
+		coalesce((
+			SELECT state != 'success' FROM result
+			WHERE (result.sha, result.dir, result.name) = (need.sha, need_dir, need_name)
+			ORDER BY id DESC LIMIT 1
+		), false) AS failed
+	FROM need;
+
+CREATE VIEW job_blocked AS
+	SELECT DISTINCT sha, dir, name FROM need_state
+	WHERE failed AND NOT pending;
+
+CREATE VIEW job_ready AS
+	SELECT sha, dir, name, labels FROM job
+	WHERE (sha, dir, name) NOT IN (
+		SELECT sha, dir, name FROM need_state
+		WHERE pending OR failed
+	);
+
+-- Jobs that no current box has the labels to run.
+-- They wait until such a box comes online.
+CREATE VIEW job_ineligible AS
+	SELECT sha, dir, name FROM job
+	WHERE NOT EXISTS (
+		SELECT 1 FROM box WHERE job.labels <@ box.labels
+	);
+
+-- The farmer now assigns jobs to boxes itself
+-- (see schedule in sched.go), so resolve only cleans up.
+
+CREATE OR REPLACE FUNCTION resolve() RETURNS trigger AS $$
+DECLARE
+	n int;
+BEGIN
+	-- First, delete any jobs that don't correspond
+	-- to a pr. See the foreign key comment in job.
+	-- But don't do the delete at all if there's nothing
+	-- to delete, because deleting zero rows still fires
+	-- triggers and would be an unbounded recursion here.
+	SELECT count(*) INTO strict n FROM job_garbage;
+	IF n > 0 THEN
+		DELETE FROM job
+		WHERE (sha, dir, name) IN (TABLE job_garbage);
+	END IF;
+
+	-- Next, finish any jobs that can never run because
+	-- a job they need has failed. Their results are
+	-- reported like any other, which in turn can block
+	-- jobs that need them, on the next recursive call.
+	SELECT count(*) INTO strict n FROM job_blocked;
+	IF n > 0 THEN
+		WITH done AS (
+			DELETE FROM job
+			WHERE (sha, dir, name) IN (TABLE job_blocked)
+			RETURNING sha, dir, name, labels
+		),
+		donepr AS (
+			SELECT sha, dir, name, labels, array_agg(num) as prnum
+			FROM done JOIN pr ON (done.sha=pr.head)
+			GROUP BY sha, dir, name, labels
+		)
+		INSERT INTO result (sha, dir, name, labels, pr, state, descr, url, elapsed_ms)
+		SELECT sha, dir, name, labels, prnum, 'error', 'skipped: dependency failed', '', 0
+		FROM donepr;
+	END IF;
+
+	-- Finally, let the farmer know the state has changed.
+	-- It assigns jobs to boxes (see schedule in sched.go),
+	-- which fires this trigger again, until no more
+	-- assignments are possible.
+	NOTIFY state_wakeup;
+
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+`
+
+// migration3 makes the repository part of the identity
+// of pull requests, jobs, and results, so one farmer can
+// serve several repositories.
+const migration3 = `
+-- Pull requests and jobs are rebuilt from GitHub when
+-- the farmer starts, so drop them rather than guess
+-- which repository each belongs to. This also drops
+-- the views on them, which are recreated below.
+DROP TABLE run, need, job, pr CASCADE;
+
+CREATE TABLE pr (
+	repo text NOT NULL, -- GitHub owner/name
+	num int NOT NULL,
+	head text NOT NULL,
+	PRIMARY KEY (repo, num)
+);
+
+CREATE TABLE job (
+	repo text NOT NULL,
+	sha text NOT NULL,
+	dir text NOT NULL,
+	name text NOT NULL,
+
+	-- labels a box must have to run this job
+	labels text[] NOT NULL DEFAULT '{}',
+
+	-- We'd like to do this, but Postgres can't have
+	-- a foreign key that references a non-unique column.
+	-- Instead, we do a little extra work in resolve
+	-- to delete jobs that don't correspond to any pr.
+	-- See occurrences of job_garbage below.
+	-- FOREIGN KEY (repo, sha) REFERENCES pr (repo, head) ON DELETE CASCADE,
+
+	PRIMARY KEY (repo, sha, dir, name)
+);
+
+-- need records that job (repo, sha, dir, name) can run
+-- only after job (repo, sha, need_dir, need_name) passes.
+-- Rows are removed along with the dependent job.
+
+CREATE TABLE need (
+	repo text NOT NULL,
+	sha text NOT NULL,
+	dir text NOT NULL,
+	name text NOT NULL,
+	FOREIGN KEY (repo, sha, dir, name) REFERENCES job ON DELETE CASCADE,
+
+	need_dir text NOT NULL,
+	need_name text NOT NULL,
+
+	PRIMARY KEY (repo, sha, dir, name, need_dir, need_name)
+);
+
+CREATE TABLE run (
+	repo text NOT NULL,
+	sha text NOT NULL,
+	dir text NOT NULL,
+	name text NOT NULL,
+	UNIQUE (repo, sha, dir, name),
+	FOREIGN KEY (repo, sha, dir, name) REFERENCES job ON DELETE CASCADE,
+
+	box text NOT NULL,
+	UNIQUE (box),
+	FOREIGN KEY (box) REFERENCES box ON DELETE CASCADE
+);
+
+CREATE TRIGGER pr_write
+	AFTER INSERT OR UPDATE OR DELETE ON pr
+	EXECUTE PROCEDURE resolve();
+
+CREATE TRIGGER job_write
+	AFTER INSERT OR UPDATE OR DELETE ON job
+	EXECUTE PROCEDURE resolve();
+
+CREATE TRIGGER run_write
+	AFTER INSERT OR UPDATE OR DELETE ON run
+	EXECUTE PROCEDURE resolve();
+
+-- Results from before have an empty repo. We can't
+-- tell where to report them, so we don't.
+ALTER TABLE result ADD COLUMN repo text NOT NULL DEFAULT '';
+ALTER TABLE result ALTER COLUMN repo DROP DEFAULT;
+UPDATE result SET reported = true WHERE NOT reported;
+
+DROP INDEX result_test;
+CREATE INDEX result_test ON result (repo, dir, name, id);
+
+CREATE VIEW job_garbage AS
+	SELECT repo, sha, dir, name FROM job
+	WHERE (repo, sha) NOT IN (SELECT repo, head FROM pr);
+
+-- The expected run time of each job, in milliseconds:
+-- the average elapsed time of the 10 most recent results
+-- for the same test (repo, dir, and name) on any commit.
+-- It is null for a test with no history.
+CREATE VIEW job_expected AS
+	SELECT repo, sha, dir, name, (
+		SELECT avg(elapsed_ms)::int FROM (
+			SELECT elapsed_ms FROM result
+			WHERE (result.repo, result.dir, result.name) = (job.repo, job.dir, job.name)
+			AND elapsed_ms > 0 -- not canceled or skipped
+			ORDER BY id DESC LIMIT 10
+		) recent
+	) AS expected_ms
+	FROM job;
+
+-- needs, resolved against jobs and results.
+
+-- A need is pending while its job is still in the job
+-- table, and failed once its job is done and the most
+-- recent result for it is anything but success.
+-- A need with neither a job nor a result refers to a
+-- test that isn't part of this commit's run, and is
+-- treated as satisfied.
+CREATE VIEW need_state AS
+	SELECT repo, sha, dir, name,
+		EXISTS (
+			SELECT 1 FROM job
+			WHERE (job.repo, job.sha, job.dir, job.name) = (need.repo, need.sha, need_dir, need_name)
+		) AS pending,
+		coalesce((
+			SELECT state != 'success' FROM result
+			WHERE (result.repo, result.sha, result.dir, result.name) = (need.repo, need.sha, need_dir, need_name)
+			ORDER BY id DESC LIMIT 1
+		), false) AS failed
+	FROM need;
+
+CREATE VIEW job_blocked AS
+	SELECT DISTINCT repo, sha, dir, name FROM need_state
+	WHERE failed AND NOT pending;
+
+CREATE VIEW job_ready AS
+	SELECT repo, sha, dir, name, labels FROM job
+	WHERE (repo, sha, dir, name) NOT IN (
+		SELECT repo, sha, dir, name FROM need_state
+		WHERE pending OR failed
+	);
+
+-- Jobs that no current box has the labels to run.
+-- They wait until such a box comes online.
+CREATE VIEW job_ineligible AS
+	SELECT repo, sha, dir, name FROM job
+	WHERE NOT EXISTS (
+		SELECT 1 FROM box WHERE job.labels <@ box.labels
+	);
+
+CREATE OR REPLACE FUNCTION resolve() RETURNS trigger AS $$
+DECLARE
+	n int;
+BEGIN
+	-- First, delete any jobs that don't correspond
+	-- to a pr. See the foreign key comment in job.
+	-- But don't do the delete at all if there's nothing
+	-- to delete, because deleting zero rows still fires
+	-- triggers and would be an unbounded recursion here.
+	SELECT count(*) INTO strict n FROM job_garbage;
+	IF n > 0 THEN
+		DELETE FROM job
+		WHERE (repo, sha, dir, name) IN (TABLE job_garbage);
+	END IF;
+
+	-- Next, finish any jobs that can never run because
+	-- a job they need has failed. Their results are
+	-- reported like any other, which in turn can block
+	-- jobs that need them, on the next recursive call.
+	SELECT count(*) INTO strict n FROM job_blocked;
+	IF n > 0 THEN
+		WITH done AS (
+			DELETE FROM job
+			WHERE (repo, sha, dir, name) IN (TABLE job_blocked)
+			RETURNING repo, sha, dir, name, labels
+		),
+		donepr AS (
+			SELECT done.repo, sha, dir, name, labels, array_agg(num) as prnum
+			FROM done JOIN pr ON (done.repo, done.sha) = (pr.repo, pr.head)
+			GROUP BY done.repo, sha, dir, name, labels
+		)
+		INSERT INTO result (repo, sha, dir, name, labels, pr, state, descr, url, elapsed_ms)
+		SELECT repo, sha, dir, name, labels, prnum, 'error', 'skipped: dependency failed', '', 0
+		FROM donepr;
+	END IF;
+
+	-- Finally, let the farmer know the state has changed.
+	-- It assigns jobs to boxes (see schedule in sched.go),
+	-- which fires this trigger again, until no more
+	-- assignments are possible.
+	NOTIFY state_wakeup;
+
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+`
+
+const migration4 = `
+-- push records each commit pushed to a branch we test.
+-- Its jobs are kept until they finish, even after a later
+-- push to the same branch, unlike a pull request's jobs,
+-- which are deleted when its head moves. Rows with no
+-- jobs left are deleted after a while; see AddPush.
+CREATE TABLE push (
+	repo text NOT NULL,
+	sha text NOT NULL,
+	branch text NOT NULL,
+	pushed_at timestamp NOT NULL DEFAULT now(),
+	PRIMARY KEY (repo, sha, branch)
+);
+
+CREATE TRIGGER push_write
+	AFTER INSERT OR UPDATE OR DELETE ON push
+	EXECUTE PROCEDURE resolve();
+
+CREATE OR REPLACE VIEW job_garbage AS
+	SELECT repo, sha, dir, name FROM job
+	WHERE (repo, sha) NOT IN (SELECT repo, head FROM pr)
+	AND (repo, sha) NOT IN (SELECT repo, sha FROM push);
+
+CREATE OR REPLACE FUNCTION resolve() RETURNS trigger AS $$
+DECLARE
+	n int;
+BEGIN
+	-- First, delete any jobs that don't correspond
+	-- to a pr or a push. See the foreign key comment
+	-- in job. But don't do the delete at all if there's
+	-- nothing to delete, because deleting zero rows still
+	-- fires triggers and would be an unbounded recursion here.
+	SELECT count(*) INTO strict n FROM job_garbage;
+	IF n > 0 THEN
+		DELETE FROM job
+		WHERE (repo, sha, dir, name) IN (TABLE job_garbage);
+	END IF;
+
+	-- Next, finish any jobs that can never run because
+	-- a job they need has failed. Their results are
+	-- reported like any other, which in turn can block
+	-- jobs that need them, on the next recursive call.
+	SELECT count(*) INTO strict n FROM job_blocked;
+	IF n > 0 THEN
+		WITH done AS (
+			DELETE FROM job
+			WHERE (repo, sha, dir, name) IN (TABLE job_blocked)
+			RETURNING repo, sha, dir, name, labels
+		)
+		INSERT INTO result (repo, sha, dir, name, labels, pr, state, descr, url, elapsed_ms)
+		SELECT repo, sha, dir, name, labels, (
+			SELECT coalesce(array_agg(num), '{}') FROM pr
+			WHERE (pr.repo, pr.head) = (done.repo, done.sha)
+		), 'error', 'skipped: dependency failed', '', 0
+		FROM done;
+	END IF;
+
+	-- Finally, let the farmer know the state has changed.
+	-- It assigns jobs to boxes (see schedule in sched.go),
+	-- which fires this trigger again, until no more
+	-- assignments are possible.
+	NOTIFY state_wakeup;
+
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+`
+
+const migration5 = `
+-- Merge testing; see TEST_MERGE in main.go.
+
+-- branch is the pull request's base branch.
+ALTER TABLE pr ADD COLUMN branch text NOT NULL DEFAULT '';
+
+-- base is the commit to merge the job's commit into
+-- before testing it, or '' to test the commit alone.
+-- It is fixed when the job is inserted, so a job that
+-- is already running isn't disturbed by a new base.
+ALTER TABLE job ADD COLUMN base text NOT NULL DEFAULT '';
+ALTER TABLE result ADD COLUMN base text NOT NULL DEFAULT '';
+
+CREATE OR REPLACE FUNCTION resolve() RETURNS trigger AS $$
+DECLARE
+	n int;
+BEGIN
+	-- First, delete any jobs that don't correspond
+	-- to a pr or a push. See the foreign key comment
+	-- in job. But don't do the delete at all if there's
+	-- nothing to delete, because deleting zero rows still
+	-- fires triggers and would be an unbounded recursion here.
+	SELECT count(*) INTO strict n FROM job_garbage;
+	IF n > 0 THEN
+		DELETE FROM job
+		WHERE (repo, sha, dir, name) IN (TABLE job_garbage);
+	END IF;
+
+	-- Next, finish any jobs that can never run because
+	-- a job they need has failed. Their results are
+	-- reported like any other, which in turn can block
+	-- jobs that need them, on the next recursive call.
+	SELECT count(*) INTO strict n FROM job_blocked;
+	IF n > 0 THEN
+		WITH done AS (
+			DELETE FROM job
+			WHERE (repo, sha, dir, name) IN (TABLE job_blocked)
+			RETURNING repo, sha, dir, name, labels, base
+		)
+		INSERT INTO result (repo, sha, dir, name, labels, base, pr, state, descr, url, elapsed_ms)
+		SELECT repo, sha, dir, name, labels, base, (
+			SELECT coalesce(array_agg(num), '{}') FROM pr
+			WHERE (pr.repo, pr.head) = (done.repo, done.sha)
+		), 'error', 'skipped: dependency failed', '', 0
+		FROM done;
+	END IF;
+
+	-- Finally, let the farmer know the state has changed.
+	-- It assigns jobs to boxes (see schedule in sched.go),
+	-- which fires this trigger again, until no more
+	-- assignments are possible.
+	NOTIFY state_wakeup;
+
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+`
+
+const migration6 = `
+-- The merge queue; see queue.go.
+
+-- merge_queue holds the pull requests waiting to be
+-- merged into their base branches, in order by queued_at.
+CREATE TABLE merge_queue (
+	repo text NOT NULL,
+	num int NOT NULL,
+	queued_at timestamp NOT NULL DEFAULT clock_timestamp(),
+	PRIMARY KEY (repo, num),
+	FOREIGN KEY (repo, num) REFERENCES pr ON DELETE CASCADE
+);
+
+-- merge_batch holds, for each base branch, the
+-- speculative merge of the first few queued pull
+-- requests into it that is being tested. Like a pushed
+-- commit, its jobs are kept until it is deleted.
+CREATE TABLE merge_batch (
+	repo text NOT NULL,
+	branch text NOT NULL,
+	base text NOT NULL, -- head of branch merged into
+	sha text NOT NULL, -- the merge
+	prs int[] NOT NULL, -- merged, in order
+	heads text[] NOT NULL, -- head of each of prs merged
+	populated bool NOT NULL DEFAULT false, -- jobs inserted
+	PRIMARY KEY (repo, branch)
+);
+
+CREATE TRIGGER merge_batch_write
+	AFTER INSERT OR UPDATE OR DELETE ON merge_batch
+	EXECUTE PROCEDURE resolve();
+
+CREATE OR REPLACE VIEW job_garbage AS
+	SELECT repo, sha, dir, name FROM job
+	WHERE (repo, sha) NOT IN (SELECT repo, head FROM pr)
+	AND (repo, sha) NOT IN (SELECT repo, sha FROM push)
+	AND (repo, sha) NOT IN (SELECT repo, sha FROM merge_batch);
+`
+
+const migration7 = `
+-- Automatic retries; see FinishJob in store.go.
+
+-- retries is how many more times to run a job, at most,
+-- after it fails, and attempt counts its runs, from 1.
+-- A result copies both from its job.
+ALTER TABLE job ADD COLUMN retries int NOT NULL DEFAULT 0;
+ALTER TABLE job ADD COLUMN attempt int NOT NULL DEFAULT 1;
+ALTER TABLE result ADD COLUMN retries int NOT NULL DEFAULT 0;
+ALTER TABLE result ADD COLUMN attempt int NOT NULL DEFAULT 1;
+
+-- retried is true for a failure after which
+-- the job was run again automatically.
+ALTER TABLE result ADD COLUMN retried bool NOT NULL DEFAULT false;
+
+-- flaky is true for a success after
+-- a failure of the same job.
+ALTER TABLE result ADD COLUMN flaky bool NOT NULL DEFAULT false;
+`
+
+const migration8 = `
+-- host is the host of the box that ran
+-- the job, or '' if it didn't run.
+ALTER TABLE result ADD COLUMN host text NOT NULL DEFAULT '';
+`
+
+const migration9 = `
+-- For finding old results to delete or archive,
+-- and recent ones for the flakiness dashboard.
+CREATE INDEX result_created_at ON result (created_at);
+`
+
+const migration10 = `
+-- A draining box is shutting down. It gets
+-- no new jobs, but finishes the one it has.
+ALTER TABLE box ADD COLUMN draining bool NOT NULL DEFAULT false;
+
+-- Jobs that no current box, other than those
+-- draining, has the labels to run.
+CREATE OR REPLACE VIEW job_ineligible AS
+	SELECT repo, sha, dir, name FROM job
+	WHERE NOT EXISTS (
+		SELECT 1 FROM box WHERE job.labels <@ box.labels AND NOT box.draining
+	);
+`
+
+const migration11 = `
+-- A result copies the needs of its job, so
+-- RetryResult can restore them (see need):
+-- need_dirs[i] and need_names[i] name each.
+ALTER TABLE result ADD COLUMN need_dirs text[] NOT NULL DEFAULT '{}';
+ALTER TABLE result ADD COLUMN need_names text[] NOT NULL DEFAULT '{}';
+
+CREATE VIEW job_needs AS
+	SELECT repo, sha, dir, name,
+		array_agg(need_dir ORDER BY need_dir, need_name) AS need_dirs,
+		array_agg(need_name ORDER BY need_dir, need_name) AS need_names
+	FROM need
+	GROUP BY repo, sha, dir, name;
+
+CREATE OR REPLACE FUNCTION resolve() RETURNS trigger AS $$
+DECLARE
+	n int;
+BEGIN
+	-- First, delete any jobs that don't correspond
+	-- to a pr or a push. See the foreign key comment
+	-- in job. But don't do the delete at all if there's
+	-- nothing to delete, because deleting zero rows still
+	-- fires triggers and would be an unbounded recursion here.
+	SELECT count(*) INTO strict n FROM job_garbage;
+	IF n > 0 THEN
+		DELETE FROM job
+		WHERE (repo, sha, dir, name) IN (TABLE job_garbage);
+	END IF;
+
+	-- Next, finish any jobs that can never run because
+	-- a job they need has failed. Their results are
+	-- reported like any other, which in turn can block
+	-- jobs that need them, on the next recursive call.
+	SELECT count(*) INTO strict n FROM job_blocked;
+	IF n > 0 THEN
+		WITH done AS (
+			DELETE FROM job
+			WHERE (repo, sha, dir, name) IN (TABLE job_blocked)
+			RETURNING repo, sha, dir, name, labels, base
+		)
+		INSERT INTO result (repo, sha, dir, name, labels, base, need_dirs, need_names, pr, state, descr, url, elapsed_ms)
+		SELECT repo, sha, dir, name, labels, base,
+			coalesce(need_dirs, '{}'), coalesce(need_names, '{}'), (
+			SELECT coalesce(array_agg(num), '{}') FROM pr
+			WHERE (pr.repo, pr.head) = (done.repo, done.sha)
+		), 'error', 'skipped: dependency failed', '', 0
+		FROM done LEFT JOIN job_needs USING (repo, sha, dir, name);
+	END IF;
+
+	-- Finally, let the farmer know the state has changed.
+	-- It assigns jobs to boxes (see schedule in sched.go),
+	-- which fires this trigger again, until no more
+	-- assignments are possible.
+	NOTIFY state_wakeup;
+
+	RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+`
@@ -0,0 +1,70 @@
+package farmer
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/wepogo/testbot"
+)
+
+// shardStatus returns the status to post for job,
+// shard number shard of shards of the Testfile entry
+// named entry, in the one status context shared by
+// all the entry's shards, given the job's own state
+// and description. See rollupShards.
+func shardStatus(ctx context.Context, job testbot.Job, entry string, shard, shards int, state, desc string) (newState, newDesc string, post bool, err error) {
+	results, err := store.CommitResults(ctx, job.Repo, job.SHA)
+	if err != nil {
+		return "", "", false, err
+	}
+	others := make(map[int]ResultInfo) // latest result by shard
+	for _, r := range results {
+		if r.Dir != job.Dir {
+			continue
+		}
+		e, i, n, ok := testbot.ParseShard(r.Name)
+		if !ok || e != entry || n != shards || i == shard {
+			continue
+		}
+		if _, ok := others[i]; !ok {
+			others[i] = r
+		}
+	}
+	newState, newDesc, post = rollupShards(shard, shards, state, desc, others)
+	return newState, newDesc, post, nil
+}
+
+// rollupShards combines the state and description of
+// shard number shard of shards with others, the latest
+// results of the other shards, by shard number.
+// The entry fails if any shard fails, and succeeds
+// once every shard has succeeded. Until then, it is
+// pending. It returns post false if another shard has
+// already failed, so its failure stands.
+func rollupShards(shard, shards int, state, desc string, others map[int]ResultInfo) (newState, newDesc string, post bool) {
+	prefix := fmt.Sprintf("shard %d of %d: ", shard, shards)
+	if state == "failure" || state == "error" {
+		return state, prefix + desc, true
+	}
+	passed := 0
+	if state == "success" {
+		passed++
+	}
+	for _, r := range others {
+		switch {
+		case r.Retried:
+			// Not done yet.
+		case r.State == "success":
+			passed++
+		default:
+			return "", "", false
+		}
+	}
+	switch {
+	case passed == shards:
+		return "success", fmt.Sprintf("all %d shards passed", shards), true
+	case state == "success":
+		return "pending", fmt.Sprintf("%d of %d shards passed", passed, shards), true
+	}
+	return "pending", prefix + desc, true
+}
@@ -0,0 +1,34 @@
+package farmer
+
+import "testing"
+
+func TestRollupShards(t *testing.T) {
+	passed := ResultInfo{State: "success"}
+	failed := ResultInfo{State: "failure"}
+	retrying := ResultInfo{State: "failure", Retried: true}
+	cases := []struct {
+		state     string
+		others    map[int]ResultInfo
+		wantState string
+		wantDesc  string
+		wantPost  bool
+	}{
+		{"pending", nil, "pending", "shard 1 of 3: running", true},
+		{"success", nil, "pending", "1 of 3 shards passed", true},
+		{"success", map[int]ResultInfo{0: passed}, "pending", "2 of 3 shards passed", true},
+		{"success", map[int]ResultInfo{0: passed, 2: passed}, "success", "all 3 shards passed", true},
+		{"success", map[int]ResultInfo{0: passed, 2: retrying}, "pending", "2 of 3 shards passed", true},
+		{"success", map[int]ResultInfo{0: failed, 2: passed}, "", "", false},
+		{"pending", map[int]ResultInfo{0: failed}, "", "", false},
+		{"failure", map[int]ResultInfo{0: passed, 2: passed}, "failure", "shard 1 of 3: running", true},
+		{"error", map[int]ResultInfo{0: failed}, "error", "shard 1 of 3: running", true},
+	}
+
+	for _, test := range cases {
+		state, desc, post := rollupShards(1, 3, test.state, "running", test.others)
+		if state != test.wantState || desc != test.wantDesc || post != test.wantPost {
+			t.Errorf("rollupShards(1, 3, %q, %v) = %q, %q, %v, want %q, %q, %v",
+				test.state, test.others, state, desc, post, test.wantState, test.wantDesc, test.wantPost)
+		}
+	}
+}
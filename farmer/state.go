@@ -2,13 +2,12 @@ package farmer
 
 import (
 	"context"
-	"database/sql"
+	"errors"
 	"fmt"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/lib/pq"
-
 	"github.com/wepogo/testbot"
 	"github.com/wepogo/testbot/log"
 )
@@ -20,10 +19,14 @@ var (
 	// NOTE(kr): allStates is reassigned, but never mutated
 )
 
-func notify(l *pq.Listener) {
+func notify(c <-chan string) {
 	ctx := context.Background()
 
-	err := loadAllBoxState(ctx)
+	err := schedule(ctx)
+	if err != nil {
+		log.Fatalkv(ctx, "at", "boot schedule", "error", err)
+	}
+	err = loadAllBoxState(ctx)
 	if err != nil {
 		log.Fatalkv(ctx, "at", "boot loadAllBoxState", "error", err)
 	}
@@ -32,20 +35,21 @@ func notify(l *pq.Listener) {
 		log.Fatalkv(ctx, "at", "boot reportResults", "error", err)
 	}
 
-	for n := range l.Notify {
-		switch n.Channel {
+	for channel := range c {
+		switch channel {
 		case "state_wakeup":
 			// Note that we can get spurious wakeups here,
 			// for example when a new job is inserted but
 			// no new assignments are possible.
-			// In that case, the trigger will fire, be
-			// unable to insert a row, and NOTIFIY on the
-			// channel anyway.
 			// That is not too bad though, because the total
 			// state size is small. It'll just cause us to
 			// reload the state only to find it's the same
 			// as it was.
-			err := loadAllBoxState(ctx)
+			err := schedule(ctx)
+			if err != nil {
+				log.Error(ctx, err, "schedule")
+			}
+			err = loadAllBoxState(ctx)
 			if err != nil {
 				log.Error(ctx, err, "loadAllBoxState")
 			}
@@ -59,13 +63,9 @@ func notify(l *pq.Listener) {
 }
 
 func gcBoxes() {
-	const q = `
-		DELETE FROM box
-		WHERE last_seen_at < now() - '5s'::interval
-	`
 	for {
 		time.Sleep(2 * time.Second)
-		_, err := db.Exec(q)
+		err := store.DeleteStaleBoxes(context.Background(), 5*time.Second)
 		if err != nil {
 			log.Error(context.Background(), err, "gc stale boxes")
 		}
@@ -102,25 +102,14 @@ func getState(id string) testbot.BoxState {
 }
 
 func loadAllBoxState(ctx context.Context) error {
-	const q = `SELECT box, sha, dir, name FROM run`
-	rows, err := db.QueryContext(ctx, q)
+	runs, err := store.Runs(ctx)
 	if err != nil {
 		return fmt.Errorf("querying box state: %w", err)
 	}
 
 	newStates := make(map[string]testbot.BoxState)
-
-	for rows.Next() {
-		var box string
-		var job testbot.Job
-		err = rows.Scan(&box, &job.SHA, &job.Dir, &job.Name)
-		if err != nil {
-			return fmt.Errorf("scanning rows: %w", err)
-		}
-		newStates[box] = testbot.BoxState{ID: box, Job: job}
-	}
-	if rows.Err() != nil {
-		return fmt.Errorf("rows.Err: %w", err)
+	for _, r := range runs {
+		newStates[r.Box] = testbot.BoxState{ID: r.Box, Job: r.Job, Base: r.Base, Attempt: r.Attempt}
 	}
 
 	mu.Lock()
@@ -131,201 +120,125 @@ func loadAllBoxState(ctx context.Context) error {
 }
 
 func reportResults(ctx context.Context) error {
-	q := `
-		SELECT id, sha, dir, name, state, descr
-		FROM result WHERE NOT reported
-	`
-	rows, err := db.QueryContext(ctx, q)
+	results, err := store.UnreportedResults(ctx)
 	if err != nil {
 		return fmt.Errorf("querying unreported results: %w", err)
 	}
-	defer rows.Close()
 
-	var reported []int64
-	for rows.Next() {
-		var id int64
-		var state, desc string
-		var job testbot.Job
-		err = rows.Scan(&id, &job.SHA, &job.Dir, &job.Name, &state, &desc)
-		if err != nil {
-			return fmt.Errorf("scanning: %w", err)
+	var reported []int
+	for _, r := range results {
+		state, desc := r.State, r.Desc
+		switch {
+		case r.Retried:
+			// The job isn't done yet.
+			state = "pending"
+			desc = fmt.Sprintf("retrying (attempt %d of %d failed): %s", r.Attempt, r.Retries+1, r.Desc)
+		case r.Flaky:
+			desc = "passed on retry (flaky)"
+		}
+		url := selfURLf("result/%d", r.ID)
+		if r.Name == testfile {
+			url = r.URL // the line with the syntax error
 		}
-		err := postStatus(ctx, job, state, desc, selfURLf("result/%d", id))
+		err := postStatus(ctx, r.Job(), state, desc, url)
 		if err != nil {
 			log.Error(ctx, err, "postStatus")
 			continue // do not return here, keep going
 		}
-		reported = append(reported, id)
-	}
-	if rows.Err() != nil {
-		return fmt.Errorf("rows.Err: %w", err)
+		reported = append(reported, r.ID)
 	}
 
-	q = `
-		UPDATE result SET reported=true
-		WHERE id = ANY($1::int[])
-	`
-	_, err = db.ExecContext(ctx, q, pq.Array(reported))
+	err = store.MarkReported(ctx, reported)
 	if err != nil {
 		return fmt.Errorf("updating result as reported: %w", err)
 	}
 	return nil
 }
 
-// upsertPR inserts or updates pr record for num
-// to store head as the head commit.
+// errNoRetry is returned by retryResult
+// for a result that can't be retried.
+var errNoRetry = errors.New("a Testfile syntax error can't be retried; push a fix")
+
+// retryResult is like store.RetryResult, but it refuses
+// to retry a Testfile's syntax error (see insertJobs),
+// which isn't the result of a job that could run.
+func retryResult(ctx context.Context, id int) (testbot.Job, error) {
+	r, err := store.Result(ctx, id)
+	if err != nil {
+		return testbot.Job{}, err
+	}
+	if r.Name == testfile {
+		return testbot.Job{}, errNoRetry
+	}
+	return store.RetryResult(ctx, id)
+}
+
+// upsertPR inserts or updates pr record for num in repo
+// to store head as the head commit and branch as
+// the base branch.
 // It returns whether the state was changed,
 // that is, it returns true when a new record
 // was inserted or if the existing record is
 // updated, and false if the existing record
 // already matches the value being stored
 // (and was thus not modified).
-func upsertPR(ctx context.Context, num int, head string) (bool, error) {
-	const cq = `
-		SELECT sha, dir, name FROM job, pr
-		WHERE sha = head AND num = $1 AND head != $2
-	`
-	rows, err := db.QueryContext(ctx, cq, num, head)
-	if err != nil {
-		return false, err
-	}
-	for rows.Next() {
-		var job testbot.Job
-		err = rows.Scan(&job.SHA, &job.Dir, &job.Name)
-		if err != nil {
-			return false, err
-		}
+func upsertPR(ctx context.Context, repo string, num int, head, branch string) (bool, error) {
+	changed, obsolete, err := store.UpsertPR(ctx, repo, num, head, branch)
+	for _, job := range obsolete {
 		go postPendingStatus(ctx, job, "canceled: obsolete commit")
 	}
-	if err := rows.Err(); err != nil {
-		return false, err
-	}
+	return changed, err
+}
 
-	const q = `
-		INSERT INTO pr (num, head) VALUES ($1, $2)
-		ON CONFLICT (num) DO UPDATE SET head=$2
-		WHERE pr.head != $2
-	`
-	res, err := db.ExecContext(ctx, q, num, head)
+// listJobs lists jobs, with those in the queue
+// first, in priority order.
+func listJobs(ctx context.Context) ([]JobInfo, error) {
+	jobs, err := store.ListJobs(ctx)
 	if err != nil {
-		return false, err
+		return nil, err
 	}
-	n, _ := res.RowsAffected()
-	return n > 0, nil
-}
-
-func upsertJobs(ctx context.Context, sha, dir string, names []string) error {
-	const q = `
-		INSERT INTO job (sha, dir, name)
-		VALUES ($1, $2, unnest($3::text[]))
-		ON CONFLICT DO NOTHING
-	`
-	_, err := db.ExecContext(ctx, q, sha, dir, pq.Array(names))
-	return err
-}
-
-type box struct {
-	ID   string
-	Host string
-	Seen time.Time
-}
-
-func listBoxes(ctx context.Context) (b []box, err error) {
-	const q = `SELECT id, host, last_seen_at FROM box ORDER BY id`
-	rows, err := db.QueryContext(ctx, q)
+	runs, err := store.Runs(ctx)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var box box
-		err = rows.Scan(&box.ID, &box.Host, &box.Seen)
-		if err != nil {
-			return nil, err
+	var queued []SchedJob
+	for _, job := range jobs {
+		if job.Queued {
+			queued = append(queued, SchedJob{Job: job.Job, Labels: job.Labels, Expected: job.Expected})
 		}
-		b = append(b, box)
 	}
-	return b, rows.Err()
-}
-
-func listJobs(ctx context.Context) (j []testbot.Job, err error) {
-	rows, err := db.QueryContext(ctx, `SELECT sha, dir, name FROM job`)
-	if err != nil {
-		return nil, err
+	priority := make(map[testbot.Job]int)
+	for i, sj := range queueOrder(scheduler, queued, runs) {
+		priority[sj.Job] = i + 1
 	}
-	defer rows.Close()
-	for rows.Next() {
-		var job testbot.Job
-		err = rows.Scan(&job.SHA, &job.Dir, &job.Name)
-		if err != nil {
-			return nil, err
+	for i := range jobs {
+		jobs[i].Priority = priority[jobs[i].Job]
+		if jobs[i].Expected > time.Second {
+			jobs[i].Expected = jobs[i].Expected.Round(time.Second)
 		}
-		j = append(j, job)
 	}
-	return j, rows.Err()
-}
-
-type resultInfo struct {
-	ID        int
-	SHA       string
-	Dir       string
-	Name      string
-	ElapsedMS int
-	ElapsedSp string // for display
-	Org       string
-	Repo      string
-	PR        []int64
-	State     string
-	Desc      string
-	CreatedAt time.Time
+	sort.SliceStable(jobs, func(a, b int) bool {
+		pa, pb := jobs[a].Priority, jobs[b].Priority
+		return pa != 0 && (pb == 0 || pa < pb)
+	})
+	return jobs, nil
 }
 
-func listResults(ctx context.Context, limit int) ([]resultInfo, error) {
-	const q = `
-		SELECT id, sha, dir, name, elapsed_ms, pr, state, descr, created_at
-		FROM result
-		ORDER BY id DESC
-		LIMIT $1
-	`
-	return scanResults(db.QueryContext(ctx, q, limit))
+func listResults(ctx context.Context, limit int) ([]ResultInfo, error) {
+	res, err := store.ListResults(ctx, limit)
+	return forDisplay(res), err
 }
 
-func jobResults(ctx context.Context, job testbot.Job) ([]resultInfo, error) {
-	const q = `
-		SELECT id, sha, dir, name, elapsed_ms, pr, state, descr, created_at
-		FROM result
-		WHERE sha=$1 AND dir=$2 AND name=$3
-		ORDER BY id DESC
-	`
-	return scanResults(db.QueryContext(ctx, q, job.SHA, job.Dir, job.Name))
+func jobResults(ctx context.Context, job testbot.Job) ([]ResultInfo, error) {
+	res, err := store.JobResults(ctx, job)
+	return forDisplay(res), err
 }
 
-func scanResults(rows *sql.Rows, err error) ([]resultInfo, error) {
-	if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
-	var res []resultInfo
-	for rows.Next() {
-		var result resultInfo
-		err = rows.Scan(
-			&result.ID,
-			&result.SHA,
-			&result.Dir,
-			&result.Name,
-			&result.ElapsedMS,
-			pq.Array(&result.PR),
-			&result.State,
-			&result.Desc,
-			&result.CreatedAt,
-		)
-		if err != nil {
-			return nil, err
-		}
-		result.ElapsedSp = pad(fmt.Sprintf("%v", time.Duration(result.ElapsedMS)*time.Millisecond))
-		result.Org = org
-		result.Repo = repo
-		res = append(res, result)
+// forDisplay fills in the fields of each result
+// used only for display.
+func forDisplay(res []ResultInfo) []ResultInfo {
+	for i := range res {
+		res[i].ElapsedSp = pad(fmt.Sprintf("%v", time.Duration(res[i].ElapsedMS)*time.Millisecond))
 	}
-	return res, rows.Err()
+	return res
 }
@@ -2,28 +2,520 @@ package farmer
 
 import (
 	"context"
+	"fmt"
+	"io/ioutil"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/jbowens/pqtest"
 
 	"github.com/wepogo/testbot"
 )
 
+// testStores runs f once with an empty memStore
+// and once with an empty pgStore as the store.
+func testStores(t *testing.T, f func(t *testing.T)) {
+	t.Run("memory", func(t *testing.T) {
+		store = newMemStore()
+		f(t)
+	})
+	t.Run("postgres", func(t *testing.T) {
+		db := pqtest.Open(t)
+		defer db.Close()
+		must(t, migrateUp(context.Background(), db, ioutil.Discard))
+		store = &pgStore{db: db}
+		f(t)
+	})
+}
+
 func TestSchema(t *testing.T) {
-	db = pqtest.Open(t, pqtest.SchemaFile("schema.sql"))
-	defer db.Close()
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		must(t, store.UpsertJobs(ctx, []testbot.Job{{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "cmd1"}}, nil, nil, nil, nil))
+		must(t, schedule(ctx))
+		checkRuns(t, run{"commit1", "/", "cmd1", "box1"})
 
-	ctx := context.Background()
-	must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
-	_, err := upsertPR(ctx, 1, "commit1")
-	must(t, err)
-	must(t, upsertJobs(ctx, "commit1", "/", []string{"cmd1"}))
-	checkRuns(t, run{"commit1", "/", "cmd1", "box1"})
+		job := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "cmd1"}
+		must(t, markDone(ctx, job, "error", "canceled by operator", "", 0))
+		must(t, schedule(ctx))
+		checkRuns(t) // should be none
+	})
+}
+
+func TestSchemaNeeds(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		build := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "build"}
+		unit := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "unit"}
+		e2e := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/server", Name: "e2e"}
+		needs := map[testbot.Job][]testbot.Job{
+			unit: {build},
+			e2e:  {unit},
+		}
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		must(t, store.UpsertJobs(ctx, []testbot.Job{e2e, unit, build}, needs, nil, nil, nil))
+		must(t, schedule(ctx))
+		checkRuns(t, run{"commit1", "/", "build", "box1"})
+
+		must(t, markDone(ctx, build, "failure", "exit status 1", "", 0))
+		must(t, schedule(ctx))
+		checkRuns(t) // should be none
+
+		results, err := store.ListResults(ctx, 10)
+		must(t, err)
+		var n int
+		for _, r := range results {
+			if r.Desc == "skipped: dependency failed" {
+				n++
+			}
+		}
+		if n != 2 {
+			t.Fatalf("skipped results = %d, want 2", n)
+		}
+	})
+}
+
+func TestSchemaLabels(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		unit := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "unit"}
+		e2e := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "e2e"}
+		gpu := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "gpu"}
+		labels := map[testbot.Job][]string{
+			e2e: {"big-mem"},
+			gpu: {"gpu"},
+		}
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box2", Labels: []string{"big-mem", "linux"}}))
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		must(t, store.UpsertJobs(ctx, []testbot.Job{unit, e2e, gpu}, nil, labels, nil, nil))
+		must(t, schedule(ctx))
+		checkRuns(t,
+			run{"commit1", "/", "unit", "box1"},
+			run{"commit1", "/", "e2e", "box2"},
+		)
+
+		jobs, err := listJobs(ctx)
+		must(t, err)
+		for _, job := range jobs {
+			if want := job.Job == gpu; job.Ineligible != want {
+				t.Errorf("%v ineligible = %v, want %v", job.Job, job.Ineligible, want)
+			}
+		}
+	})
+}
+
+func TestSchemaPriority(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+
+		// History from an earlier commit.
+		_, err := upsertPR(ctx, "org/repo", 1, "commit0", "main")
+		must(t, err)
+		history := []struct {
+			name    string
+			state   string
+			elapsed time.Duration
+		}{
+			{"short", "success", time.Second},
+			{"long", "success", time.Minute},
+			{"long", "failure", 0},
+		}
+		for _, h := range history {
+			job := testbot.Job{Repo: "org/repo", SHA: "commit0", Dir: "/", Name: h.name}
+			must(t, store.UpsertJobs(ctx, []testbot.Job{job}, nil, nil, nil, nil))
+			must(t, markDone(ctx, job, h.state, "", "", h.elapsed))
+		}
+
+		_, err = upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		short := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "short"}
+		long := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "long"}
+		unknown := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/a", Name: "unknown"}
+		must(t, store.UpsertJobs(ctx, []testbot.Job{short, long, unknown}, nil, nil, nil, nil))
+		must(t, schedule(ctx))
+
+		jobs, err := listJobs(ctx)
+		must(t, err)
+		var got []string
+		for _, job := range jobs {
+			got = append(got, fmt.Sprintf("%d %s %v", job.Priority, job.Name, job.Expected))
+		}
+		want := []string{"1 unknown 0s", "2 long 1m0s", "3 short 1s"}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("jobs = %q, want %q", got, want)
+		}
+
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		must(t, schedule(ctx))
+		checkRuns(t, run{"commit1", "/a", "unknown", "box1"})
+		must(t, markDone(ctx, unknown, "success", "", "", time.Second))
+		must(t, schedule(ctx))
+		checkRuns(t, run{"commit1", "/", "long", "box1"})
+	})
+}
+
+func TestSchemaFairShare(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box2"}))
+
+		// A big pull request takes every box.
+		_, err := upsertPR(ctx, "org/repo", 1, "big", "main")
+		must(t, err)
+		var bigJobs []testbot.Job
+		for _, name := range []string{"a", "b", "c", "d"} {
+			bigJobs = append(bigJobs, testbot.Job{Repo: "org/repo", SHA: "big", Dir: "/", Name: name})
+		}
+		must(t, store.UpsertJobs(ctx, bigJobs, nil, nil, nil, nil))
+		must(t, schedule(ctx))
+
+		// A small one arrives, and must wait for a box.
+		_, err = upsertPR(ctx, "org/repo", 2, "small", "main")
+		must(t, err)
+		small := testbot.Job{Repo: "org/repo", SHA: "small", Dir: "/", Name: "x"}
+		must(t, store.UpsertJobs(ctx, []testbot.Job{small}, nil, nil, nil, nil))
+		must(t, schedule(ctx))
+		if n := countRuns(t, "small"); n != 0 {
+			t.Fatalf("small runs = %d, want 0", n)
+		}
+
+		// The next free box goes to the small one,
+		// even though the big one was first.
+		runs, err := store.Runs(ctx)
+		must(t, err)
+		must(t, markDone(ctx, runs[0].Job, "success", "", "", time.Second))
+		must(t, schedule(ctx))
+		if n := countRuns(t, "small"); n != 1 {
+			t.Fatalf("small runs = %d, want 1", n)
+		}
+	})
+}
+
+func TestSchemaRepos(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		// Two repositories with the same pull request
+		// number and the same head (say, a mirror).
+		a := testbot.Job{Repo: "org/a", SHA: "commit1", Dir: "/", Name: "unit"}
+		b := testbot.Job{Repo: "org/b", SHA: "commit1", Dir: "/", Name: "unit"}
+		for _, job := range []testbot.Job{a, b} {
+			_, err := upsertPR(ctx, job.Repo, 1, job.SHA, "main")
+			must(t, err)
+			must(t, store.UpsertJobs(ctx, []testbot.Job{job}, nil, nil, nil, nil))
+		}
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		must(t, schedule(ctx))
+		must(t, markDone(ctx, a, "success", "", "", time.Second))
+
+		if _, ok, err := store.Job(ctx, b); err != nil || !ok {
+			t.Fatalf("job %v not waiting after %v finished (err %v)", b, a, err)
+		}
+		results, err := store.JobResults(ctx, b)
+		must(t, err)
+		if len(results) != 0 {
+			t.Errorf("results for %v = %+v, want none", b, results)
+		}
+
+		must(t, store.DeletePR(ctx, "org/a", 1))
+		prs, err := store.CommitPRs(ctx, "org/b", "commit1")
+		must(t, err)
+		if !reflect.DeepEqual(prs, []int64{1}) {
+			t.Errorf("org/b PRs = %v, want [1]", prs)
+		}
+	})
+}
+
+func TestSchemaPush(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		pushed := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "unit"}
+		added, err := store.AddPush(ctx, "org/repo", "main", "commit1")
+		must(t, err)
+		if !added {
+			t.Fatal("first AddPush = false, want true")
+		}
+		added, err = store.AddPush(ctx, "org/repo", "main", "commit1")
+		must(t, err)
+		if added {
+			t.Fatal("second AddPush = true, want false")
+		}
+		must(t, store.UpsertJobs(ctx, []testbot.Job{pushed}, nil, nil, nil, nil))
 
-	job := testbot.Job{SHA: "commit1", Dir: "/", Name: "cmd1"}
-	must(t, markDone(ctx, job, "error", "canceled by operator", "", 0))
-	checkRuns(t) // should be none
+		// A later push, and a pull request whose head
+		// moves on, leave the pushed commit's job alone.
+		_, err = store.AddPush(ctx, "org/repo", "main", "commit2")
+		must(t, err)
+		_, err = upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		_, err = upsertPR(ctx, "org/repo", 1, "commit3", "main")
+		must(t, err)
+		if _, ok, err := store.Job(ctx, pushed); err != nil || !ok {
+			t.Fatalf("job %v not waiting (err %v)", pushed, err)
+		}
+
+		must(t, markDone(ctx, pushed, "success", "", "", time.Second))
+		results, err := store.JobResults(ctx, pushed)
+		must(t, err)
+		if len(results) != 1 || len(results[0].PR) != 0 {
+			t.Fatalf("results = %+v, want one with no pull requests", results)
+		}
+	})
+}
+
+func TestSchemaMerge(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		_, err = upsertPR(ctx, "org/repo", 2, "commit2", "release")
+		must(t, err)
+		prs, err := store.BranchPRs(ctx, "org/repo", "main")
+		must(t, err)
+		if want := []PR{{Num: 1, Head: "commit1"}}; !reflect.DeepEqual(prs, want) {
+			t.Errorf("BranchPRs(main) = %+v, want %+v", prs, want)
+		}
+		pr, err := store.PR(ctx, "org/repo", 2)
+		must(t, err)
+		if want := (PR{Num: 2, Head: "commit2"}); pr != want {
+			t.Errorf("PR(2) = %+v, want %+v", pr, want)
+		}
+		if _, err := store.PR(ctx, "org/repo", 3); err != ErrNotFound {
+			t.Errorf("PR(3) err = %v, want ErrNotFound", err)
+		}
+
+		unit := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "unit"}
+		e2e := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "e2e"}
+		jobs := []testbot.Job{unit, e2e}
+		bases := map[testbot.Job]string{unit: "base1", e2e: "base1"}
+		must(t, store.UpsertJobs(ctx, jobs, nil, nil, bases, nil))
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		must(t, schedule(ctx))
+		runs, err := store.Runs(ctx)
+		must(t, err)
+		if len(runs) != 1 || runs[0].Base != "base1" {
+			t.Fatalf("runs = %+v, want one with base base1", runs)
+		}
+
+		// The base moves. Only the waiting job gets it.
+		bases = map[testbot.Job]string{unit: "base2", e2e: "base2"}
+		must(t, store.UpsertJobs(ctx, jobs, nil, nil, bases, nil))
+		for _, job := range jobs {
+			info, _, err := store.Job(ctx, job)
+			must(t, err)
+			want := "base2"
+			if job == runs[0].Job {
+				want = "base1"
+			}
+			if info.Base != want {
+				t.Errorf("%v base = %q, want %q", job, info.Base, want)
+			}
+		}
+
+		must(t, markDone(ctx, runs[0].Job, "success", "", "", time.Second))
+		results, err := store.JobResults(ctx, runs[0].Job)
+		must(t, err)
+		if len(results) != 1 || results[0].Base != "base1" {
+			t.Errorf("results = %+v, want one with base base1", results)
+		}
+	})
+}
+
+func TestSchemaQueue(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		_, err = upsertPR(ctx, "org/repo", 2, "commit2", "main")
+		must(t, err)
+		for _, num := range []int{2, 1} {
+			added, err := store.Enqueue(ctx, "org/repo", num)
+			must(t, err)
+			if !added {
+				t.Errorf("Enqueue(%d) = false, want true", num)
+			}
+		}
+		for _, num := range []int{2, 3} {
+			added, err := store.Enqueue(ctx, "org/repo", num)
+			must(t, err)
+			if added {
+				t.Errorf("Enqueue(%d) again or nonexistent = true, want false", num)
+			}
+		}
+		queue, err := store.Queue(ctx)
+		must(t, err)
+		want := []QueuedPR{
+			{PR{2, "commit2"}, "org/repo", "main"},
+			{PR{1, "commit1"}, "org/repo", "main"},
+		}
+		if !reflect.DeepEqual(queue, want) {
+			t.Fatalf("Queue = %+v, want %+v", queue, want)
+		}
+
+		b := Batch{Repo: "org/repo", Branch: "main", Base: "base1", SHA: "merge1", PRs: []PR{{2, "commit2"}}}
+		must(t, store.PutBatch(ctx, b))
+		unit := testbot.Job{Repo: "org/repo", SHA: "merge1", Dir: "/", Name: "unit"}
+		must(t, store.UpsertJobs(ctx, []testbot.Job{unit}, nil, nil, nil, nil))
+		b.Populated = true
+		must(t, store.PutBatch(ctx, b))
+		batches, err := store.Batches(ctx)
+		must(t, err)
+		if !reflect.DeepEqual(batches, []Batch{b}) {
+			t.Fatalf("Batches = %+v, want %+v", batches, []Batch{b})
+		}
+		if done, _, err := batchResults(ctx, b); err != nil || done {
+			t.Errorf("batchResults = %v, %v, want not done", done, err)
+		}
+
+		must(t, markDone(ctx, unit, "failure", "", "", time.Second))
+		done, failed, err := batchResults(ctx, b)
+		must(t, err)
+		if !done || failed == nil || failed.Job() != unit {
+			t.Errorf("batchResults = %v, %+v, want done, failed %v", done, failed, unit)
+		}
+
+		// Deleting the batch deletes its jobs.
+		_, err = store.RetryResult(ctx, failed.ID)
+		must(t, err)
+		must(t, store.DeleteBatch(ctx, "org/repo", "main"))
+		if _, ok, _ := store.Job(ctx, unit); ok {
+			t.Errorf("job %v still exists after DeleteBatch", unit)
+		}
+
+		// Deleting a pull request dequeues it.
+		must(t, store.DeletePR(ctx, "org/repo", 2))
+		must(t, store.Dequeue(ctx, "org/repo", 1))
+		queue, err = store.Queue(ctx)
+		must(t, err)
+		if len(queue) != 0 {
+			t.Errorf("Queue = %+v, want empty", queue)
+		}
+	})
+}
+
+func TestSchemaRetries(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		unit := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "unit"}
+		retries := map[testbot.Job]int{unit: 1}
+		must(t, store.UpsertJobs(ctx, []testbot.Job{unit}, nil, nil, nil, retries))
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		must(t, schedule(ctx))
+		checkRuns(t, run{"commit1", "/", "unit", "box1"})
+
+		// The first failure is retried.
+		must(t, markDone(ctx, unit, "failure", "", "", time.Second))
+		info, ok, err := store.Job(ctx, unit)
+		must(t, err)
+		if !ok || info.Attempt != 2 {
+			t.Fatalf("job = %+v, %v, want attempt 2", info, ok)
+		}
+		must(t, schedule(ctx))
+		runs, err := store.Runs(ctx)
+		must(t, err)
+		if len(runs) != 1 || runs[0].Attempt != 2 {
+			t.Fatalf("runs = %+v, want one attempt 2", runs)
+		}
+
+		must(t, markDone(ctx, unit, "success", "", "", time.Second))
+		if _, ok, _ := store.Job(ctx, unit); ok {
+			t.Fatalf("job %v still exists after success", unit)
+		}
+		results, err := store.JobResults(ctx, unit)
+		must(t, err)
+		if len(results) != 2 {
+			t.Fatalf("results = %+v, want 2", results)
+		}
+		if r := results[1]; r.Attempt != 1 || !r.Retried || r.Flaky {
+			t.Errorf("first result = %+v, want attempt 1, retried", r)
+		}
+		if r := results[0]; r.Attempt != 2 || r.Retried || !r.Flaky {
+			t.Errorf("second result = %+v, want attempt 2, flaky", r)
+		}
+
+		// A retry by hand is the next attempt.
+		_, err = store.RetryResult(ctx, results[1].ID)
+		must(t, err)
+		info, _, err = store.Job(ctx, unit)
+		must(t, err)
+		if info.Attempt != 3 {
+			t.Errorf("attempt after RetryResult = %d, want 3", info.Attempt)
+		}
+
+		// With no retries left, a failure is final.
+		must(t, markDone(ctx, unit, "failure", "", "", time.Second))
+		if _, ok, _ := store.Job(ctx, unit); ok {
+			t.Errorf("job %v still exists after last failure", unit)
+		}
+
+		// A success after a retry by hand isn't flaky,
+		// despite the failures before it.
+		results, err = store.JobResults(ctx, unit)
+		must(t, err)
+		_, err = store.RetryResult(ctx, results[0].ID)
+		must(t, err)
+		must(t, markDone(ctx, unit, "success", "", "", time.Second))
+		results, err = store.JobResults(ctx, unit)
+		must(t, err)
+		if r := results[0]; r.State != "success" || r.Flaky {
+			t.Errorf("result after retry by hand = %+v, want success, not flaky", r)
+		}
+	})
+}
+
+func TestSchemaRetryNeeds(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		build := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "build"}
+		e2e := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "e2e"}
+		needs := map[testbot.Job][]testbot.Job{e2e: {build}}
+		must(t, store.UpsertJobs(ctx, []testbot.Job{build, e2e}, needs, nil, nil, nil))
+		must(t, markDone(ctx, build, "success", "", "", time.Second))
+		must(t, markDone(ctx, e2e, "failure", "", "", time.Second))
+
+		// Retrying both, e2e still waits for build.
+		results, err := store.ListResults(ctx, 10)
+		must(t, err)
+		for _, r := range results {
+			_, err = store.RetryResult(ctx, r.ID)
+			must(t, err)
+		}
+		info, ok, err := store.Job(ctx, e2e)
+		must(t, err)
+		if !ok || info.Queued {
+			t.Fatalf("e2e = %+v, %v after RetryResult, want waiting for build", info, ok)
+		}
+		must(t, markDone(ctx, build, "success", "", "", time.Second))
+		info, _, err = store.Job(ctx, e2e)
+		must(t, err)
+		if !info.Queued {
+			t.Errorf("e2e = %+v after build, want queued", info)
+		}
+	})
+}
+
+func countRuns(t *testing.T, sha string) (n int) {
+	t.Helper()
+	runs, err := store.Runs(context.Background())
+	must(t, err)
+	for _, r := range runs {
+		if r.Job.SHA == sha {
+			n++
+		}
+	}
+	return n
 }
 
 type run struct {
@@ -32,21 +524,12 @@ type run struct {
 }
 
 func checkRuns(t *testing.T, want ...run) {
+	t.Helper()
+	runs, err := store.Runs(context.Background())
+	must(t, err)
 	var got []run
-	rows, err := db.Query("SELECT sha, dir, name, box FROM run")
-	if err != nil {
-		t.Fatal(err)
-	}
-	for rows.Next() {
-		var run run
-		err = rows.Scan(&run.sha, &run.dir, &run.name, &run.box)
-		if err != nil {
-			t.Fatal(err)
-		}
-		got = append(got, run)
-	}
-	if rows.Err() != nil {
-		t.Fatal(err)
+	for _, r := range runs {
+		got = append(got, run{r.Job.SHA, r.Job.Dir, r.Job.Name, r.Box})
 	}
 	if !reflect.DeepEqual(got, want) {
 		t.Fatalf("runs = %+v, want %+v", got, want)
@@ -59,3 +542,48 @@ func must(t *testing.T, err error) {
 		t.Fatal(err)
 	}
 }
+
+func TestSchemaDraining(t *testing.T) {
+	testStores(t, func(t *testing.T) {
+		ctx := context.Background()
+		_, err := upsertPR(ctx, "org/repo", 1, "commit1", "main")
+		must(t, err)
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1", Draining: true}))
+		must(t, store.UpsertJobs(ctx, []testbot.Job{{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "cmd1"}}, nil, nil, nil, nil))
+		must(t, schedule(ctx))
+		checkRuns(t) // a draining box gets no jobs
+
+		job := testbot.Job{Repo: "org/repo", SHA: "commit1", Dir: "/", Name: "cmd1"}
+		n, err := store.InsertRuns(ctx, []Run{{Job: job, Box: "box1"}})
+		must(t, err)
+		if n != 0 {
+			t.Errorf("InsertRuns on draining box = %d, want 0", n)
+		}
+		boxes, err := store.ListBoxes(ctx)
+		must(t, err)
+		if len(boxes) != 1 || !boxes[0].Draining {
+			t.Errorf("boxes = %+v, want box1 draining", boxes)
+		}
+
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1"}))
+		must(t, schedule(ctx))
+		checkRuns(t, run{"commit1", "/", "cmd1", "box1"})
+
+		// A draining box gives back a job it won't run.
+		must(t, boxPing(ctx, testbot.BoxPingReq{ID: "box1", Draining: true}))
+		must(t, store.ReleaseJob(ctx, job, "box2")) // not its box
+		checkRuns(t, run{"commit1", "/", "cmd1", "box1"})
+		must(t, store.ReleaseJob(ctx, job, "box1"))
+		checkRuns(t)
+		info, ok, err := store.Job(ctx, job)
+		must(t, err)
+		if !ok || !info.Queued || info.Attempt != 1 {
+			t.Errorf("job = %+v, %v, want queued as attempt 1", info, ok)
+		}
+		results, err := store.JobResults(ctx, job)
+		must(t, err)
+		if len(results) != 0 {
+			t.Errorf("results = %+v, want none", results)
+		}
+	})
+}
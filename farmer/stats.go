@@ -0,0 +1,266 @@
+package farmer
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/wepogo/testbot"
+	"github.com/wepogo/testbot/log"
+)
+
+// An EntryStats summarizes the results of
+// one Testfile entry over a window of time.
+type EntryStats struct {
+	Repo string
+	Dir  string
+	Name string
+
+	Runs        int     // results, counting each attempt
+	Failures    int     // results with state failure
+	Errors      int     // results with state error
+	FailureRate float64 // Failures / Runs
+
+	Commits   int     // commits with any result
+	Flaky     int     // commits with both a success and a failure
+	FlakeRate float64 // Flaky / Commits
+
+	// TimeToGreenMS is the mean time, in milliseconds,
+	// from a failure on a commit to the next success on
+	// the same commit, over the Recovered times that
+	// happened. It is 0 if none did.
+	TimeToGreenMS int
+	Recovered     int
+}
+
+// Path returns the entry's repository, directory,
+// and name, joined, as used in the flaky page's URL.
+func (s EntryStats) Path() string {
+	return entryPath(s.Repo, s.Dir, s.Name)
+}
+
+func entryPath(repo, dir, name string) string {
+	return path.Join(repo, dir, name)
+}
+
+// entrySorts holds the orders for the flaky page,
+// by the name used to select one in its URL.
+// Each puts the worst entries first.
+var entrySorts = map[string]func(a, b EntryStats) bool{
+	"flake":   func(a, b EntryStats) bool { return a.FlakeRate > b.FlakeRate },
+	"failure": func(a, b EntryStats) bool { return a.FailureRate > b.FailureRate },
+	"green":   func(a, b EntryStats) bool { return a.TimeToGreenMS > b.TimeToGreenMS },
+}
+
+// entryStats summarizes results, which must be oldest
+// first, by entry, in order by repository, directory,
+// and name.
+func entryStats(results []ResultInfo) []EntryStats {
+	type entry struct{ repo, dir, name string }
+	type commitState struct {
+		success, failure bool
+		redSince         time.Time // of the first failure since a success
+	}
+	stats := make(map[entry]*EntryStats)
+	commits := make(map[testbot.Job]*commitState) // by job, one per commit
+	green := make(map[entry]time.Duration)        // total time to green
+	for _, r := range results {
+		k := entry{r.Repo, r.Dir, r.Name}
+		s := stats[k]
+		if s == nil {
+			s = &EntryStats{Repo: r.Repo, Dir: r.Dir, Name: r.Name}
+			stats[k] = s
+		}
+		c := commits[r.Job()]
+		if c == nil {
+			c = new(commitState)
+			commits[r.Job()] = c
+			s.Commits++
+		}
+		s.Runs++
+		switch r.State {
+		case "success":
+			if c.failure && !c.success {
+				s.Flaky++
+			}
+			c.success = true
+			if !c.redSince.IsZero() {
+				green[k] += r.CreatedAt.Sub(c.redSince)
+				s.Recovered++
+				c.redSince = time.Time{}
+			}
+		case "failure":
+			s.Failures++
+			if c.success && !c.failure {
+				s.Flaky++
+			}
+			c.failure = true
+			if c.redSince.IsZero() {
+				c.redSince = r.CreatedAt
+			}
+		case "error":
+			s.Errors++
+		}
+	}
+
+	var a []EntryStats
+	for k, s := range stats {
+		s.FailureRate = float64(s.Failures) / float64(s.Runs)
+		s.FlakeRate = float64(s.Flaky) / float64(s.Commits)
+		if s.Recovered > 0 {
+			s.TimeToGreenMS = int(green[k] / time.Duration(s.Recovered) / time.Millisecond)
+		}
+		a = append(a, *s)
+	}
+	sort.Slice(a, func(i, j int) bool {
+		x, y := a[i], a[j]
+		if x.Repo != y.Repo {
+			return x.Repo < y.Repo
+		}
+		if x.Dir != y.Dir {
+			return x.Dir < y.Dir
+		}
+		return x.Name < y.Name
+	})
+	return a
+}
+
+// parseWindow parses s as a duration,
+// also accepting a number of days, such as 7d.
+func parseWindow(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("bad window %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("bad window %q", s)
+	}
+	return d, nil
+}
+
+// wantJSON returns whether req asks for JSON
+// rather than HTML, with format=json.
+func wantJSON(req *http.Request) bool {
+	return req.URL.Query().Get("format") == "json"
+}
+
+func writeJSON(w http.ResponseWriter, req *http.Request, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Error(req.Context(), err, "encoding json")
+	}
+}
+
+// flaky serves the flakiness dashboard: every entry
+// with results within the window (default 7d),
+// worst first according to sort (default flake;
+// see entrySorts), or, for a path naming an entry,
+// that entry's results.
+func flaky(w http.ResponseWriter, req *http.Request) {
+	q := req.URL.Query()
+	window := or(q.Get("window"), "7d")
+	d, err := parseWindow(window)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	sortName := or(q.Get("sort"), "flake")
+	less, ok := entrySorts[sortName]
+	if !ok {
+		http.Error(w, "unknown sort "+sortName, 400)
+		return
+	}
+	if p := strings.TrimPrefix(req.URL.Path, "/flaky/"); p != req.URL.Path {
+		flakyEntry(w, req, p, window, d)
+		return
+	}
+	results, err := store.RecentResults(req.Context(), d)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+
+	entries := entryStats(results)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return less(entries[i], entries[j])
+	})
+	data := struct {
+		Window  string
+		Sort    string
+		Entries []EntryStats
+	}{window, sortName, entries}
+	if wantJSON(req) {
+		writeJSON(w, req, data)
+		return
+	}
+	w.Header().Set("Content-Language", "en")
+	err = flakyPage.Execute(w, data)
+	if err != nil {
+		log.Error(req.Context(), err, "flaky template")
+	}
+}
+
+// flakyEntry serves the drill-down for the entry
+// named by p, over the window of length d.
+func flakyEntry(w http.ResponseWriter, req *http.Request, p, window string, d time.Duration) {
+	repo, dir, name, err := parseEntryPath(p)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		return
+	}
+	mine, err := store.EntryResults(req.Context(), repo, dir, name, d)
+	if err != nil {
+		http.Error(w, err.Error(), 500)
+		return
+	}
+	data := struct {
+		Window  string
+		Entry   EntryStats
+		Results []ResultInfo // newest first
+	}{Window: window}
+	data.Entry = EntryStats{Repo: repo, Dir: dir, Name: name}
+	if s := entryStats(mine); len(s) > 0 {
+		data.Entry = s[0]
+	}
+	for i := len(mine) - 1; i >= 0; i-- {
+		data.Results = append(data.Results, mine[i])
+	}
+	forDisplay(data.Results)
+	if wantJSON(req) {
+		writeJSON(w, req, data)
+		return
+	}
+	w.Header().Set("Content-Language", "en")
+	err = flakyEntryPage.Execute(w, data)
+	if err != nil {
+		log.Error(req.Context(), err, "flaky entry template")
+	}
+}
+
+// parseEntryPath parses p, of the form
+// owner/name/dir/entry, as returned by
+// entryPath.
+func parseEntryPath(p string) (repo, dir, name string, err error) {
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) < 3 {
+		return "", "", "", errors.New("bad entry path " + p)
+	}
+	repo = parts[0] + "/" + parts[1]
+	if !testbot.OKRepo(repo) {
+		return "", "", "", errors.New("bad repository " + repo)
+	}
+	dir = "/" + strings.Join(parts[2:len(parts)-1], "/")
+	name = parts[len(parts)-1]
+	return repo, dir, name, nil
+}
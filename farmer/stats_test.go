@@ -0,0 +1,72 @@
+package farmer
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEntryStats(t *testing.T) {
+	t0 := time.Now()
+	result := func(sha, name, state string, min int) ResultInfo {
+		return ResultInfo{
+			Repo:      "org/repo",
+			SHA:       sha,
+			Dir:       "/",
+			Name:      name,
+			State:     state,
+			CreatedAt: t0.Add(time.Duration(min) * time.Minute),
+		}
+	}
+	results := []ResultInfo{
+		result("c1", "unit", "failure", 0),
+		result("c1", "unit", "success", 10),
+		result("c2", "unit", "success", 20),
+		result("c3", "unit", "error", 30),
+		result("c1", "lint", "failure", 0),
+		result("c2", "lint", "failure", 10),
+	}
+	got := entryStats(results)
+	if len(got) != 2 {
+		t.Fatalf("entryStats = %+v, want 2 entries", got)
+	}
+	lint, unit := got[0], got[1]
+	if lint.Name != "lint" || lint.Runs != 2 || lint.FailureRate != 1 || lint.Flaky != 0 || lint.TimeToGreenMS != 0 {
+		t.Errorf("lint = %+v, want 2 runs, all failed, none flaky", lint)
+	}
+	if unit.Runs != 4 || unit.Failures != 1 || unit.Errors != 1 || unit.Commits != 3 || unit.Flaky != 1 {
+		t.Errorf("unit = %+v, want 4 runs, 1 failure, 1 error, 3 commits, 1 flaky", unit)
+	}
+	if want := int(10 * time.Minute / time.Millisecond); unit.TimeToGreenMS != want || unit.Recovered != 1 {
+		t.Errorf("unit time to green = %dms over %d, want %dms over 1", unit.TimeToGreenMS, unit.Recovered, want)
+	}
+}
+
+func TestFlakyHandler(t *testing.T) {
+	gpu := setupMem(t)
+	ctx := context.Background()
+	must(t, markDone(ctx, gpu, "failure", "", "", time.Second))
+	_, err := store.RetryResult(ctx, 1)
+	must(t, err)
+	must(t, markDone(ctx, gpu, "success", "", "", time.Second))
+
+	w := do(http.HandlerFunc(flaky), "GET", "/flaky?format=json", "")
+	var page struct{ Entries []EntryStats }
+	must(t, json.Unmarshal(w.Body.Bytes(), &page))
+	if len(page.Entries) != 1 || page.Entries[0].Flaky != 1 || page.Entries[0].Path() != "org/repo/a/gpu" {
+		t.Fatalf("flaky entries = %+v, want one flaky org/repo/a/gpu", page.Entries)
+	}
+
+	w = do(http.HandlerFunc(flaky), "GET", "/flaky/org/repo/a/gpu?window=1d", "")
+	if body := w.Body.String(); !strings.Contains(body, "1 flaky") || !strings.Contains(body, "/result/2") {
+		t.Errorf("entry page = %q, want 1 flaky and a link to result 2", body)
+	}
+
+	w = do(http.HandlerFunc(flaky), "GET", "/flaky?window=never", "")
+	if w.Code != 400 {
+		t.Errorf("bad window status = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,311 @@
+package farmer
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/wepogo/testbot"
+)
+
+// A Store holds the farmer's state: pull requests,
+// pushes, the merge queue, jobs, boxes, runs
+// (assignments of jobs to boxes), and results.
+//
+// Besides storing what it's told, a Store keeps
+// these rules (in Postgres, triggers keep them;
+// see schema.go):
+//
+//   - A job exists only while some pull request in its
+//     repository has its commit as head, or while its
+//     commit is recorded as pushed or is the merge of a
+//     batch. Changing a pull request's head or deleting
+//     it deletes the jobs for its old head, unless that
+//     commit was also pushed.
+//   - Deleting a pull request removes it from the
+//     merge queue.
+//   - Deleting a job or a box deletes its run, if any.
+//   - A job that needs a job whose latest result is not
+//     success, and that isn't waiting or running again,
+//     is finished with state error and description
+//     "skipped: dependency failed".
+//   - Finishing a job records a result, with the pull
+//     requests in its repository that have the job's
+//     commit as head, if any.
+//
+// After any change to jobs, boxes, or runs, a Store
+// sends "state_wakeup" on its Notify channel, and after
+// any new result, it sends "report". Several changes
+// may be coalesced into one notification.
+type Store interface {
+	// UpsertPR records head as the head commit of pull
+	// request num in repo, and branch as its base branch.
+	// It returns whether that changed anything, along with
+	// the jobs for the previous head, which are now obsolete.
+	UpsertPR(ctx context.Context, repo string, num int, head, branch string) (changed bool, obsolete []testbot.Job, err error)
+
+	// DeletePR deletes pull request num in repo.
+	DeletePR(ctx context.Context, repo string, num int) error
+
+	// CommitPRs returns the numbers of the pull requests
+	// in repo whose head is sha.
+	CommitPRs(ctx context.Context, repo, sha string) ([]int64, error)
+
+	// PR returns pull request num in repo.
+	// It returns ErrNotFound if there is no such pull request.
+	PR(ctx context.Context, repo string, num int) (PR, error)
+
+	// BranchPRs returns the pull requests in repo
+	// whose base branch is branch, in order by number.
+	BranchPRs(ctx context.Context, repo, branch string) ([]PR, error)
+
+	// AddPush records that sha was pushed to branch in repo.
+	// It returns false if that was already recorded.
+	// It also forgets pushes from over an hour ago that
+	// have no jobs left.
+	AddPush(ctx context.Context, repo, branch, sha string) (bool, error)
+
+	// Enqueue adds pull request num in repo to the end
+	// of the merge queue. It returns false if it was
+	// already queued, or if there is no such pull request.
+	Enqueue(ctx context.Context, repo string, num int) (bool, error)
+
+	// Dequeue removes pull request num in repo
+	// from the merge queue.
+	Dequeue(ctx context.Context, repo string, num int) error
+
+	// Queue lists the pull requests in the merge queue,
+	// in the order they were added.
+	Queue(ctx context.Context) ([]QueuedPR, error)
+
+	// PutBatch records b as the batch being tested for
+	// its branch, replacing any other.
+	PutBatch(ctx context.Context, b Batch) error
+
+	// DeleteBatch deletes the batch for branch in repo,
+	// if any, along with its jobs.
+	DeleteBatch(ctx context.Context, repo, branch string) error
+
+	// Batches lists the batches being tested,
+	// in order by repository and branch.
+	Batches(ctx context.Context) ([]Batch, error)
+
+	// UpsertJobs inserts jobs and, for each job, the jobs
+	// it needs, the labels a box must have to run it, the
+	// commit to merge it into before running it, if any,
+	// and how many times to retry it after a failure,
+	// atomically, so that no job can be assigned to a box
+	// before its needs are recorded.
+	// For jobs that already exist, it only sets the base,
+	// and only if the job isn't running.
+	UpsertJobs(ctx context.Context, jobs []testbot.Job, needs map[testbot.Job][]testbot.Job, labels map[testbot.Job][]string, bases map[testbot.Job]string, retries map[testbot.Job]int) error
+
+	// Job returns information about job,
+	// and false if it is not waiting or running.
+	// It doesn't set Priority.
+	Job(ctx context.Context, job testbot.Job) (JobInfo, bool, error)
+
+	// ListJobs lists every job waiting or running,
+	// in order by repository, commit, directory, and name.
+	// It doesn't set Priority.
+	ListJobs(ctx context.Context) ([]JobInfo, error)
+
+	// FinishJob deletes job and records its result.
+	// State must be one of error, failure, pending,
+	// or success.
+	// But if state is failure and the job has retries
+	// left, FinishJob records the result as retried,
+	// and leaves the job to run again, unassigned,
+	// as its next attempt. A success on such a retry
+	// is recorded as flaky. (A success after a retry
+	// by hand, with RetryResult, isn't.)
+	FinishJob(ctx context.Context, job testbot.Job, state, desc, url string, elapsed time.Duration) error
+
+	// AddResult records a result for job, as FinishJob
+	// does, but without the job, which needn't exist,
+	// and isn't created. The result is attempt 1.
+	AddResult(ctx context.Context, job testbot.Job, state, desc, url string) error
+
+	// RetryResult makes the job of result id wait to
+	// run again (unless it already is), as its next
+	// attempt, with the needs it had, and returns it.
+	// It returns ErrNotFound if there is no such result.
+	RetryResult(ctx context.Context, id int) (testbot.Job, error)
+
+	// PingBox records that a box is alive,
+	// along with its host, its labels, and
+	// whether it is draining. A draining box
+	// is never assigned a job.
+	PingBox(ctx context.Context, p testbot.BoxPingReq) error
+
+	// DeleteStaleBoxes deletes boxes
+	// not heard from within d.
+	DeleteStaleBoxes(ctx context.Context, d time.Duration) error
+
+	// ListBoxes lists every box, in order by ID.
+	ListBoxes(ctx context.Context) ([]Box, error)
+
+	// SchedState returns the jobs waiting for a box,
+	// the idle boxes that aren't draining, and the runs,
+	// all at one point in time. Jobs are in order by
+	// repository, commit, directory, and name, and boxes
+	// by ID.
+	SchedState(ctx context.Context) ([]SchedJob, []SchedBox, []Run, error)
+
+	// InsertRuns inserts runs, skipping any whose job
+	// or box doesn't exist or is already assigned,
+	// or whose box is draining, and returns how many
+	// it inserted.
+	InsertRuns(ctx context.Context, runs []Run) (int, error)
+
+	// ReleaseJob deletes the run of job on box, if any,
+	// leaving the job to wait for another box, as the
+	// same attempt.
+	ReleaseJob(ctx context.Context, job testbot.Job, box string) error
+
+	// Runs returns the current runs, in order by box.
+	Runs(ctx context.Context) ([]Run, error)
+
+	// Result returns result id.
+	// It returns ErrNotFound if there is no such result.
+	Result(ctx context.Context, id int) (ResultInfo, error)
+
+	// ListResults lists the most recent results,
+	// newest first, up to limit.
+	ListResults(ctx context.Context, limit int) ([]ResultInfo, error)
+
+	// JobResults lists the results for job, newest first.
+	JobResults(ctx context.Context, job testbot.Job) ([]ResultInfo, error)
+
+	// RecentResults lists the results
+	// from within d, oldest first.
+	RecentResults(ctx context.Context, d time.Duration) ([]ResultInfo, error)
+
+	// EntryResults lists the results for the Testfile
+	// entry name in dir in repo, at any commit,
+	// from within d, oldest first.
+	EntryResults(ctx context.Context, repo, dir, name string, d time.Duration) ([]ResultInfo, error)
+
+	// CommitResults lists the results for every job
+	// at commit sha in repo, newest first.
+	CommitResults(ctx context.Context, repo, sha string) ([]ResultInfo, error)
+
+	// UnreportedResults lists the results
+	// not yet marked reported, oldest first.
+	UnreportedResults(ctx context.Context) ([]ResultInfo, error)
+
+	// MarkReported marks results ids as reported.
+	MarkReported(ctx context.Context, ids []int) error
+
+	// OldResults lists up to limit results from before t,
+	// oldest first, that can be deleted: those already
+	// reported, other than the latest result of each job
+	// at a commit still in use: the head of a pull request,
+	// a pushed commit, a merge batch, or a commit with
+	// jobs still waiting or running.
+	OldResults(ctx context.Context, t time.Time, limit int) ([]ResultInfo, error)
+
+	// DeleteResults deletes results ids.
+	DeleteResults(ctx context.Context, ids []int) error
+
+	// Notify returns the channel for notifications
+	// of changes; see above.
+	Notify() <-chan string
+}
+
+// ErrNotFound is returned by Store methods
+// for a nonexistent record.
+var ErrNotFound = errors.New("not found")
+
+// A Box is a worker box.
+type Box struct {
+	ID       string
+	Host     string
+	Seen     time.Time
+	Labels   []string
+	Draining bool // shutting down; gets no new jobs
+}
+
+// A PR is a pull request.
+type PR struct {
+	Num  int
+	Head string
+}
+
+// A QueuedPR is a pull request in the merge queue.
+type QueuedPR struct {
+	PR
+	Repo   string
+	Branch string // base branch
+}
+
+// A Batch is the merge of the first few pull requests
+// queued for a branch into its head, being tested
+// before the branch is fast-forwarded to it.
+type Batch struct {
+	Repo      string
+	Branch    string
+	Base      string // head of Branch merged into
+	SHA       string // the merge
+	PRs       []PR   // merged, in order, with the heads merged
+	Populated bool   // jobs inserted
+}
+
+// A JobInfo is a job waiting or running.
+type JobInfo struct {
+	testbot.Job
+	Labels  []string
+	Base    string // commit to merge into, if any
+	Attempt int    // 1 for the first run
+
+	// Ineligible is true if no current box, other
+	// than those draining, has all the labels the
+	// job needs.
+	Ineligible bool
+
+	// Queued is true if the job is ready to run,
+	// but not running.
+	Queued bool
+
+	// Priority is the job's place in the queue, with 1
+	// running first (see queueOrder). It is 0 for a job
+	// that is running or waiting for a job it needs.
+	Priority int
+
+	Expected time.Duration // 0 if unknown
+}
+
+// A ResultInfo is the result of a finished job.
+type ResultInfo struct {
+	ID        int
+	Repo      string
+	SHA       string
+	Dir       string
+	Name      string
+	Labels    []string
+	Base      string // commit the job was merged into, if any
+	Retries   int    // from the job's Testfile entry
+	Attempt   int    // 1 for the first run
+	Retried   bool   // a failure, after which the job ran again
+	Flaky     bool   // a success after an automatic retry
+	Host      string // of the box that ran the job, if any
+	ElapsedMS int
+	ElapsedSp string // for display
+	PR        []int64
+	State     string
+	Desc      string
+	URL       string
+	CreatedAt time.Time
+}
+
+// Job returns the job that produced r.
+func (r ResultInfo) Job() testbot.Job {
+	return testbot.Job{Repo: r.Repo, SHA: r.SHA, Dir: r.Dir, Name: r.Name}
+}
+
+// EntryPath returns the repository, directory, and
+// name of r's Testfile entry, joined, as used in the
+// URLs of the pages about an entry (see parseEntryPath).
+func (r ResultInfo) EntryPath() string {
+	return entryPath(r.Repo, r.Dir, r.Name)
+}
@@ -10,6 +10,20 @@ import (
 
 var funcMap = template.FuncMap{
 	"reltime": reltime,
+	"join":    strings.Join,
+	"pct":     func(f float64) float64 { return 100 * f },
+	"ms":      msDuration,
+	"live":    liveURL,
+}
+
+// msDuration returns ms milliseconds as a duration,
+// rounded to the second if it is over a second.
+func msDuration(ms int) time.Duration {
+	d := time.Duration(ms) * time.Millisecond
+	if d > time.Second {
+		d = d.Round(time.Second)
+	}
+	return d
 }
 
 var page = template.Must(template.New("page").Funcs(funcMap).Parse(`
@@ -22,20 +36,19 @@ var page = template.Must(template.New("page").Funcs(funcMap).Parse(`
 {{- reltime .CreatedAt | printf "%8s" -}}
 </time> <a href=/result/{{.ID}}>result</a>
 {{- .ElapsedSp}} {{.ElapsedMS}}ms
-{{- if eq .State "success"}} ok {{else}} <b>fail</b> {{end -}}
-{{- $org := .Org }}
+{{- if .Flaky}} <b>flaky</b> {{else if eq .State "success"}} ok {{else if .Retried}} <b>retried</b> {{else}} <b>fail</b> {{end -}}
 {{- $repo := .Repo }}
 {{- range .PR -}}
-<a href=https://github.com/{{$org}}/{{$repo}}/pull/{{.}}>#{{.}}</a> {{end -}}
-{{- printf "%.8s" .SHA}} {{.Dir}} {{.Name -}}
+<a href=https://github.com/{{$repo}}/pull/{{.}}>{{$repo}}#{{.}}</a> {{end -}}
+{{- printf "%.8s" .SHA}} <a href=/history/{{.EntryPath}}>{{.Dir}} {{.Name}}</a>
+{{- if gt .Attempt 1}} (attempt {{.Attempt}}){{end -}}
 {{- if eq .State "success"}}{{else}} <b>{{.Desc}}</b>{{end -}}
 {{- end -}}
 
 {{- define "prlist" -}}
-{{- $org := .Org }}
 {{- $repo := .Repo }}
 {{range .PR -}}
-<a href="https://github.com/{{$org}}/{{$repo}}/pull/{{.}}">https://github.com/{{$org}}/{{$repo}}/pull/{{.}}</a>
+<a href="https://github.com/{{$repo}}/pull/{{.}}">https://github.com/{{$repo}}/pull/{{.}}</a> <a href="/pr/{{$repo}}/{{.}}">all jobs</a>
 {{end}}
 {{- end -}}
 
@@ -58,11 +71,13 @@ pre tag, at the end of the document.
 var homePage = template.Must(template.Must(page.Clone()).Parse(`
 
 {{define "content"}}
-<b>testbot</b> <a href=guide.txt>guide.txt</a>
+<b>testbot</b> <a href=guide.txt>guide.txt</a> <a href=flaky>flaky</a>
 
 <b>boxes</b>
 {{- range .Boxes}}
-{{.}}
+{{.ID}} {{.Host}}
+{{- with .Labels}} labels: {{join . " "}}{{end}}
+{{- if .Draining}} <b>draining</b>{{end}}
 {{- else}}
 {{.ErrBox}}
 {{- end}}
@@ -74,13 +89,31 @@ var homePage = template.Must(template.Must(page.Clone()).Parse(`
 (none)
 {{- end}}
 
-<b>jobs</b>
+<b>jobs</b> (in priority order, with expected time)
 {{- range .Jobs}}
-{{.}}
+{{with .Priority}}{{printf "%3d" .}}{{else}}  -{{end}} {{with .Expected}}{{printf "%8v" .}}{{else}} unknown{{end}} {{.Job}}
+{{- with .Labels}} labels: {{join . " "}}{{end}}
+{{- if gt .Attempt 1}} attempt {{.Attempt}}{{end}}
+{{- if .Ineligible}} (no eligible worker){{end}}
 {{- else}}
 {{.ErrJob}}
 {{- end}}
 
+{{- if .MergeQueue}}
+
+<b>merge queue</b>
+{{- range .Batches}}
+testing {{printf "%.8s" .SHA}} for {{.Repo}} {{.Branch}}:
+{{- $repo := .Repo}}{{range .PRs}} <a href=https://github.com/{{$repo}}/pull/{{.Num}}>#{{.Num}}</a>{{end}}
+{{- if not .Populated}} (finding jobs){{end}}
+{{- end}}
+{{- range .Queue}}
+<a href=https://github.com/{{.Repo}}/pull/{{.Num}}>{{.Repo}}#{{.Num}}</a> into {{.Branch}}
+{{- else}}
+{{with .ErrQueue}}{{.}}{{else}}(none){{end}}
+{{- end}}
+{{- end}}
+
 <b>results</b> (just the last {{len .Results}} of them)
 {{- range .Results}}
 {{template "resultline" .}}
@@ -117,6 +150,104 @@ var livePage = template.Must(template.Must(page.Clone()).Parse(`
 
 `))
 
+var flakyPage = template.Must(template.Must(page.Clone()).Parse(`
+
+{{define "title"}}flaky{{end}}
+
+{{define "content"}}
+<b>flaky</b> (results in the last {{.Window}}, worst {{.Sort}} first)
+{{- $sort := .Sort}}
+window: <a href="?window=1d&sort={{$sort}}">1d</a> <a href="?window=7d&sort={{$sort}}">7d</a> <a href="?window=30d&sort={{$sort}}">30d</a>
+{{- $window := .Window}}
+sort: <a href="?window={{$window}}&sort=flake">flake</a> <a href="?window={{$window}}&sort=failure">failure</a> <a href="?window={{$window}}&sort=green">green</a>
+<a href="?window={{$window}}&sort={{$sort}}&format=json">json</a>
+
+ flake   fail  runs  time to green  entry
+{{- range .Entries}}
+{{printf "%5.1f%%" (pct .FlakeRate)}} {{printf "%5.1f%%" (pct .FailureRate)}} {{printf "%5d" .Runs}} {{with .TimeToGreenMS}}{{printf "%14v" (ms .)}}{{else}}             -{{end}}  <a href="/flaky/{{.Path}}?window={{$window}}">{{.Repo}} {{.Dir}} {{.Name}}</a>
+{{- else}}
+(no results)
+{{- end}}
+{{end}}
+
+`))
+
+var flakyEntryPage = template.Must(template.Must(page.Clone()).Parse(`
+
+{{define "title"}}{{.Entry.Repo}} {{.Entry.Dir}} {{.Entry.Name}}{{end}}
+
+{{define "content"}}
+<b>{{.Entry.Repo}} {{.Entry.Dir}} {{.Entry.Name}}</b> (results in the last {{.Window}})
+{{with .Entry -}}
+{{.Runs}} runs, {{.Failures}} failed, {{.Errors}} errors
+{{.Commits}} commits, {{.Flaky}} flaky
+{{- with .TimeToGreenMS}}, {{ms .}} mean time to green{{end}}
+{{- end}}
+<a href="?window={{.Window}}&format=json">json</a> <a href="/history/{{.Entry.Path}}">history</a> <a href="/flaky?window={{.Window}}">all entries</a>
+
+<b>results</b>
+{{- range .Results}}
+{{template "resultline" .}}
+{{- else}}
+(none)
+{{- end}}
+{{end}}
+
+`))
+
+var historyPage = template.Must(template.Must(page.Clone()).Parse(`
+
+{{define "title"}}{{.Repo}} {{.Dir}} {{.Name}} history{{end}}
+
+{{define "content"}}
+<b>{{.Repo}} {{.Dir}} {{.Name}}</b> (results in the last {{.Window}}, by {{.Bucket}})
+window: <a href="?window=7d">7d</a> <a href="?window=30d">30d</a> <a href="?window=90d">90d</a> <a href="?window=365d">365d</a>
+<a href="?window={{.Window}}&format=json">json</a> <a href="/flaky/{{.Path}}?window={{.Window}}">flakiness</a>
+
+start             runs     ok      p50      p90      max
+{{- range .Buckets}}
+{{.Start.Local.Format "2006-01-02 15:04"}} {{printf "%5d" .Runs}} {{printf "%5.1f%%" (pct .SuccessRate)}}
+{{- if .Successes}} {{printf "%8v" (ms .P50MS)}} {{printf "%8v" (ms .P90MS)}} {{printf "%8v" (ms .MaxMS)}}{{else}}        -        -        -{{end}}
+{{- else}}
+(no results)
+{{- end}}
+
+<b>results</b> (with worker host)
+{{- range .Results}}
+{{template "resultline" .}} {{.Host}}
+{{- end}}
+{{end}}
+
+`))
+
+var prPage = template.Must(template.Must(page.Clone()).Parse(`
+
+{{define "title"}}{{.Repo}}#{{.Num}}{{end}}
+
+{{define "content"}}
+<b>{{.Repo}}#{{.Num}}</b> at {{printf "%.8s" .Head}} <a href="https://github.com/{{.Repo}}/pull/{{.Num}}">github</a> <a href="?format=json">json</a>
+<form method=post action="/pr/{{.Repo}}/{{.Num}}/cancel"><input type=submit value="cancel all"></form>
+<form method=post action="/pr/{{.Repo}}/{{.Num}}/retry-failed"><input type=submit value="retry all failed"></form>
+<form method=post action="/pr/{{.Repo}}/{{.Num}}/rerun"><input type=submit value="re-run everything"></form>
+<b>jobs</b> (with priority)
+{{- range .Jobs}}
+{{with .Priority}}{{printf "%3d" .}}{{else}}  -{{end}} <a href="{{live .Job}}">{{.Dir}} {{.Name}}</a>
+{{- if gt .Attempt 1}} attempt {{.Attempt}}{{end}}
+{{- if .Ineligible}} (no eligible worker){{end}}
+{{- else}}
+(none)
+{{- end}}
+
+<b>results</b> (the latest for each job)
+{{- range .Results}}
+{{template "resultline" .}}
+{{- else}}
+(none)
+{{- end}}
+{{end}}
+
+`))
+
 var resultPage = template.Must(template.Must(page.Clone()).Parse(`
 
 {{define "title"}}{{.Title}}{{end}}
@@ -0,0 +1,135 @@
+package farmer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/wepogo/testbot"
+	"github.com/wepogo/testbot/log"
+)
+
+// A watchIndex maps each watched directory
+// to the directories of the Testfiles that watch it.
+type watchIndex map[string][]string
+
+// watchers returns the directories of all Testfiles
+// that watch any of dirs or any of their ancestors.
+func (x watchIndex) watchers(dirs []string) []string {
+	var a []string
+	for _, dir := range fillParents(dirs) {
+		a = append(a, x[dir]...)
+	}
+	sort.Strings(a)
+	return uniq(a)
+}
+
+// watchDirs considers the directory of each Testfile
+// that watches an ancestor of any changed file
+// to be affected.
+func watchDirs(ctx context.Context, repo, sha string, changed []string) ([]string, error) {
+	x, err := loadWatchIndex(ctx, repo, sha)
+	if err != nil {
+		return nil, fmt.Errorf("loading watch index: %w", err)
+	}
+	var dirs []string
+	for _, file := range changed {
+		dirs = append(dirs, path.Dir(file))
+	}
+	return x.watchers(dirs), nil
+}
+
+var (
+	watchMu    sync.Mutex
+	watchCache = map[string][]string{} // Testfile blob SHA -> watched dirs
+)
+
+// loadWatchIndex builds the reverse index of watch
+// declarations for every Testfile in repo at sha.
+// It fetches only Testfiles it hasn't seen before,
+// remembering the watch declarations of each version
+// of a Testfile by its blob SHA.
+func loadWatchIndex(ctx context.Context, repo, sha string) (watchIndex, error) {
+	var tree struct {
+		Tree []struct {
+			Path string
+			Type string
+			SHA  string
+		}
+		Truncated bool
+	}
+	err := gh.Getf(&tree, "%s/git/trees/%s?recursive=1", repo, sha)
+	if err != nil {
+		return nil, fmt.Errorf("getting tree: %w", err)
+	}
+	if tree.Truncated {
+		log.Printkv(ctx, "at", "watch index", "repo", repo, "sha", sha, "warning", "tree truncated")
+	}
+
+	x := make(watchIndex)
+	for _, ent := range tree.Tree {
+		if ent.Type != "blob" || path.Base(ent.Path) != testfile {
+			continue
+		}
+		watch, err := blobWatch(ctx, repo, sha, "/"+ent.Path, ent.SHA)
+		if err != nil {
+			return nil, fmt.Errorf("getting %s: %w", ent.Path, err)
+		}
+		dir := path.Dir("/" + ent.Path)
+		for _, w := range watch {
+			x[w] = append(x[w], dir)
+		}
+	}
+	return x, nil
+}
+
+// blobWatch returns the watch declarations in the
+// Testfile at name, with the given blob SHA,
+// in repo at commit sha.
+// A Testfile with a syntax error watches nothing;
+// the error gets reported when its own directory
+// is affected.
+func blobWatch(ctx context.Context, repo, sha, name, blob string) ([]string, error) {
+	watchMu.Lock()
+	watch, ok := watchCache[blob]
+	watchMu.Unlock()
+	if ok {
+		return watch, nil
+	}
+
+	var body bytes.Buffer
+	err := gh.Getf(&body, "%s/git/blobs/%s", repo, blob)
+	if err != nil {
+		return nil, err
+	}
+	// Checking for "include" and "watch" first is just
+	// an optimization, since few Testfiles have either.
+	s := body.String()
+	if strings.Contains(s, "include") {
+		// The watch declarations of a Testfile with includes
+		// depend on more than its own blob, so don't cache.
+		tf, err := testbot.ReadTestfile(name, contentsOpen(ctx, repo, sha))
+		if _, ok := err.(testbot.SyntaxError); ok {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		return tf.Watch, nil
+	} else if strings.Contains(s, "watch") {
+		tf, err := testbot.ParseTestfile(&body)
+		if err == nil {
+			watch = tf.Watch
+		} else if _, ok := err.(testbot.SyntaxError); !ok {
+			return nil, err
+		}
+	}
+
+	watchMu.Lock()
+	watchCache[blob] = watch
+	watchMu.Unlock()
+	return watch, nil
+}
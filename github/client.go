@@ -168,6 +168,22 @@ func (c *Client) Putf(req, resp interface{}, format string, arg ...interface{})
 	return err
 }
 
+// Patchf performs a PATCH request to the given URL.
+//
+// It sends the request body according to req's type:
+//   nil         empty
+//   io.Reader   req
+//   url.Values  encode req as form data & set Content-Type
+//   (other)     encode req as JSON      & set Content-Type
+// It treats the response body according to resp's type:
+//   nil        discard
+//   io.Writer  write body to resp
+//   (other)    decode JSON into resp
+func (c *Client) Patchf(req, resp interface{}, format string, arg ...interface{}) error {
+	_, err := c.rpc("PATCH", fmt.Sprintf(format, arg...), req, resp)
+	return err
+}
+
 // Note that rpc closes the response body before returning.
 func (c *Client) rpc(method, u string, req, resp interface{}) (*http.Response, error) {
 	var r io.Reader
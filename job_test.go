@@ -7,9 +7,10 @@ func TestParseJob(t *testing.T) {
 		s string
 		j Job
 	}{
-		{"91ac/meta", Job{"91ac", "/", "meta"}},
-		{"91ac/core/gotest", Job{"91ac", "/core", "gotest"}},
-		{"91ac/cmd/ledgerd/gotest", Job{"91ac", "/cmd/ledgerd", "gotest"}},
+		{"org/repo/91ac/meta", Job{"org/repo", "91ac", "/", "meta"}},
+		{"org/repo/91ac/core/gotest", Job{"org/repo", "91ac", "/core", "gotest"}},
+		{"org/repo/91ac/cmd/ledgerd/gotest", Job{"org/repo", "91ac", "/cmd/ledgerd", "gotest"}},
+		{"my-org/my.repo/91ac/meta", Job{"my-org/my.repo", "91ac", "/", "meta"}},
 	}
 
 	for _, test := range cases {
@@ -25,10 +26,12 @@ func TestParseJob(t *testing.T) {
 
 func TestParseJobBad(t *testing.T) {
 	cases := []string{
-		"91ac",
-		"91ac/",
-		"91ac/meta/",
-		"foo/meta",
+		"org/repo/91ac",
+		"org/repo/91ac/",
+		"org/repo/91ac/meta/",
+		"org/repo/foo/meta",
+		"91ac/meta",
+		"org/../91ac/meta",
 	}
 
 	for _, test := range cases {
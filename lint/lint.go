@@ -0,0 +1,199 @@
+// Package lint checks the Testfiles in a checkout
+// for mistakes, before the farmer sees them.
+package lint
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/wepogo/testbot"
+)
+
+const testfile = "Testfile"
+
+// A Problem is a mistake in a Testfile,
+// or in a file a Testfile includes.
+type Problem struct {
+	File string // absolute path in the repo
+	Line int    // starting at 1, or 0 if not known
+	Msg  string
+}
+
+func (p Problem) String() string {
+	if p.Line > 0 {
+		return fmt.Sprintf("%s:%d: %s", p.File, p.Line, p.Msg)
+	}
+	return p.File + ": " + p.Msg
+}
+
+// Main checks the Testfiles in the checkout in dir,
+// prints any problems to stderr, and exits with
+// status 1 if there were any.
+func Main(dir string) {
+	problems, err := Check(dir)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "testbot lint:", err)
+		os.Exit(1)
+	}
+	for _, p := range problems {
+		// Print paths relative to dir, so editors
+		// and terminals can find the files.
+		p.File = filepath.Join(dir, filepath.FromSlash(p.File[1:]))
+		fmt.Fprintln(os.Stderr, p)
+	}
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+// Check checks every Testfile in the checkout in root.
+// It reports:
+//
+//   - syntax errors, such as duplicate entry names,
+//     with their positions
+//   - entries with an empty command
+//   - needs that refer to a nonexistent Testfile or entry
+//   - watch declarations for nonexistent directories
+//   - files the farmer will never read: files whose
+//     names differ from Testfile only in case, and
+//     files ending in .Testfile that no Testfile includes
+//
+// The problems are sorted by position.
+func Check(root string) ([]Problem, error) {
+	var files, strays []string
+	err := filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fi.IsDir() && fi.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		if fi.IsDir() {
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join("/", filepath.ToSlash(rel))
+		switch base := fi.Name(); {
+		case base == testfile:
+			files = append(files, name)
+		case strings.EqualFold(base, testfile) || strings.HasSuffix(base, "."+testfile):
+			strays = append(strays, name)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	c := &checker{
+		root:     root,
+		tfs:      make(map[string]*testbot.Testfile),
+		included: make(map[string]bool),
+		seen:     make(map[Problem]bool),
+	}
+	for _, name := range files {
+		err := c.read(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+	for _, name := range files {
+		if tf := c.tfs[path.Dir(name)]; tf != nil {
+			c.check(name, tf)
+		}
+	}
+	for _, name := range strays {
+		switch {
+		case c.included[name]:
+		case strings.EqualFold(path.Base(name), testfile):
+			c.add(Problem{File: name, Msg: "unreachable: the farmer only reads files named " + testfile})
+		default:
+			c.add(Problem{File: name, Msg: "unreachable: no Testfile includes this file"})
+		}
+	}
+
+	sort.SliceStable(c.problems, func(i, j int) bool {
+		a, b := c.problems[i], c.problems[j]
+		if a.File != b.File {
+			return a.File < b.File
+		}
+		return a.Line < b.Line
+	})
+	return c.problems, nil
+}
+
+type checker struct {
+	root     string
+	tfs      map[string]*testbot.Testfile // by directory
+	included map[string]bool
+	problems []Problem
+	seen     map[Problem]bool // a file included twice can have the same problem twice
+}
+
+func (c *checker) add(p Problem) {
+	if !c.seen[p] {
+		c.seen[p] = true
+		c.problems = append(c.problems, p)
+	}
+}
+
+// read reads the Testfile name, recording
+// its syntax errors and the files it includes.
+func (c *checker) read(name string) error {
+	open := func(file string) (io.ReadCloser, error) {
+		if file != name {
+			c.included[file] = true
+		}
+		return os.Open(filepath.Join(c.root, filepath.FromSlash(file)))
+	}
+	tf, err := testbot.ReadTestfile(name, open)
+	if serr, ok := err.(testbot.SyntaxError); ok {
+		c.add(Problem{File: serr.File, Line: serr.Line, Msg: serr.Msg})
+	} else if err != nil {
+		return err
+	}
+	// A nil Testfile records that the
+	// directory has a Testfile we couldn't read.
+	c.tfs[path.Dir(name)] = tf
+	return nil
+}
+
+// check checks the Testfile name, whose
+// syntax has already been checked by read.
+func (c *checker) check(name string, tf *testbot.Testfile) {
+	dir := path.Dir(name)
+	for _, e := range tf.Entries {
+		if strings.TrimSpace(e.Command) == "" {
+			c.add(Problem{File: e.File, Line: e.Line, Msg: "entry " + e.Name + " has an empty command"})
+		}
+		for _, job := range e.Needed(testbot.Job{Dir: dir, Name: e.Name}) {
+			if job.Dir == dir {
+				continue // checked by the parser
+			}
+			other, ok := c.tfs[job.Dir]
+			if ok && other == nil {
+				continue // already reported
+			} else if !ok {
+				msg := fmt.Sprintf("%s needs %s/%s, but there is no Testfile in %s", e.Name, job.Dir, job.Name, job.Dir)
+				c.add(Problem{File: e.File, Line: e.Line, Msg: msg})
+			} else if _, ok := other.Entries[job.Name]; !ok && other.Groups[job.Name] == nil {
+				msg := fmt.Sprintf("%s needs unknown entry %s/%s", e.Name, job.Dir, job.Name)
+				c.add(Problem{File: e.File, Line: e.Line, Msg: msg})
+			}
+		}
+	}
+	for _, w := range tf.Watch {
+		fi, err := os.Stat(filepath.Join(c.root, filepath.FromSlash(w)))
+		if err != nil || !fi.IsDir() {
+			c.add(Problem{File: name, Msg: "watch directory " + w + " does not exist"})
+		}
+	}
+}
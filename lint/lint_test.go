@@ -0,0 +1,59 @@
+package lint
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	files := map[string]string{
+		"Testfile":              "build: make\nbuild: make all\n",
+		"lib/shared/Testfile":   "gotest: go test ./...\nrace: go test -race\n\tshards: 2\n",
+		"server/Testfile":       "watch: /lib /nonexistent\nempty:\ne2e: make e2e\n\tneeds: /lib/shared/gotest /lib/shared/race /lib/shared/vet /api/gen\n",
+		"bad/Testfile":          "ok: echo ok\nnot an entry\n",
+		"bad/testfile":          "x: y\n",
+		"inc/Testfile":          "include: /testbot/go.Testfile\n",
+		"testbot/go.Testfile":   "vet: go vet\n\tretries: many\n",
+		"testbot/old.Testfile":  "x: y\n",
+		"docs/no-problem.txt":   "Testfile\n",
+		".git/objects/Testfile": "not an entry\n",
+	}
+	root, err := ioutil.TempDir("", "lint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for name, s := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		err := os.MkdirAll(filepath.Dir(p), 0777)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(p, []byte(s), 0666)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	got, err := Check(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Problem{
+		{"/Testfile", 2, "duplicate entry build (first at line 1)"},
+		{"/bad/Testfile", 2, "bad line: not an entry"},
+		{"/bad/testfile", 0, "unreachable: the farmer only reads files named Testfile"},
+		{"/server/Testfile", 0, "watch directory /nonexistent does not exist"},
+		{"/server/Testfile", 2, "entry empty has an empty command"},
+		{"/server/Testfile", 3, "e2e needs unknown entry /lib/shared/vet"},
+		{"/server/Testfile", 3, "e2e needs /api/gen, but there is no Testfile in /api"},
+		{"/testbot/go.Testfile", 2, "bad retries for vet: \"many\" is not a number"},
+		{"/testbot/old.Testfile", 0, "unreachable: no Testfile includes this file"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Check = %+v, want %+v", got, want)
+	}
+}
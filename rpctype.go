@@ -12,15 +12,34 @@ import (
 type BoxPingReq struct {
 	ID   string
 	Host string
+
+	// Labels describe the box's capabilities.
+	// The farmer assigns the box only jobs whose
+	// Testfile entries require a subset of them.
+	Labels []string
+
+	// Draining is set by a box that is shutting down.
+	// The farmer assigns it no new jobs.
+	Draining bool
 }
 
 type Job struct {
+	Repo string // GitHub owner/name
 	SHA  string
 	Dir  string
 	Name string
 }
 
+// ParseJob parses a job in the form
+// owner/name/sha/dir/name, as in the
+// farmer's live URLs.
 func ParseJob(s string) (j Job, err error) {
+	f := strings.SplitN(s, "/", 3)
+	if len(f) < 3 || !OKRepo(f[0]+"/"+f[1]) {
+		return Job{}, errors.New("bad job: no repo")
+	}
+	j.Repo = f[0] + "/" + f[1]
+	s = f[2]
 	i := strings.IndexByte(s, '/')
 	if i < 0 {
 		return Job{}, errors.New("bad job")
@@ -40,9 +59,40 @@ func ParseJob(s string) (j Job, err error) {
 	return j, nil
 }
 
+// OKRepo returns whether s is a well-formed
+// GitHub repository name, owner/name.
+func OKRepo(s string) bool {
+	f := strings.Split(s, "/")
+	if len(f) != 2 {
+		return false
+	}
+	for _, part := range f {
+		if part == "" || part == "." || part == ".." {
+			return false
+		}
+		for _, c := range part {
+			ok := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.'
+			if !ok {
+				return false
+			}
+		}
+	}
+	return true
+}
+
 type BoxState struct {
 	ID  string
 	Job Job
+
+	// Base, if set, is a commit to merge Job.SHA
+	// into before running the job. Statuses are
+	// still reported for Job.SHA.
+	Base string
+
+	// Attempt counts the runs of Job, from 1.
+	// The farmer runs a failed job again, as its
+	// next attempt, if its Testfile entry allows.
+	Attempt int
 }
 
 type BoxJobUpdateReq struct {
@@ -53,6 +103,15 @@ type BoxJobUpdateReq struct {
 	Elapsed time.Duration
 }
 
+// A BoxReleaseReq gives back a job the farmer
+// assigned to box ID that the box won't run,
+// because it is shutting down, so the farmer
+// can assign the job to another box.
+type BoxReleaseReq struct {
+	ID  string
+	Job Job
+}
+
 type RetryReq struct {
 	ResultID int
 }
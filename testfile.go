@@ -3,33 +3,750 @@ package testbot
 import (
 	"bufio"
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
 )
 
-type SyntaxError string
+// A SyntaxError describes a problem in a Testfile
+// or a file it includes.
+type SyntaxError struct {
+	File string // absolute path in the repo, if known
+	Line int    // line number, starting at 1, if known
+	Msg  string
+}
 
 func (e SyntaxError) Error() string {
-	return string(e)
+	switch {
+	case e.File != "" && e.Line > 0:
+		return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+	case e.File != "":
+		return e.File + ": " + e.Msg
+	case e.Line > 0:
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return e.Msg
+}
+
+// An Entry is one test defined in a Testfile.
+//
+// Name and Command come from the entry line itself.
+// The remaining fields are options, set on indented
+// lines immediately following the entry line:
+//
+//   integration: go test -tags integration ./...
+//     timeout: 10m
+//     env: PGHOST=localhost
+//     retries: 2
+//     allow_failure: true
+//     needs: build /lib/shared/gotest
+//     paths: db/**/*.sql
+//     matrix: NODE=10,12
+//     shards: 4
+type Entry struct {
+	Name    string
+	Command string
+
+	Timeout      time.Duration // zero means the worker's default
+	Env          []string      // each in the form "key=value"
+	Retries      int           // extra attempts after a failure, run by the farmer
+	AllowFailure bool          // report a failure as success
+
+	// Needs lists entries that must pass before this one
+	// can run. Each is either the name of an entry in the
+	// same Testfile or the absolute path of another
+	// Testfile's directory joined with an entry name.
+	Needs []string
+
+	// Paths lists glob patterns for files that affect
+	// this entry. If it is empty, any change affecting
+	// the Testfile affects the entry. See Affected.
+	Paths []string
+
+	// Labels lists labels a worker must advertise
+	// to be eligible to run this entry.
+	Labels []string
+
+	// File and Line tell where the entry is defined.
+	// File is an absolute path in the repo, and is
+	// empty if the Testfile was read by ParseTestfile.
+	File string
+	Line int
+
+	// Matrix holds the matrix variables, in the form
+	// "key=value", for an entry expanded from a matrix.
+	// Each matrix option line gives a variable and a
+	// comma-separated list of values, and the entry
+	// is expanded into one entry for each combination
+	// of values, named by appending the values to the
+	// original name. For example, an entry gotest with
+	//
+	//   matrix: GOFLAGS=-race,
+	//   matrix: NODE=10,12
+	//
+	// becomes gotest_race_10, gotest_race_12,
+	// gotest_none_10, and gotest_none_12.
+	Matrix []string
+
+	// Shard and Shards are set for an entry expanded
+	// from a sharded entry: it is shard number Shard,
+	// counting from 0, of Shards. An entry with the
+	// option shards: N is expanded into N entries,
+	// named as by ShardName, each meant to run its
+	// own part of the original entry's tests.
+	// Shards is 0 for an entry that isn't a shard.
+	Shard  int
+	Shards int
+}
+
+// ShardName returns the name of shard number shard,
+// counting from 0, of the entry name split into
+// shards shards: for example, gotest_shard1of4.
+func ShardName(name string, shard, shards int) string {
+	return fmt.Sprintf("%s_shard%dof%d", name, shard, shards)
+}
+
+// ParseShard parses name as returned by ShardName.
+// It returns ok false if name isn't such a name.
+func ParseShard(name string) (entry string, shard, shards int, ok bool) {
+	i := strings.LastIndex(name, "_shard")
+	if i <= 0 {
+		return "", 0, 0, false
+	}
+	f := strings.SplitN(name[i+len("_shard"):], "of", 2)
+	if len(f) != 2 {
+		return "", 0, 0, false
+	}
+	shard, err1 := strconv.Atoi(f[0])
+	shards, err2 := strconv.Atoi(f[1])
+	if err1 != nil || err2 != nil || shard < 0 || shard >= shards {
+		return "", 0, 0, false
+	}
+	entry = name[:i]
+	if ShardName(entry, shard, shards) != name {
+		return "", 0, 0, false // not canonical, as in shard01of4
+	}
+	return entry, shard, shards, true
+}
+
+// Affected returns whether any of the changed files
+// affects e, in the Testfile in dir.
+// Each changed file is an absolute path in the repo.
+//
+// A relative pattern in e.Paths is relative to dir.
+// Patterns use the syntax of path.Match, plus the
+// segment ** matches zero or more directories.
+func (e Entry) Affected(dir string, changed []string) bool {
+	if len(e.Paths) == 0 {
+		return true
+	}
+	for _, pat := range e.Paths {
+		if !path.IsAbs(pat) {
+			pat = path.Join(dir, pat)
+		}
+		for _, file := range changed {
+			if MatchPath(pat, file) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MatchPath reports whether name matches the
+// slash-separated glob pattern.
+// It is like path.Match, except the pattern segment **
+// matches zero or more whole segments of name.
+// A malformed pattern matches nothing.
+func MatchPath(pattern, name string) bool {
+	return matchSegs(strings.Split(pattern, "/"), strings.Split(name, "/"))
 }
 
-func ParseTestfile(r io.Reader) (entries map[string]string, err error) {
-	m := make(map[string]string)
+func matchSegs(pat, name []string) bool {
+	for len(pat) > 0 {
+		if pat[0] == "**" {
+			for i := 0; i <= len(name); i++ {
+				if matchSegs(pat[1:], name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pat[0], name[0]); !ok {
+			return false
+		}
+		pat, name = pat[1:], name[1:]
+	}
+	return len(name) == 0
+}
+
+// Needed returns the jobs that must pass before
+// job, the job for e, can run.
+func (e Entry) Needed(job Job) []Job {
+	var jobs []Job
+	for _, need := range e.Needs {
+		j := Job{Repo: job.Repo, SHA: job.SHA, Dir: job.Dir, Name: need}
+		if path.IsAbs(need) {
+			j.Dir, j.Name = path.Split(need)
+			j.Dir = path.Clean(j.Dir)
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs
+}
+
+// A Testfile holds the contents of a Testfile.
+type Testfile struct {
+	Entries map[string]Entry
+
+	// Watch lists directories, in addition to the
+	// Testfile's own directory and its descendants,
+	// where any change affects the Testfile.
+	// Each is an absolute path in the repo.
+	// It is set by top-level lines like
+	//
+	//   watch: /lib/shared /proto
+	Watch []string
+
+	// Groups maps the name of each matrix or sharded
+	// entry, as written, to the names of the entries
+	// expanded from it. A need naming such an entry,
+	// in this Testfile or another, means all of them.
+	Groups map[string][]string
+}
+
+// ParseTestfile parses the Testfile in r.
+// It returns a SyntaxError if the Testfile
+// has an include line; use ReadTestfile
+// to parse a Testfile that includes other files.
+func ParseTestfile(r io.Reader) (*Testfile, error) {
+	return parse(r, "", nil)
+}
+
+// An OpenFunc opens the file at name,
+// an absolute path in the repo.
+// If there is no such file, the error
+// must satisfy errors.Is(err, os.ErrNotExist).
+type OpenFunc func(name string) (io.ReadCloser, error)
+
+// ReadTestfile reads and parses the Testfile at name,
+// an absolute path in the repo, using open to read it
+// and any files it includes.
+//
+// If the Testfile itself doesn't exist, ReadTestfile
+// returns the error from open. A missing included file
+// or an include cycle is a SyntaxError.
+func ReadTestfile(name string, open OpenFunc) (*Testfile, error) {
+	f, err := open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	name = path.Clean(name)
+	return parse(f, name, &includer{open: open, stack: []string{name}})
+}
+
+// An includer reads included files
+// on behalf of the parser.
+type includer struct {
+	open  OpenFunc
+	stack []string // files being parsed, outermost first
+}
+
+type parser struct {
+	tf   *Testfile
+	inc  *includer
+	vars map[string]string
+	cur  *Entry
+	opts bool // whether an option line can follow, for cur (so cur != nil)
+	file string
+	line int
+
+	axes   []axis              // matrix of cur
+	shards int                 // shards of cur, if more than 1
+	groups map[string][]string // matrix or sharded entry name -> expanded names
+}
+
+// An axis is one variable of a matrix.
+type axis struct {
+	key    string
+	values []string
+}
+
+func parse(r io.Reader, file string, inc *includer) (*Testfile, error) {
+	p := &parser{
+		tf:     &Testfile{Entries: make(map[string]Entry)},
+		inc:    inc,
+		file:   file,
+		vars:   make(map[string]string),
+		groups: make(map[string][]string),
+	}
+	err := p.parse(r)
+	if err != nil {
+		return nil, err
+	}
+	expandNeeds(p.tf.Entries, p.groups)
+	p.tf.Groups = p.groups
+	if err := checkNeeds(p.tf.Entries); err != nil {
+		return nil, err
+	}
+	return p.tf, nil
+}
+
+func (p *parser) parse(r io.Reader) error {
 	sc := bufio.NewScanner(r)
 	for sc.Scan() {
+		p.line++
 		l := bytes.TrimSpace(sc.Bytes())
-		if len(l) == 0 || l[0] == '#' {
+		if len(l) == 0 {
+			p.opts = false // a blank line ends cur's options
 			continue
 		}
-		if i := bytes.IndexByte(l, ':'); i >= 0 && okName(l[:i]) {
-			m[string(l[:i])] = string(bytes.TrimSpace(l[i+1:]))
-		} else {
-			return nil, SyntaxError("bad line: " + sc.Text())
+		if l[0] == '#' {
+			continue
+		}
+		i := bytes.IndexByte(l, ':')
+		if i < 0 || !okName(l[:i]) {
+			return p.errorf("bad line: %s", sc.Text())
+		}
+		key, val := string(l[:i]), expand(string(bytes.TrimSpace(l[i+1:])), p.vars)
+		if isIndented(sc.Bytes()) && isOption(key) && p.opts {
+			var err error
+			switch key {
+			case "matrix":
+				err = p.addAxis(val)
+			case "shards":
+				p.shards, err = atoi(val)
+				if err == nil && p.shards <= 0 {
+					err = errors.New("shards must be positive")
+				}
+			default:
+				err = setOption(p.cur, key, val)
+			}
+			if err != nil {
+				return p.errorf("bad %s for %s: %v", key, p.cur.Name, err)
+			}
+			continue
+		}
+		if err := p.flush(); err != nil {
+			return err
+		}
+		switch key {
+		case "watch":
+			for _, dir := range strings.Fields(val) {
+				if !path.IsAbs(dir) {
+					return p.errorf("watch directory must be absolute: %s", dir)
+				}
+				p.tf.Watch = append(p.tf.Watch, path.Clean(dir))
+			}
+		case "var":
+			i := strings.IndexByte(val, '=')
+			if i < 0 || !okName([]byte(strings.TrimSpace(val[:i]))) {
+				return p.errorf("var must be name=value: %s", sc.Text())
+			}
+			p.vars[strings.TrimSpace(val[:i])] = strings.TrimSpace(val[i+1:])
+		case "include":
+			err := p.include(val)
+			if err != nil {
+				return err
+			}
+		default:
+			p.cur = &Entry{Name: key, Command: val, File: p.file, Line: p.line}
+			p.opts = true
 		}
 	}
 	if err := sc.Err(); err != nil {
-		return nil, err
+		return err
+	}
+	return p.flush()
+}
+
+// flush records the current entry, if any,
+// expanding its matrix, then its shards.
+func (p *parser) flush() error {
+	if p.cur == nil {
+		return nil
+	}
+	e := *p.cur
+	axes, shards := p.axes, p.shards
+	p.cur, p.opts, p.axes, p.shards = nil, false, nil, 0
+	if err := p.checkDup(e); err != nil {
+		return err
+	}
+	if len(axes) == 0 && shards <= 1 {
+		if err := checkShardName(e); err != nil {
+			return err
+		}
+		p.add(e)
+		return nil
+	}
+
+	expanded := []Entry{e}
+	for _, ax := range axes {
+		var next []Entry
+		for _, x := range expanded {
+			for _, v := range ax.values {
+				y := x
+				y.Name += "_" + matrixSuffix(v)
+				y.Matrix = append(x.Matrix[:len(x.Matrix):len(x.Matrix)], ax.key+"="+v)
+				next = append(next, y)
+			}
+		}
+		expanded = next
+	}
+	if shards > 1 {
+		var next []Entry
+		for _, x := range expanded {
+			for i := 0; i < shards; i++ {
+				y := x
+				y.Name = ShardName(x.Name, i, shards)
+				y.Shard, y.Shards = i, shards
+				next = append(next, y)
+				if x.Name != e.Name {
+					// Needs can name one value of the matrix.
+					p.groups[x.Name] = append(p.groups[x.Name], y.Name)
+				}
+			}
+		}
+		expanded = next
+	}
+	seen := make(map[string]bool)
+	for _, x := range expanded {
+		if seen[x.Name] {
+			return SyntaxError{File: e.File, Line: e.Line, Msg: "matrix of " + e.Name + " has duplicate name " + x.Name}
+		}
+		seen[x.Name] = true
+		if err := checkShardName(x); err != nil {
+			return err
+		}
+		if err := p.checkDup(x); err != nil {
+			return err
+		}
+	}
+	p.groups[e.Name] = nil
+	for _, x := range expanded {
+		p.add(x)
+		p.groups[e.Name] = append(p.groups[e.Name], x.Name)
+	}
+	return nil
+}
+
+// checkShardName returns an error if e isn't a shard
+// but its name looks like one, as returned by ShardName,
+// since testbot would report it as part of a sharded entry.
+func checkShardName(e Entry) error {
+	if _, _, _, ok := ParseShard(e.Name); ok && e.Shards == 0 {
+		return SyntaxError{File: e.File, Line: e.Line, Msg: "name " + e.Name + " is reserved for shards"}
+	}
+	return nil
+}
+
+// checkDup returns an error if an entry named like e,
+// or a matrix or sharded entry with e's name,
+// is already in the Testfile, perhaps from another file.
+func (p *parser) checkDup(e Entry) error {
+	prev, ok := p.tf.Entries[e.Name]
+	if g := p.groups[e.Name]; !ok && len(g) > 0 {
+		prev, ok = p.tf.Entries[g[0]], true
+	}
+	if !ok {
+		return nil
+	}
+	where := fmt.Sprintf("line %d", prev.Line)
+	if prev.File != e.File {
+		where = fmt.Sprintf("%s:%d", prev.File, prev.Line)
+	}
+	return SyntaxError{File: e.File, Line: e.Line, Msg: fmt.Sprintf("duplicate entry %s (first at %s)", e.Name, where)}
+}
+
+// add adds e, which checkDup has accepted,
+// to the Testfile.
+func (p *parser) add(e Entry) {
+	p.tf.Entries[e.Name] = e
+}
+
+func (p *parser) errorf(format string, arg ...interface{}) error {
+	return SyntaxError{File: p.file, Line: p.line, Msg: fmt.Sprintf(format, arg...)}
+}
+
+func (p *parser) addAxis(val string) error {
+	i := strings.IndexByte(val, '=')
+	if i < 0 || !okName([]byte(val[:i])) {
+		return errors.New("matrix must be key=value,value,...")
+	}
+	ax := axis{key: val[:i], values: strings.Split(val[i+1:], ",")}
+	for i, v := range ax.values {
+		ax.values[i] = strings.TrimSpace(v)
+	}
+	p.axes = append(p.axes, ax)
+	return nil
+}
+
+// matrixSuffix returns a string usable in an entry name
+// to stand for the matrix value v.
+func matrixSuffix(v string) string {
+	b := []byte(v)
+	for i, c := range b {
+		if !okName([]byte{c}) {
+			b[i] = '_'
+		}
+	}
+	s := strings.Trim(string(b), "_")
+	if s == "" {
+		return "none"
+	}
+	return s
+}
+
+// expandNeeds replaces each need naming a matrix or
+// sharded entry in the same Testfile with the names
+// of all entries expanded from it.
+func expandNeeds(m map[string]Entry, groups map[string][]string) {
+	if len(groups) == 0 {
+		return
+	}
+	for name, e := range m {
+		var needs []string
+		for _, need := range e.Needs {
+			if a, ok := groups[need]; ok {
+				needs = append(needs, a...)
+			} else {
+				needs = append(needs, need)
+			}
+		}
+		e.Needs = needs
+		m[name] = e
+	}
+}
+
+// include parses the file at name, relative
+// to the repo root, as if its contents appeared
+// in place of the include line.
+// The included file sees a copy of the variables
+// defined so far; its own definitions don't
+// affect the including file.
+func (p *parser) include(name string) error {
+	if p.inc == nil {
+		return p.errorf("cannot include %s here", name)
+	}
+	name = path.Join("/", name)
+	for _, s := range p.inc.stack {
+		if s == name {
+			return p.errorf("include cycle: %s", strings.Join(append(p.inc.stack, name), " -> "))
+		}
+	}
+	f, err := p.inc.open(name)
+	if errors.Is(err, os.ErrNotExist) {
+		return p.errorf("include %s: no such file", name)
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	vars := make(map[string]string)
+	for k, v := range p.vars {
+		vars[k] = v
+	}
+	sub := &parser{
+		tf:     p.tf,
+		inc:    &includer{open: p.inc.open, stack: append(p.inc.stack[:len(p.inc.stack):len(p.inc.stack)], name)},
+		vars:   vars,
+		groups: p.groups,
+		file:   name,
+	}
+	return sub.parse(f)
+}
+
+// expand replaces each {{name}} in s with the value
+// of the variable name, if it is defined.
+// Anything else, including {{name}} for an undefined
+// name, is left alone, since a shell command might
+// contain such text for other reasons.
+func expand(s string, vars map[string]string) string {
+	if len(vars) == 0 {
+		return s
+	}
+	var b strings.Builder
+	for {
+		i := strings.Index(s, "{{")
+		if i < 0 {
+			break
+		}
+		j := strings.Index(s[i+2:], "}}")
+		if j < 0 {
+			break
+		}
+		name := s[i+2 : i+2+j]
+		v, ok := vars[name]
+		if !ok {
+			b.WriteString(s[:i+2])
+			s = s[i+2:]
+			continue
+		}
+		b.WriteString(s[:i])
+		b.WriteString(v)
+		s = s[i+2+j+2:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// checkNeeds checks that every need within the
+// same Testfile names an entry in m, and that
+// they form no cycles.
+func checkNeeds(m map[string]Entry) error {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make(map[string]int)
+	var visit func(name string) error
+	visit = func(name string) error {
+		switch state[name] {
+		case visiting:
+			e := m[name]
+			return SyntaxError{File: e.File, Line: e.Line, Msg: "dependency cycle through " + name}
+		case visited:
+			return nil
+		}
+		state[name] = visiting
+		for _, need := range m[name].Needs {
+			if path.IsAbs(need) {
+				continue
+			}
+			if _, ok := m[need]; !ok {
+				e := m[name]
+				return SyntaxError{File: e.File, Line: e.Line, Msg: name + " needs unknown entry " + need}
+			}
+			if err := visit(need); err != nil {
+				return err
+			}
+		}
+		state[name] = visited
+		return nil
+	}
+	for name := range m {
+		if err := visit(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isIndented(line []byte) bool {
+	return len(line) > 0 && (line[0] == ' ' || line[0] == '\t')
+}
+
+// isOption returns whether key is the name of an entry
+// option, such as timeout. An indented line with such
+// a key sets that option of the entry it directly
+// follows (with no blank line between, apart from other
+// options and comments). Any other line is an entry,
+// even an indented one named like an option, as it
+// was before options existed.
+func isOption(key string) bool {
+	switch key {
+	case "timeout", "env", "retries", "allow_failure", "needs", "paths", "labels", "matrix", "shards":
+		return true
+	}
+	return false
+}
+
+func setOption(e *Entry, key, val string) error {
+	var err error
+	switch key {
+	case "timeout":
+		e.Timeout, err = time.ParseDuration(val)
+		if err != nil {
+			err = fmt.Errorf("%q is not a duration, such as 90s or 10m", val)
+		} else if e.Timeout <= 0 {
+			err = errors.New("timeout must be positive")
+		}
+	case "env":
+		if i := strings.IndexByte(val, '='); i <= 0 {
+			err = errors.New("env must be key=value")
+		}
+		e.Env = append(e.Env, val)
+	case "retries":
+		e.Retries, err = atoi(val)
+		if err == nil && e.Retries < 0 {
+			err = errors.New("retries must not be negative")
+		}
+	case "allow_failure":
+		e.AllowFailure, err = strconv.ParseBool(val)
+		if err != nil {
+			err = fmt.Errorf("%q is not true or false", val)
+		}
+	case "needs":
+		for _, need := range strings.Fields(val) {
+			if !okNeed(need) {
+				err = errors.New("bad entry reference " + need)
+			}
+			e.Needs = append(e.Needs, need)
+		}
+	case "paths":
+		for _, pat := range strings.Fields(val) {
+			if !okPattern(pat) {
+				err = errors.New("bad pattern " + pat)
+			}
+			e.Paths = append(e.Paths, pat)
+		}
+	case "labels":
+		for _, label := range strings.Fields(val) {
+			if !OKLabel(label) {
+				err = errors.New("bad label " + label)
+			}
+			e.Labels = append(e.Labels, label)
+		}
+	}
+	return err
+}
+
+// atoi is like strconv.Atoi,
+// but its error is fit for a Testfile author.
+func atoi(s string) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not a number", s)
+	}
+	return n, nil
+}
+
+// OKLabel returns whether s is a valid worker label:
+// letters, digits, and the punctuation _ . and -.
+func OKLabel(s string) bool {
+	for _, c := range s {
+		if '0' <= c && c <= '9' || 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || c == '_' || c == '.' || c == '-' {
+			continue
+		}
+		return false
+	}
+	return len(s) > 0
+}
+
+// okNeed returns whether s is an entry name,
+// optionally preceded by an absolute directory.
+func okNeed(s string) bool {
+	dir, name := path.Split(s)
+	return (dir == "" || path.IsAbs(dir)) && okName([]byte(name))
+}
+
+func okPattern(pat string) bool {
+	for _, seg := range strings.Split(pat, "/") {
+		if _, err := path.Match(seg, ""); err != nil {
+			return false
+		}
 	}
-	return m, nil
+	return true
 }
 
 func okName(name []byte) bool {
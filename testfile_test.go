@@ -1,9 +1,15 @@
 package testbot
 
 import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
 	"reflect"
 	"strings"
 	"testing"
+	"time"
 )
 
 const sampleTestfile = `
@@ -13,19 +19,475 @@ gocompile: go install chain/... # this is an end-of-line comment
 `
 
 func TestParseCommands(t *testing.T) {
-	want := map[string]string{
-		"gotest":    "go test ./...",
-		"gocompile": "go install chain/... # this is an end-of-line comment",
+	want := map[string]Entry{
+		"gotest":    {Name: "gotest", Command: "go test ./...", Line: 3},
+		"gocompile": {Name: "gocompile", Command: "go install chain/... # this is an end-of-line comment", Line: 4},
 	}
-	got, err := ParseTestfile(strings.NewReader(sampleTestfile))
+	tf, err := ParseTestfile(strings.NewReader(sampleTestfile))
 	if err != nil {
 		t.Fatal(err)
 	}
-	if !reflect.DeepEqual(got, want) {
+	if got := tf.Entries; !reflect.DeepEqual(got, want) {
 		t.Errorf("ParseTestfile(%#q) = %v, want %v", sampleTestfile, got, want)
 	}
 }
 
+const optionsTestfile = `
+lint: golint ./...
+integration: go test -tags integration ./...
+	# options apply to the entry above
+	timeout: 10m
+	env: PGHOST=localhost
+	env: GOFLAGS=-race -count=1
+	retries: 2
+	allow_failure: true
+	labels: big-mem linux
+  indented: echo still an entry
+`
+
+func TestParseOptions(t *testing.T) {
+	want := map[string]Entry{
+		"lint": {Name: "lint", Command: "golint ./...", Line: 2},
+		"integration": {
+			Name:         "integration",
+			Command:      "go test -tags integration ./...",
+			Timeout:      10 * time.Minute,
+			Env:          []string{"PGHOST=localhost", "GOFLAGS=-race -count=1"},
+			Retries:      2,
+			AllowFailure: true,
+			Labels:       []string{"big-mem", "linux"},
+			Line:         3,
+		},
+		"indented": {Name: "indented", Command: "echo still an entry", Line: 11},
+	}
+	tf, err := ParseTestfile(strings.NewReader(optionsTestfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := tf.Entries; !reflect.DeepEqual(got, want) {
+		t.Errorf("ParseTestfile(%#q) = %+v, want %+v", optionsTestfile, got, want)
+	}
+}
+
+func TestParseOptionsBad(t *testing.T) {
+	cases := []string{
+		"a: b\n  timeout: forever\n",
+		"a: b\n  timeout: -1s\n",
+		"a: b\n  env: NOEQUALS\n",
+		"a: b\n  env: =x\n",
+		"a: b\n  retries: two\n",
+		"a: b\n  retries: -1\n",
+		"a: b\n  allow_failure: maybe\n",
+		"a: b\n  labels: linux/amd64\n",
+		"a: b\n  shards: 0\n",
+		"a: b\n  shards: many\n",
+	}
+
+	for _, test := range cases {
+		_, err := ParseTestfile(strings.NewReader(test))
+		if _, ok := err.(SyntaxError); !ok {
+			t.Errorf("ParseTestfile(%q) err = %v, want SyntaxError", test, err)
+		}
+	}
+}
+
+// Indented lines named like options, but not directly
+// after an entry, are entries, as they were before
+// options existed.
+func TestParseOptionNamedEntries(t *testing.T) {
+	for _, test := range []struct {
+		in   string
+		want map[string]Entry
+	}{{
+		in: "  env: ./check-env.sh\n",
+		want: map[string]Entry{
+			"env": {Name: "env", Command: "./check-env.sh", Line: 1},
+		},
+	}, {
+		in: "a: b\n\n\tenv: ./check-env.sh\n\ttimeout: 5m\n",
+		want: map[string]Entry{
+			"a":   {Name: "a", Command: "b", Line: 1},
+			"env": {Name: "env", Command: "./check-env.sh", Line: 3, Timeout: 5 * time.Minute},
+		},
+	}, {
+		in: "a: b\nwatch: /lib\n  timeout: 1s\n",
+		want: map[string]Entry{
+			"a":       {Name: "a", Command: "b", Line: 1},
+			"timeout": {Name: "timeout", Command: "1s", Line: 3},
+		},
+	}} {
+		tf, err := ParseTestfile(strings.NewReader(test.in))
+		if err != nil {
+			t.Errorf("ParseTestfile(%q) err = %v", test.in, err)
+			continue
+		}
+		if got := tf.Entries; !reflect.DeepEqual(got, test.want) {
+			t.Errorf("ParseTestfile(%q) = %+v, want %+v", test.in, got, test.want)
+		}
+	}
+}
+
+const needsTestfile = `
+build: make
+unit: make test
+	needs: build
+e2e: make e2e
+	needs: unit build /lib/shared/gotest
+`
+
+func TestParseNeeds(t *testing.T) {
+	tf, err := ParseTestfile(strings.NewReader(needsTestfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := tf.Entries["e2e"].Needed(Job{"org/repo", "91ac", "/server", "e2e"})
+	want := []Job{
+		{"org/repo", "91ac", "/server", "unit"},
+		{"org/repo", "91ac", "/server", "build"},
+		{"org/repo", "91ac", "/lib/shared", "gotest"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Needed = %+v, want %+v", got, want)
+	}
+}
+
+func TestParseNeedsBad(t *testing.T) {
+	cases := []string{
+		"a: b\n  needs: c\n",
+		"a: b\n  needs: a\n",
+		"a: b\n  needs: c\nc: d\n  needs: a\n",
+		"a: b\n  needs: lib/c\n",
+		"a: b\n  needs: /lib/\n",
+		"a: b\n  needs: /lib/c.d\n",
+		"a: b\n  paths: db/[\n",
+		"watch: lib\n",
+	}
+
+	for _, test := range cases {
+		_, err := ParseTestfile(strings.NewReader(test))
+		if _, ok := err.(SyntaxError); !ok {
+			t.Errorf("ParseTestfile(%q) err = %v, want SyntaxError", test, err)
+		}
+	}
+}
+
+func TestParseWatch(t *testing.T) {
+	const s = "watch: /lib/shared /proto/\ntest: go test\nwatch: /\n"
+	tf, err := ParseTestfile(strings.NewReader(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"/lib/shared", "/proto", "/"}
+	if !reflect.DeepEqual(tf.Watch, want) {
+		t.Errorf("Watch = %q, want %q", tf.Watch, want)
+	}
+	if len(tf.Entries) != 1 {
+		t.Errorf("len(Entries) = %d, want 1", len(tf.Entries))
+	}
+}
+
+// mapOpen returns an OpenFunc that reads files from m.
+func mapOpen(m map[string]string) OpenFunc {
+	return func(name string) (io.ReadCloser, error) {
+		s, ok := m[name]
+		if !ok {
+			return nil, fmt.Errorf("open %s: %w", name, os.ErrNotExist)
+		}
+		return ioutil.NopCloser(strings.NewReader(s)), nil
+	}
+}
+
+func TestReadTestfileInclude(t *testing.T) {
+	files := map[string]string{
+		"/server/Testfile": `
+var: PKG=./server/...
+var: PKG=./lib/...
+include: testbot/go.Testfile
+extra: echo {{PKG}} {{UNDEFINED}} '{{.Dir}}'
+`,
+		"/testbot/go.Testfile": `
+var: FLAGS=-race -cover
+vet: go vet {{PKG}}
+gotest: go test {{FLAGS}} {{PKG}}
+	needs: vet
+`,
+	}
+	tf, err := ReadTestfile("/server/Testfile", mapOpen(files))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]Entry{
+		"vet": {
+			Name:    "vet",
+			Command: "go vet ./lib/...",
+			File:    "/testbot/go.Testfile",
+			Line:    3,
+		},
+		"gotest": {
+			Name:    "gotest",
+			Command: "go test -race -cover ./lib/...",
+			Needs:   []string{"vet"},
+			File:    "/testbot/go.Testfile",
+			Line:    4,
+		},
+		"extra": {
+			Name:    "extra",
+			Command: "echo ./lib/... {{UNDEFINED}} '{{.Dir}}'",
+			File:    "/server/Testfile",
+			Line:    5,
+		},
+	}
+	if !reflect.DeepEqual(tf.Entries, want) {
+		t.Errorf("Entries = %+v, want %+v", tf.Entries, want)
+	}
+}
+
+func TestReadTestfileIncludeBad(t *testing.T) {
+	files := map[string]string{
+		"/missing":  "include: /nonexistent\n",
+		"/cycle1":   "include: /cycle2\n",
+		"/cycle2":   "a: b\ninclude: /cycle1\n",
+		"/self":     "include: /self\n",
+		"/badvar":   "var: a b\n",
+		"/badinner": "include: /badvar\n",
+	}
+	for name := range files {
+		_, err := ReadTestfile(name, mapOpen(files))
+		if _, ok := err.(SyntaxError); !ok {
+			t.Errorf("ReadTestfile(%q) err = %v, want SyntaxError", name, err)
+		}
+	}
+
+	_, err := ReadTestfile("/nonexistent", mapOpen(files))
+	if !os.IsNotExist(errors.Unwrap(err)) {
+		t.Errorf("ReadTestfile(%q) err = %v, want not exist", "/nonexistent", err)
+	}
+
+	_, err = ParseTestfile(strings.NewReader(files["/self"]))
+	if _, ok := err.(SyntaxError); !ok {
+		t.Errorf("ParseTestfile with include err = %v, want SyntaxError", err)
+	}
+}
+
+func TestSyntaxErrorPosition(t *testing.T) {
+	files := map[string]string{
+		"/Testfile":     "a: echo a\ninclude: /inc.Testfile\n",
+		"/inc.Testfile": "b: echo b\n\n# comment\nbad line\n",
+		"/needs":        "a: echo a\nb: echo b\n\tneeds: c\n",
+		"/dup":          "b: echo b\n\nb: echo again\n",
+		"/dupinc":       "include: /dup.Testfile\nb: echo again\n",
+		"/dup.Testfile": "b: echo b\n",
+		"/dupmatrix":    "a: echo a\n\tshards: 2\na: echo a\n",
+		"/option":       "a: echo a\n\ttimeout: 0s\n",
+	}
+	cases := []struct {
+		name string
+		want SyntaxError
+	}{
+		{"/Testfile", SyntaxError{File: "/inc.Testfile", Line: 4, Msg: "bad line: bad line"}},
+		{"/needs", SyntaxError{File: "/needs", Line: 2, Msg: "b needs unknown entry c"}},
+		{"/dup", SyntaxError{File: "/dup", Line: 3, Msg: "duplicate entry b (first at line 1)"}},
+		{"/dupinc", SyntaxError{File: "/dupinc", Line: 2, Msg: "duplicate entry b (first at /dup.Testfile:1)"}},
+		{"/dupmatrix", SyntaxError{File: "/dupmatrix", Line: 3, Msg: "duplicate entry a (first at line 1)"}},
+		{"/option", SyntaxError{File: "/option", Line: 2, Msg: "bad timeout for a: timeout must be positive"}},
+	}
+	for _, test := range cases {
+		_, err := ReadTestfile(test.name, mapOpen(files))
+		if err != test.want {
+			t.Errorf("ReadTestfile(%q) err = %#v, want %#v", test.name, err, test.want)
+		}
+	}
+
+	want := "/inc.Testfile:4: bad line: bad line"
+	if got := cases[0].want.Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+	want = "line 2: x"
+	if got := (SyntaxError{Line: 2, Msg: "x"}).Error(); got != want {
+		t.Errorf("Error() = %q, want %q", got, want)
+	}
+}
+
+const matrixTestfile = `
+gotest: go test ./...
+	matrix: GOFLAGS=-race,
+	matrix: NODE=10, 12
+	timeout: 5m
+lint: golint
+	needs: gotest
+`
+
+func TestParseMatrix(t *testing.T) {
+	tf, err := ParseTestfile(strings.NewReader(matrixTestfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotest := func(name string, matrix ...string) Entry {
+		return Entry{Name: name, Command: "go test ./...", Timeout: 5 * time.Minute, Line: 2, Matrix: matrix}
+	}
+	want := map[string]Entry{
+		"gotest_race_10": gotest("gotest_race_10", "GOFLAGS=-race", "NODE=10"),
+		"gotest_race_12": gotest("gotest_race_12", "GOFLAGS=-race", "NODE=12"),
+		"gotest_none_10": gotest("gotest_none_10", "GOFLAGS=", "NODE=10"),
+		"gotest_none_12": gotest("gotest_none_12", "GOFLAGS=", "NODE=12"),
+		"lint": {
+			Name:    "lint",
+			Command: "golint",
+			Needs:   []string{"gotest_race_10", "gotest_race_12", "gotest_none_10", "gotest_none_12"},
+			Line:    6,
+		},
+	}
+	if !reflect.DeepEqual(tf.Entries, want) {
+		t.Errorf("Entries = %+v, want %+v", tf.Entries, want)
+	}
+}
+
+const shardsTestfile = `
+gotest: go test ./...
+	matrix: NODE=10,12
+	shards: 2
+e2e: make e2e
+	shards: 3
+	shards: 1
+lint: golint
+	needs: gotest_10
+`
+
+func TestParseShards(t *testing.T) {
+	tf, err := ParseTestfile(strings.NewReader(shardsTestfile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gotest := func(name, node string, shard int) Entry {
+		return Entry{Name: name, Command: "go test ./...", Line: 2, Matrix: []string{"NODE=" + node}, Shard: shard, Shards: 2}
+	}
+	want := map[string]Entry{
+		"gotest_10_shard0of2": gotest("gotest_10_shard0of2", "10", 0),
+		"gotest_10_shard1of2": gotest("gotest_10_shard1of2", "10", 1),
+		"gotest_12_shard0of2": gotest("gotest_12_shard0of2", "12", 0),
+		"gotest_12_shard1of2": gotest("gotest_12_shard1of2", "12", 1),
+		"e2e":                 {Name: "e2e", Command: "make e2e", Line: 5},
+		"lint": {
+			Name:    "lint",
+			Command: "golint",
+			Needs:   []string{"gotest_10_shard0of2", "gotest_10_shard1of2"},
+			Line:    8,
+		},
+	}
+	if !reflect.DeepEqual(tf.Entries, want) {
+		t.Errorf("Entries = %+v, want %+v", tf.Entries, want)
+	}
+}
+
+func TestParseShard(t *testing.T) {
+	cases := []struct {
+		name          string
+		entry         string
+		shard, shards int
+		ok            bool
+	}{
+		{"gotest_shard0of4", "gotest", 0, 4, true},
+		{"gotest_race_10_shard3of4", "gotest_race_10", 3, 4, true},
+		{"a_shard1of2_shard1of3", "a_shard1of2", 1, 3, true},
+		{"gotest", "", 0, 0, false},
+		{"_shard0of2", "", 0, 0, false},
+		{"gotest_shard4of4", "", 0, 0, false},
+		{"gotest_shard01of4", "", 0, 0, false},
+		{"gotest_shard-1of4", "", 0, 0, false},
+		{"gotest_shard1", "", 0, 0, false},
+	}
+
+	for _, test := range cases {
+		entry, shard, shards, ok := ParseShard(test.name)
+		if entry != test.entry || shard != test.shard || shards != test.shards || ok != test.ok {
+			t.Errorf("ParseShard(%q) = %q, %d, %d, %v, want %q, %d, %d, %v",
+				test.name, entry, shard, shards, ok, test.entry, test.shard, test.shards, test.ok)
+		}
+	}
+}
+
+func TestParseShardsBad(t *testing.T) {
+	// Names that look like shards, but aren't.
+	cases := []string{
+		"a_shard0of2: b\n",
+		"a: b\n  matrix: X=shard0of2,shard1of2\n",
+	}
+
+	for _, test := range cases {
+		_, err := ParseTestfile(strings.NewReader(test))
+		if _, ok := err.(SyntaxError); !ok {
+			t.Errorf("ParseTestfile(%q) err = %v, want SyntaxError", test, err)
+		}
+	}
+}
+
+func TestParseMatrixBad(t *testing.T) {
+	cases := []string{
+		"a: b\n  matrix: X\n",
+		"a: b\n  matrix: =1,2\n",
+		"a: b\n  matrix: X-Y=1,2\n",
+		"a: b\n  matrix: X=-a,a\n",
+	}
+
+	for _, test := range cases {
+		_, err := ParseTestfile(strings.NewReader(test))
+		if _, ok := err.(SyntaxError); !ok {
+			t.Errorf("ParseTestfile(%q) err = %v, want SyntaxError", test, err)
+		}
+	}
+}
+
+func TestAffected(t *testing.T) {
+	e := Entry{Paths: []string{"db/**/*.sql", "/go.mod"}}
+	cases := []struct {
+		changed []string
+		want    bool
+	}{
+		{[]string{"/server/db/1.sql"}, true},
+		{[]string{"/server/db/a/b/2.sql"}, true},
+		{[]string{"/server/README.md", "/go.mod"}, true},
+		{[]string{"/server/README.md"}, false},
+		{[]string{"/server/db/1.go"}, false},
+		{[]string{"/db/1.sql"}, false},
+		{nil, false},
+	}
+
+	for _, test := range cases {
+		got := e.Affected("/server", test.changed)
+		if got != test.want {
+			t.Errorf("Affected(%q) = %v, want %v", test.changed, got, test.want)
+		}
+	}
+
+	if !(Entry{}).Affected("/server", nil) {
+		t.Errorf("Affected with no paths = false, want true")
+	}
+}
+
+func TestMatchPath(t *testing.T) {
+	cases := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"/a/*.go", "/a/b.go", true},
+		{"/a/*.go", "/a/b/c.go", false},
+		{"/a/**", "/a/b/c.go", true},
+		{"/a/**", "/a", true},
+		{"/a/**/c.go", "/a/c.go", true},
+		{"/a/**/c.go", "/a/b/b/c.go", true},
+		{"/a/**/c.go", "/a/b/d.go", false},
+		{"/**/*.md", "/README.md", true},
+		{"/a/[", "/a/[", false},
+	}
+
+	for _, test := range cases {
+		got := MatchPath(test.pattern, test.name)
+		if got != test.want {
+			t.Errorf("MatchPath(%q, %q) = %v, want %v", test.pattern, test.name, got, test.want)
+		}
+	}
+}
+
 func TestOkNameOk(t *testing.T) {
 	cases := []string{
 		"web",
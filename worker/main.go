@@ -11,11 +11,18 @@ with all necessary runtimes installed. It:
 
 * long polls the `testbot farmer` service
 * receives a job
-* clones the job's `SHA`
+* clones the job's repository, if it hasn't already,
+  and checks out the job's `SHA`, merged into the
+  job's base commit if the farmer sent one
 * changes to the job's directory
 * runs the commands in the job directory's `Testfile`
 * reports results back to the `testbot farmer` service
 
+On SIGTERM, it drains: it tells the farmer to assign it no
+more jobs, waits for its current job, if any, to finish
+(up to $DRAIN_TIMEOUT), cancels the job if it doesn't,
+reporting that as the job's result, and exits.
+
 */
 
 import (
@@ -32,6 +39,7 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"os/user"
 	"path"
 	"path/filepath"
@@ -51,10 +59,14 @@ import (
 var (
 	boxID       = randID()
 	hostname, _ = os.Hostname()
-	org         = os.Getenv("GITHUB_ORG")
-	repo        = os.Getenv("GITHUB_REPO")
-	repoURL     = "https://github.com/" + org + "/" + repo + ".git"
 	farmerURL   = os.Getenv("FARMER_URL")
+
+	// Repositories to clone at startup, each GitHub owner/name,
+	// from space-separated $GITHUB_REPOS or, if that is unset,
+	// $GITHUB_ORG/$GITHUB_REPO. A job from any other repository
+	// gets it cloned when the job starts.
+	repos = strings.Fields(or(os.Getenv("GITHUB_REPOS"), os.Getenv("GITHUB_ORG")+"/"+os.Getenv("GITHUB_REPO")))
+
 	// httpClient is used for all http requests so that we amortize the setup costs
 	httpClient = http.Client{
 		Timeout: 10 * time.Second,
@@ -77,16 +89,24 @@ var (
 	// Make this as tight as we can.
 	jobTimeout = envDuration("JOB_TIMEOUT", "60s")
 
+	// How long to wait for the current job when draining.
+	// Less than the 30s Heroku waits after SIGTERM.
+	drainTimeout = envDuration("DRAIN_TIMEOUT", "25s")
+
 	// Directory layout
 	rootDir = path.Join(os.Getenv("HOME"), "worker")
 	binDir  = path.Join(os.Getenv("HOME"), "bin")
 	outDir  = path.Join(rootDir, "out")
 	wsDir   = path.Join(rootDir, "ws")
-	repoDir = path.Join(wsDir, "src/"+repo)
+
+	// Space-separated labels to advertise to the farmer.
+	// See Labels in testbot.BoxPingReq.
+	labels = strings.Fields(os.Getenv("LABELS"))
 
 	pingReq = testbot.BoxPingReq{
-		ID:   boxID,
-		Host: hostname,
+		ID:     boxID,
+		Host:   hostname,
+		Labels: labels,
 	}
 
 	// Reads $AWS_REGION, $AWS_ACCESS_KEY_ID, and $AWS_SECRET_ACCESS_KEY
@@ -96,8 +116,23 @@ var (
 	curMu  sync.Mutex
 	curOut string
 	curJob testbot.Job
+
+	drainMu  sync.Mutex
+	draining bool
 )
 
+// repoDir returns the directory of the local clone of repo.
+func repoDir(repo string) string {
+	return path.Join(wsDir, "src", repo)
+}
+
+func or(a, b string) string {
+	if a == "" {
+		return b
+	}
+	return a
+}
+
 func envDuration(key, fallback string) time.Duration {
 	s := os.Getenv(key)
 	if s == "" {
@@ -117,6 +152,14 @@ func Main() {
 		os.Exit(1)
 	}
 
+	for _, label := range labels {
+		if !testbot.OKLabel(label) {
+			fmt.Fprintln(os.Stderr, "LABELS has bad label", label)
+			os.Exit(1)
+		}
+	}
+	checkRepos()
+
 	if gitCredentials != "" {
 		writeGHCreds(gitCredentials)
 	}
@@ -132,15 +175,106 @@ func Main() {
 	}()
 	go pollForOutput()
 
-	state := testbot.BoxState{ID: boxID}
+	states := make(chan testbot.BoxState)
+	go func() {
+		state := testbot.BoxState{ID: boxID}
+		for {
+			state = waitState(state)
+			states <- state
+		}
+	}()
+	// SIGTERM cancels ctx, which stops the setup
+	// of a job (see startJob), then drains the box.
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM)
+	ctx, stop := context.WithCancel(context.Background())
+	go func() {
+		<-term
+		stop()
+	}()
+
 	cancel := func() {}
+	var started testbot.BoxState
 	for {
-		state = waitState(state)
-		cancel()
-		cancel = startJob(state.Job)
+		select {
+		case state := <-states:
+			cancel()
+			cancel = startJob(ctx, state.Job, state.Base, state.Attempt)
+			started = state
+		case <-ctx.Done():
+			drain(cancel)
+			release(states, started)
+			fmt.Println("drained box", boxID)
+			os.Exit(0)
+		}
 	}
 }
 
+// drain tells the farmer this box is draining, so it
+// gets no new jobs, then waits up to drainTimeout for
+// the current job, if any, to finish. If it doesn't,
+// drain calls cancel to stop it and report the result.
+func drain(cancel func()) {
+	fmt.Println("draining box", boxID)
+	drainMu.Lock()
+	draining = true
+	drainMu.Unlock()
+	ping()
+
+	deadline := time.Now().Add(drainTimeout)
+	for busy() && time.Now().Before(deadline) {
+		time.Sleep(100 * time.Millisecond)
+	}
+	cancel()
+}
+
+// release gives back any job the farmer assigned to
+// this box, in a state from states, after the last one
+// it started, but before it heard the box is draining,
+// so the farmer can run the job elsewhere without
+// waiting for the box to stop pinging.
+func release(states <-chan testbot.BoxState, started testbot.BoxState) {
+	// The farmer assigns nothing new once it hears the
+	// box is draining, so any such state is already
+	// waiting, or on its way.
+	timeout := time.After(time.Second)
+	for {
+		select {
+		case state := <-states:
+			if state.Job == (testbot.Job{}) || state == started {
+				continue
+			}
+			releaseJob(state.Job)
+		case <-timeout:
+			return
+		}
+	}
+}
+
+// releaseJob tells the farmer this box won't run job,
+// so it goes back in the queue for another box.
+func releaseJob(job testbot.Job) {
+	fmt.Fprintln(os.Stderr, job, "releasing job to drain box")
+	req := testbot.BoxReleaseReq{ID: boxID, Job: job}
+	err := postJSON("/box-release", req, nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, job, "cannot release job", err)
+	}
+}
+
+func isDraining() bool {
+	drainMu.Lock()
+	defer drainMu.Unlock()
+	return draining
+}
+
+// busy returns whether a job is running.
+func busy() bool {
+	curMu.Lock()
+	defer curMu.Unlock()
+	return curJob != (testbot.Job{})
+}
+
 func writeGHCreds(creds string) {
 	usr, err := user.Current()
 	if err != nil {
@@ -169,27 +303,49 @@ func writeGHCreds(creds string) {
 // without registering with the farmer.
 // It writes output to stdout instead of S3.
 // It requires all the same environment as Main.
+// If job.Repo is empty, it uses the first
+// configured repository.
 func OneJob(job testbot.Job) {
+	checkRepos()
+	if job.Repo == "" {
+		job.Repo = repos[0]
+	}
 	if gitCredentials != "" {
 		writeGHCreds(gitCredentials)
 	}
 	initFilesystem()
 	ctx := context.Background()
-	cmd, err := startJobProc(ctx, os.Stdout, job)
+	entry, err := loadEntry(ctx, os.Stdout, job, "")
 	if err != nil {
 		fmt.Fprintln(os.Stderr, job, err)
 		os.Exit(2)
 	}
-	err = cmd.Wait()
-	syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) // kill entire process group
+	if entry.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, entry.Timeout)
+		defer cancel()
+	}
+	root := repoDir(job.Repo)
+	err = runEntry(ctx, root, path.Join(root, job.Dir), os.Stdout, entry)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, job, err)
 		os.Exit(2)
 	}
 }
 
+func checkRepos() {
+	for _, repo := range repos {
+		if !testbot.OKRepo(repo) {
+			fmt.Fprintln(os.Stderr, "GITHUB_REPOS has bad repository", repo)
+			os.Exit(1)
+		}
+	}
+}
+
 func ping() {
-	err := postJSON("/box-ping", pingReq, nil)
+	req := pingReq
+	req.Draining = isDraining()
+	err := postJSON("/box-ping", req, nil)
 	if err != nil {
 		log.Fatalkv(
 			context.Background(),
@@ -238,8 +394,19 @@ func initFilesystem() {
 	must(os.RemoveAll(rootDir))
 	must(os.MkdirAll(wsDir, 0700))
 	must(os.MkdirAll(outDir, 0700))
-	must(command(ctx, os.Stdout, "git", "clone", repoURL, repoDir).Run())
-	must(runIn(ctx, repoDir, command(ctx, os.Stdout, "git", "checkout", "-bt")))
+	for _, repo := range repos {
+		must(cloneRepo(ctx, os.Stdout, repo))
+	}
+}
+
+// cloneRepo clones repo into repoDir(repo).
+func cloneRepo(ctx context.Context, w io.Writer, repo string) error {
+	dir := repoDir(repo)
+	err := command(ctx, w, "git", "clone", "https://github.com/"+repo+".git", dir).Run()
+	if err != nil {
+		return err
+	}
+	return runIn(ctx, dir, command(ctx, w, "git", "checkout", "-bt"))
 }
 
 func waitState(oldState testbot.BoxState) (newState testbot.BoxState) {
@@ -265,7 +432,13 @@ func getState(oldState testbot.BoxState) testbot.BoxState {
 	return newState
 }
 
-func startJob(job testbot.Job) func() {
+// startJob starts running job, merged into commit
+// base, if any, as the given attempt.
+// It returns a function that stops it.
+// It sets up the job before it returns; canceling ctx
+// stops that, and gives the job back to the farmer
+// (see releaseJob), but doesn't stop a running job.
+func startJob(ctx context.Context, job testbot.Job, base string, attempt int) func() {
 	start := time.Now()
 	if job == (testbot.Job{}) {
 		// nothing to do
@@ -288,7 +461,11 @@ func startJob(job testbot.Job) func() {
 		}
 	}
 
-	postStatus("pending", "running", "")
+	running := "running"
+	if attempt > 1 {
+		running = fmt.Sprintf("running (attempt %d)", attempt)
+	}
+	postStatus("pending", running, "")
 
 	f, err := os.Create(path.Join(outDir, outputFile(job)))
 	if err != nil {
@@ -302,23 +479,29 @@ func startJob(job testbot.Job) func() {
 	curJob = job
 	curMu.Unlock()
 
-	cmddir := filepath.Join(repoDir, filepath.FromSlash(job.Dir))
+	if attempt > 1 {
+		fmt.Fprintln(f, "attempt", attempt)
+	}
+
+	root := repoDir(job.Repo)
+	cmddir := filepath.Join(root, filepath.FromSlash(job.Dir))
 
-	// must be called exactly once (to close f)
+	// one of these must be called exactly once (to close f)
+	closeOutput := func() {
+		f.Close()
+		curMu.Lock()
+		curJob = testbot.Job{}
+		curOut = ""
+		curMu.Unlock()
+	}
 	uploadAndPostStatus := func(status, desc string) {
-		defer func() {
-			curMu.Lock()
-			curJob = testbot.Job{}
-			curOut = ""
-			curMu.Unlock()
-		}()
-		defer f.Close()
+		defer closeOutput()
 
 		fmt.Fprintln(f, desc)
 		f.Seek(0, 0)
 		if s := scanError(f); s != "" && status != "success" {
 			s = strings.Replace(s, cmddir+"/", "", -1)
-			s = strings.Replace(s, repoDir+"/", "$I10R/", -1)
+			s = strings.Replace(s, root+"/", "$I10R/", -1)
 			desc += ": " + s
 		}
 		f.Seek(0, 0)
@@ -331,26 +514,40 @@ func startJob(job testbot.Job) func() {
 		postStatus(status, desc, u)
 	}
 
-	jobCtx := context.Background()
-	jobCtx, cancel := context.WithTimeout(jobCtx, jobTimeout)
-	cmd, err := startJobProc(jobCtx, f, job)
-	if err != nil {
-		cancel()
+	setupCtx, cancelSetup := context.WithTimeout(ctx, jobTimeout)
+	entry, err := loadEntry(setupCtx, f, job, base)
+	cancelSetup()
+	if err != nil && ctx.Err() != nil {
+		fmt.Fprintln(os.Stderr, job, "canceled setting up job:", err)
+		closeOutput()
+		releaseJob(job)
+		return func() {}
+	} else if err != nil {
 		fmt.Fprintln(os.Stderr, job, err)
 		uploadAndPostStatus("error", err.Error())
 		return func() {}
 	}
 
-	// wait for job, post result status
+	timeout := jobTimeout
+	if entry.Timeout > 0 {
+		timeout = entry.Timeout
+	}
+	jobCtx, cancel := context.WithDeadline(context.Background(), start.Add(timeout))
+
+	// run job, post result status
 	done := make(chan int)
 	go func() {
 		defer close(done) // ok to start next job
 
-		jobErr := cmd.Wait()
-		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL) // kill entire process group
-
-		if jobErr != nil && jobCtx.Err() != nil {
+		jobErr := runEntry(jobCtx, root, cmddir, f, entry)
+		if jobErr != nil && jobCtx.Err() == context.Canceled && isDraining() {
+			fmt.Fprintln(os.Stderr, job, "canceled running job to drain box")
+			uploadAndPostStatus("error", "canceled: worker shut down: "+jobErr.Error())
+		} else if jobErr != nil && jobCtx.Err() != nil {
 			uploadAndPostStatus("error", fmt.Sprintf("canceled automatically: %s: %s", jobCtx.Err(), jobErr))
+		} else if jobErr != nil && entry.AllowFailure {
+			fmt.Fprintln(os.Stderr, job, "allowed failure running job", jobErr)
+			uploadAndPostStatus("success", "allowed failure: "+jobErr.Error())
 		} else if jobErr != nil {
 			fmt.Fprintln(os.Stderr, job, "failure running job", jobErr)
 			uploadAndPostStatus("failure", jobErr.Error())
@@ -364,56 +561,87 @@ func startJob(job testbot.Job) func() {
 	return func() { cancel(); <-done }
 }
 
-func startJobProc(ctx context.Context, w io.Writer, job testbot.Job) (*exec.Cmd, error) {
+// loadEntry checks out job.SHA in job.Repo, merged
+// into commit base, if any, and returns the Testfile
+// entry for job.
+func loadEntry(ctx context.Context, w io.Writer, job testbot.Job, base string) (testbot.Entry, error) {
 	fmt.Fprintln(w, "starting job", job)
 	fmt.Fprintln(w, "worker host", hostname)
 
 	start := time.Now()
 	var setupBuf bytes.Buffer
-	err := setupJob(ctx, &setupBuf, job.SHA)
+	err := setupJob(ctx, &setupBuf, job.Repo, job.SHA, base)
 	if err != nil {
 		w.Write(setupBuf.Bytes())
-		return nil, fmt.Errorf("clone: %w", err)
+		return testbot.Entry{}, fmt.Errorf("clone: %w", err)
 	}
 	fmt.Fprintln(w, "setup ok", time.Since(start))
-	cmddir := path.Join(repoDir, job.Dir)
-
-	// Run the actual tests:
-
-	testfile, err := os.Open(path.Join(cmddir, "Testfile"))
-	if err != nil {
-		return nil, err
-	}
-	defer testfile.Close()
-
-	entries, err := testbot.ParseTestfile(testfile)
+	testfile := path.Join(job.Dir, "Testfile")
+	tf, err := testbot.ReadTestfile(testfile, repoOpen(repoDir(job.Repo)))
 	if err != nil {
-		fmt.Fprintf(w, "parse %s: %v\n", testfile.Name(), err)
-		return nil, err
+		fmt.Fprintf(w, "parse %s: %v\n", testfile, err)
+		return testbot.Entry{}, err
 	}
 
-	cmd, ok := entries[job.Name]
+	entry, ok := tf.Entries[job.Name]
 	if !ok {
 		fmt.Fprintln(w, "cannot find Testfile entry", job.Name)
-		return nil, fmt.Errorf("cannot find Testfile entry %s", job.Name)
+		return testbot.Entry{}, fmt.Errorf("cannot find Testfile entry %s", job.Name)
+	}
+	return entry, nil
+}
+
+// repoOpen returns an OpenFunc that opens name,
+// an absolute path in the repo, in the local clone
+// at root.
+func repoOpen(root string) testbot.OpenFunc {
+	return func(name string) (io.ReadCloser, error) {
+		return os.Open(filepath.Join(root, filepath.FromSlash(name)))
 	}
+}
 
-	c := prepareCommand(ctx, cmddir, w, cmd)
-	return c, c.Start()
+// runEntry runs the actual tests for entry in dir,
+// in the local clone at root.
+// It kills the entire process group
+// once the main process exits.
+// It doesn't retry a failure; the farmer
+// does that, as a new attempt.
+func runEntry(ctx context.Context, root, dir string, w io.Writer, entry testbot.Entry) error {
+	c := prepareCommand(ctx, root, dir, w, entry)
+	err := c.Start()
+	if err != nil {
+		return err
+	}
+	err = c.Wait()
+	syscall.Kill(-c.Process.Pid, syscall.SIGKILL) // kill entire process group
+	return err
 }
 
-func prepareCommand(ctx context.Context, dir string, w io.Writer, cmd string) *exec.Cmd {
-	c := command(ctx, w, "/bin/bash", "-eo", "pipefail", "-c", cmd)
+func prepareCommand(ctx context.Context, root, dir string, w io.Writer, entry testbot.Entry) *exec.Cmd {
+	c := command(ctx, w, "/bin/bash", "-eo", "pipefail", "-c", entry.Command)
 	c.Env = append(os.Environ(),
-		"CHAIN="+repoDir,
-		"I10R="+repoDir,
+		"CHAIN="+root,
+		"I10R="+root,
 		"GOBIN="+binDir,
 		"NETLIFY_AUTH_TOKEN="+netlify,
-		"PATH="+binDir+":"+repoDir+"/bin:"+os.Getenv("PATH"),
+		"PATH="+binDir+":"+root+"/bin:"+os.Getenv("PATH"),
 	)
+	// Entry env and matrix variables come last
+	// so they can override the above.
+	env := append(entry.Env[:len(entry.Env):len(entry.Env)], entry.Matrix...)
+	if entry.Shards > 0 {
+		env = append(env,
+			"TESTBOT_SHARD_INDEX="+strconv.Itoa(entry.Shard),
+			"TESTBOT_SHARD_TOTAL="+strconv.Itoa(entry.Shards),
+		)
+	}
+	c.Env = append(c.Env, env...)
 	c.Dir = dir
 	fmt.Fprintln(w, "cd", c.Dir)
-	fmt.Fprintln(w, cmd)
+	for _, kv := range env {
+		fmt.Fprintln(w, "export", kv)
+	}
+	fmt.Fprintln(w, entry.Command)
 	return c
 }
 
@@ -432,6 +660,7 @@ func sendOutput(j testbot.Job) {
 		return
 	}
 	req.Header.Set("Box-ID", boxID)
+	req.Header.Set("Job-Repo", j.Repo)
 	req.Header.Set("Job-SHA", j.SHA)
 	req.Header.Set("Job-Dir", j.Dir)
 	req.Header.Set("Job-Name", j.Name)
@@ -475,34 +704,58 @@ func must(err error) {
 	}
 }
 
-func setupJob(ctx context.Context, w io.Writer, sha string) error {
-	// Make sure we have sha in the local clone.
-	if !objectExists(ctx, w, sha) {
-		err := runIn(ctx, repoDir, command(ctx, w, "git", "fetch"))
+func setupJob(ctx context.Context, w io.Writer, repo, sha, base string) error {
+	if !testbot.OKRepo(repo) {
+		return fmt.Errorf("bad repository %q", repo)
+	}
+	dir := repoDir(repo)
+	if _, err := os.Stat(filepath.Join(dir, ".git")); os.IsNotExist(err) {
+		err = cloneRepo(ctx, w, repo)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Make sure we have sha (and base) in the local clone.
+	if !objectExists(ctx, w, dir, sha) || base != "" && !objectExists(ctx, w, dir, base) {
+		err := runIn(ctx, dir, command(ctx, w, "git", "fetch"))
 		if err != nil {
 			// Sometimes this fails, and trying again usually works.
 			// So try again just one more time, after a brief wait.
 			// If it still fails after that, give up.
 			time.Sleep(2 * time.Second)
-			err = runIn(ctx, repoDir, command(ctx, w, "git", "fetch"))
+			err = runIn(ctx, dir, command(ctx, w, "git", "fetch"))
 		}
 		if err != nil {
 			return err
 		}
 	}
 
-	err := runIn(ctx, repoDir, command(ctx, w, "git", "clean", "-xdf"))
+	err := runIn(ctx, dir, command(ctx, w, "git", "clean", "-xdf"))
 	if err != nil {
 		return err
 	}
-	return runIn(ctx, repoDir, command(ctx, w, "git", "reset", "--hard", sha))
+	err = runIn(ctx, dir, command(ctx, w, "git", "reset", "--hard", sha))
+	if err != nil || base == "" {
+		return err
+	}
+	fmt.Fprintln(w, "merging into base", base)
+	err = runIn(ctx, dir, command(ctx, w, "git",
+		"-c", "user.name=testbot", "-c", "user.email=testbot@localhost",
+		"merge", "--no-edit", "--no-ff", base,
+	))
+	if err != nil {
+		runIn(ctx, dir, command(ctx, w, "git", "merge", "--abort"))
+		return fmt.Errorf("merge into base %.8s: %w", base, err)
+	}
+	return nil
 }
 
 // objectExists returns whether the object definitely exists.
 // It returns false if the object doesn't exist, or if there
 // was an error.
-func objectExists(ctx context.Context, w io.Writer, sha string) bool {
-	err := runIn(ctx, repoDir, command(ctx, w, "git", "cat-file", "-e", sha))
+func objectExists(ctx context.Context, w io.Writer, dir, sha string) bool {
+	err := runIn(ctx, dir, command(ctx, w, "git", "cat-file", "-e", sha))
 	return err == nil
 }
 